@@ -2,21 +2,32 @@ package main
 
 import (
 	"archive/tar"
+	"archive/zip"
+	"bufio"
+	"bytes"
 	"compress/bzip2"
 	"compress/gzip"
 	"context"
+	"crypto/sha256"
+	"encoding/hex"
 	"errors"
 	"fmt"
 	"io"
 	"io/fs"
 	"log/slog"
+	"math"
 	"os"
 	"path"
 	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
 	"time"
 
 	"github.com/aibor/cpio"
 	"github.com/klauspost/compress/zstd"
+	"github.com/mook/obs-service-dotnet_packages/version"
+	"github.com/ulikunitz/xz"
 )
 
 type compressionType string
@@ -25,6 +36,7 @@ const (
 	compressionTypeNone = "none"
 	compressionTypeGZip = "gz"
 	compressionTypeZstd = "zst"
+	compressionTypeXz   = "xz"
 )
 
 func (c *compressionType) String() string {
@@ -36,25 +48,272 @@ func (c *compressionType) String() string {
 
 func (c *compressionType) Set(value string) error {
 	switch value {
-	case compressionTypeNone, compressionTypeGZip, compressionTypeZstd:
+	case compressionTypeNone, compressionTypeGZip, compressionTypeZstd, compressionTypeXz:
 		*c = compressionType(value)
 		return nil
 	}
 	return fmt.Errorf("invalid copmression type %s", value)
 }
 
-func createArchive(sourceDir, outputBase string, compressionType compressionType) error {
-	var extension string
+// The file extension of archives created with the given compression.
+func archiveExtension(compressionType compressionType) string {
+	switch compressionType {
+	case compressionTypeGZip:
+		return ".tar.gz"
+	case compressionTypeZstd:
+		return ".tar.zst"
+	case compressionTypeXz:
+		return ".tar.xz"
+	}
+	return ".tar"
+}
+
+// outputFormat is the archive format of the output.
+type outputFormat string
+
+const (
+	outputFormatTar  = "tar"
+	outputFormatCpio = "cpio"
+	outputFormatZip  = "zip"
+)
+
+func (f *outputFormat) String() string {
+	if f == nil {
+		return "<nil>"
+	}
+	return string(*f)
+}
+
+func (f *outputFormat) Set(value string) error {
+	switch value {
+	case outputFormatTar, outputFormatCpio, outputFormatZip:
+		*f = outputFormat(value)
+		return nil
+	}
+	return fmt.Errorf("invalid format %s", value)
+}
+
+// The file extension of the output archive. OBS compresses .obscpio archives
+// itself, and zip archives compress each file, so neither is compressed.
+func outputExtension(opts *options) string {
+	return formatExtension(opts.format, opts.compression)
+}
+
+// The file extension of archives in the given format and compression.
+func formatExtension(format outputFormat, compression compressionType) string {
+	switch format {
+	case outputFormatCpio:
+		return ".obscpio"
+	case outputFormatZip:
+		return ".zip"
+	}
+	return archiveExtension(compression)
+}
+
+type outputLayout string
+
+const (
+	outputLayoutFlat   = "flat"
+	outputLayoutNested = "nested"
+)
+
+func (l *outputLayout) String() string {
+	if l == nil {
+		return "<nil>"
+	}
+	return string(*l)
+}
+
+func (l *outputLayout) Set(value string) error {
+	switch value {
+	case outputLayoutFlat, outputLayoutNested:
+		*l = outputLayout(value)
+		return nil
+	}
+	return fmt.Errorf("invalid layout %s", value)
+}
+
+// Create a directory containing a <id>.tar.zst archive of each package in
+// packagesDir, so that unchanged packages produce unchanged files. Other files
+// are copied as they are. The caller must remove the returned directory.
+func nestPackages(ctx context.Context, packagesDir string) (string, error) {
+	nestedDir, err := os.MkdirTemp("", "obs-service-dotnet-packages-nested-*")
+	if err != nil {
+		return "", err
+	}
+	entries, err := os.ReadDir(packagesDir)
+	if err != nil {
+		return nestedDir, err
+	}
+	for _, entry := range entries {
+		source := filepath.Join(packagesDir, entry.Name())
+		target := filepath.Join(nestedDir, entry.Name())
+		if !entry.IsDir() {
+			buf, err := os.ReadFile(source)
+			if err != nil {
+				return nestedDir, err
+			}
+			if err := os.WriteFile(target, buf, 0o644); err != nil {
+				return nestedDir, err
+			}
+			continue
+		}
+		slog.DebugContext(ctx, "creating package archive", "package", entry.Name())
+		if err := createArchive(ctx, source, target, outputFormatTar, compressionTypeZstd); err != nil {
+			return nestedDir, fmt.Errorf("failed to create archive for %s: %w", entry.Name(), err)
+		}
+	}
+	return nestedDir, nil
+}
+
+// Create the output archive from a package directory, in the layout and with
+// the compression selected in the options.
+func writeOutput(ctx context.Context, packagesDir, outputBase string) error {
+	opts := optionsFrom(ctx)
+	archiveDir := packagesDir
+	if opts.layout == outputLayoutNested {
+		var err error
+		archiveDir, err = nestPackages(ctx, packagesDir)
+		defer os.RemoveAll(archiveDir)
+		if err != nil {
+			return fmt.Errorf("error creating package archives: %w", err)
+		}
+	}
+	if err := createArchive(ctx, archiveDir, outputBase, opts.format, opts.compression); err != nil {
+		return fmt.Errorf("error creating output archive: %w", err)
+	}
+	if opts.format == outputFormatCpio {
+		if err := writeObsinfo(ctx, outputBase); err != nil {
+			return fmt.Errorf("error writing obsinfo: %w", err)
+		}
+	}
+	return nil
+}
+
+// Write the .obsinfo file OBS expects next to a .obscpio archive. The mtime
+// is SOURCE_DATE_EPOCH if it is set, so that it is reproducible.
+func writeObsinfo(ctx context.Context, outputBase string) error {
+	opts := optionsFrom(ctx)
+	mtime, ok := sourceDateEpoch(ctx)
+	if !ok {
+		mtime = time.Now()
+	}
+	var buf bytes.Buffer
+	fmt.Fprintf(&buf, "name: %s\n", filepath.Base(outputBase))
+	if len(opts.archives) > 0 {
+		if v := version.FromFilename(filepath.Base(opts.archives[0])); v != "" {
+			fmt.Fprintf(&buf, "version: %s\n", v)
+		}
+	}
+	fmt.Fprintf(&buf, "mtime: %d\n", mtime.Unix())
+	return os.WriteFile(outputBase+".obsinfo", buf.Bytes(), 0o644)
+}
+
+// archiveWriter writes the members of an output archive.
+type archiveWriter interface {
+	io.WriteCloser
+	// Start a member; the name of directories ends in a slash.
+	writeHeader(name string, info fs.FileInfo) error
+}
+
+type tarArchiveWriter struct {
+	*tar.Writer
+	ctx context.Context
+}
+
+func (w tarArchiveWriter) writeHeader(name string, info fs.FileInfo) error {
+	h, err := tar.FileInfoHeader(info, "")
+	if err != nil {
+		return err
+	}
+	h.Name = name
+	h.Uid = 0
+	h.Uname = ""
+	h.Gid = 0
+	h.Gname = ""
+	if epoch, ok := sourceDateEpoch(w.ctx); ok {
+		// Clamp times to SOURCE_DATE_EPOCH, and drop the others, so
+		// that the archive does not depend on when it was created.
+		if h.ModTime.After(epoch) {
+			h.ModTime = epoch
+		}
+		h.AccessTime = time.Time{}
+		h.ChangeTime = time.Time{}
+	}
+	return w.WriteHeader(h)
+}
+
+type cpioArchiveWriter struct {
+	*cpio.Writer
+	ctx context.Context
+}
+
+func (w cpioArchiveWriter) writeHeader(name string, info fs.FileInfo) error {
+	h, err := cpio.FileInfoHeader(info)
+	if err != nil {
+		return err
+	}
+	// Like cpio(1), directory names do not end in a slash.
+	h.Name = strings.TrimSuffix(name, "/")
+	if epoch, ok := sourceDateEpoch(w.ctx); ok && h.ModTime.After(epoch) {
+		h.ModTime = epoch
+	}
+	return w.WriteHeader(h)
+}
+
+type zipArchiveWriter struct {
+	*zip.Writer
+	ctx    context.Context
+	member io.Writer
+}
+
+func (w *zipArchiveWriter) writeHeader(name string, info fs.FileInfo) error {
+	h, err := zip.FileInfoHeader(info)
+	if err != nil {
+		return err
+	}
+	h.Name = name
+	if info.Mode().IsRegular() {
+		h.Method = zip.Deflate
+	}
+	// Zip stores the local time of the header, so use UTC to get the same
+	// archive in every time zone.
+	h.Modified = h.Modified.UTC()
+	if epoch, ok := sourceDateEpoch(w.ctx); ok && h.Modified.After(epoch) {
+		h.Modified = epoch
+	}
+	w.member, err = w.CreateHeader(h)
+	return err
+}
+
+func (w *zipArchiveWriter) Write(p []byte) (int, error) {
+	return w.member.Write(p)
+}
+
+// The window size for zstd long mode (-zstd-long).
+const zstdLongWindowSize = 1 << 27
+
+func createArchive(ctx context.Context, sourceDir, outputBase string, format outputFormat, compressionType compressionType) error {
+	extension := formatExtension(format, compressionType)
+	if format != outputFormatTar {
+		compressionType = compressionTypeNone
+	}
 	compress := func(w io.Writer) (io.Writer, error) { return w, nil }
 	switch compressionType {
-	case compressionTypeNone:
-		extension = ".tar"
 	case compressionTypeGZip:
-		extension = ".tar.gz"
 		compress = func(w io.Writer) (io.Writer, error) { return gzip.NewWriter(w), nil }
+	case compressionTypeXz:
+		compress = func(w io.Writer) (io.Writer, error) { return xz.NewWriter(w) }
 	case compressionTypeZstd:
-		extension = ".tar.zst"
 		compress = func(w io.Writer) (io.Writer, error) { return zstd.NewWriter(w) }
+		if optionsFrom(ctx).zstdLong {
+			// A window of 128 MiB (like zstd --long) lets similar files far
+			// apart in the archive share matches, and is still the largest
+			// window zstd decompresses without --long.
+			compress = func(w io.Writer) (io.Writer, error) {
+				return zstd.NewWriter(w, zstd.WithWindowSize(zstdLongWindowSize), zstd.WithEncoderLevel(zstd.SpeedBestCompression))
+			}
+		}
 	}
 
 	outputPath := outputBase + extension
@@ -71,7 +330,13 @@ func createArchive(sourceDir, outputBase string, compressionType compressionType
 	if err != nil {
 		return err
 	}
-	tarWriter := tar.NewWriter(compressWriter)
+	var archive archiveWriter = tarArchiveWriter{tar.NewWriter(compressWriter), ctx}
+	switch format {
+	case outputFormatCpio:
+		archive = cpioArchiveWriter{cpio.NewWriter(compressWriter), ctx}
+	case outputFormatZip:
+		archive = &zipArchiveWriter{Writer: zip.NewWriter(compressWriter), ctx: ctx}
+	}
 
 	// Use a custom walk function to avoid embedding user/group info into the archive.
 	dirFS := os.DirFS(sourceDir)
@@ -89,19 +354,14 @@ func createArchive(sourceDir, outputBase string, compressionType compressionType
 		if !d.IsDir() && !info.Mode().IsRegular() {
 			return fmt.Errorf("failed to handle non-regular file %s", path)
 		}
-		h, err := tar.FileInfoHeader(info, "")
+		name, err := checkWindowsPath(ctx, path)
 		if err != nil {
 			return err
 		}
-		h.Name = path
 		if d.IsDir() {
-			h.Name += "/"
+			name += "/"
 		}
-		h.Uid = 0
-		h.Uname = ""
-		h.Gid = 0
-		h.Gname = ""
-		if err := tarWriter.WriteHeader(h); err != nil {
+		if err := archive.writeHeader(name, info); err != nil {
 			return err
 		}
 		if info.Mode().IsRegular() {
@@ -110,7 +370,7 @@ func createArchive(sourceDir, outputBase string, compressionType compressionType
 				return err
 			}
 			defer f.Close()
-			_, err = io.Copy(tarWriter, f)
+			_, err = io.Copy(archive, f)
 			return err
 		}
 		return nil
@@ -118,7 +378,7 @@ func createArchive(sourceDir, outputBase string, compressionType compressionType
 	if err != nil {
 		return err
 	}
-	if err := tarWriter.Close(); err != nil {
+	if err := archive.Close(); err != nil {
 		return err
 	}
 	if closer, ok := compressWriter.(io.Closer); ok {
@@ -138,16 +398,277 @@ func createArchive(sourceDir, outputBase string, compressionType compressionType
 	return os.Rename(outputFile.Name(), outputPath)
 }
 
-// Extract an archive, returning the names of the solution files.
+// Extensions of source archives that can be extracted.
+var sourceArchiveExts = []string{
+	".obscpio",
+	".src.rpm",
+	".tar",
+	".tar.bz2",
+	".tar.gz",
+	".tar.xz",
+	".tar.zst",
+	".tbz2",
+	".tgz",
+	".txz",
+	".zip",
+}
+
+// Magic numbers of supported compression formats.
+var compressionMagic = []struct {
+	magic      []byte
+	decompress func(io.Reader) (io.Reader, error)
+}{
+	{[]byte{0x1f, 0x8b}, func(r io.Reader) (io.Reader, error) { return gzip.NewReader(r) }},
+	{[]byte("BZh"), func(r io.Reader) (io.Reader, error) { return bzip2.NewReader(r), nil }},
+	{[]byte{0x28, 0xb5, 0x2f, 0xfd}, func(r io.Reader) (io.Reader, error) { return zstd.NewReader(r) }},
+	{[]byte{0xfd, '7', 'z', 'X', 'Z', 0x00}, func(r io.Reader) (io.Reader, error) { return xz.NewReader(r) }},
+}
+
+// stripComponents is the number of leading path components to remove from the
+// members of source archives, or stripComponentsAuto.
+type stripComponents int
+
+// stripComponentsAuto removes the top-level directory if it is the only member
+// at the top level, as %setup expects.
+const stripComponentsAuto stripComponents = -1
+
+func (c *stripComponents) String() string {
+	if c == nil {
+		return "<nil>"
+	}
+	if *c == stripComponentsAuto {
+		return "auto"
+	}
+	return strconv.Itoa(int(*c))
+}
+
+func (c *stripComponents) Set(value string) error {
+	if value == "auto" {
+		*c = stripComponentsAuto
+		return nil
+	}
+	n, err := strconv.Atoi(value)
+	if err != nil || n < 0 {
+		return fmt.Errorf("invalid number of components %s", value)
+	}
+	*c = stripComponents(n)
+	return nil
+}
+
+// Extract a source archive into outDir, removing leading path components as
+// given by -strip-components. Returns the names of the solution files.  The
+// archive and any archives nested in it share the limits of the run, or new
+// ones if the run has none.
+func extractSources(ctx context.Context, archivePath, outDir string) ([]string, error) {
+	ctx = withExtractLimits(ctx, extractLimitsFrom(ctx))
+	strip := optionsFrom(ctx).stripComponents
+	if strip == 0 {
+		return extractArchive(ctx, archivePath, outDir)
+	}
+	tempDir, err := os.MkdirTemp(outDir, ".extract-*")
+	if err != nil {
+		return nil, err
+	}
+	defer os.RemoveAll(tempDir)
+	solutions, err := extractArchive(ctx, archivePath, tempDir)
+	if err != nil {
+		return nil, err
+	}
+	if strip == stripComponentsAuto {
+		strip = 0
+		entries, err := os.ReadDir(tempDir)
+		if err != nil {
+			return nil, err
+		}
+		if len(entries) == 1 && entries[0].IsDir() {
+			strip = 1
+		}
+		slog.DebugContext(ctx, "detected leading path components", "archive", archivePath, "count", strip)
+	}
+
+	// Move everything at the given depth into outDir; like tar, members
+	// above it are dropped.
+	dirs := []string{"."}
+	for range strip {
+		var next []string
+		for _, dir := range dirs {
+			entries, err := os.ReadDir(filepath.Join(tempDir, dir))
+			if err != nil {
+				return nil, err
+			}
+			for _, entry := range entries {
+				if entry.IsDir() {
+					next = append(next, filepath.Join(dir, entry.Name()))
+				}
+			}
+		}
+		dirs = next
+	}
+	for _, dir := range dirs {
+		entries, err := os.ReadDir(filepath.Join(tempDir, dir))
+		if err != nil {
+			return nil, err
+		}
+		for _, entry := range entries {
+			target := filepath.Join(outDir, entry.Name())
+			if _, err := os.Lstat(target); err == nil {
+				return nil, fmt.Errorf("failed to strip components of %s: %s exists more than once", archivePath, entry.Name())
+			}
+			if err := os.Rename(filepath.Join(tempDir, dir, entry.Name()), target); err != nil {
+				return nil, err
+			}
+		}
+	}
+	var stripped []string
+	for _, solution := range solutions {
+		parts := strings.Split(path.Clean(solution), "/")
+		if len(parts) > int(strip) {
+			stripped = append(stripped, path.Join(parts[strip:]...))
+		}
+	}
+	return stripped, nil
+}
+
+// Extract an archive, returning the names of the solution files. The format
+// is detected from the contents, regardless of the file name.
 func extractArchive(ctx context.Context, archivePath, outDir string) ([]string, error) {
 	slog.InfoContext(ctx, "extracting archive", "archive", archivePath)
-	switch filepath.Ext(archivePath) {
-	case ".cpio", ".obscpio":
-		return extractCpio(ctx, archivePath, outDir)
-	case ".tar", ".tar.gz", ".tar.zst":
-		return extractTar(ctx, archivePath, outDir)
+	file, err := os.Open(archivePath)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open archive %s: %w", archivePath, err)
+	}
+	defer file.Close()
+
+	// Zip archives need random access, so they can not be compressed.
+	raw := bufio.NewReader(file)
+	magic, _ := raw.Peek(4)
+	switch {
+	case bytes.Equal(magic, []byte("PK\x03\x04")):
+		return extractZip(ctx, archivePath, outDir)
+	case bytes.Equal(magic, rpmLeadMagic):
+		solutions, err := extractRPM(ctx, raw, outDir)
+		if err != nil {
+			return nil, fmt.Errorf("failed to extract rpm %s: %w", archivePath, err)
+		}
+		return solutions, nil
 	}
-	return nil, fmt.Errorf("unsupported archive format %s", filepath.Ext(archivePath))
+	solutions, err := extractStream(ctx, raw, outDir)
+	if err != nil {
+		return nil, fmt.Errorf("failed to extract archive %s: %w", archivePath, err)
+	}
+	return solutions, nil
+}
+
+// Extract a (possibly compressed) tar or cpio archive, returning the names of
+// the solution files.
+func extractStream(ctx context.Context, raw *bufio.Reader, outDir string) ([]string, error) {
+	var stream io.Reader = raw
+	for _, compression := range compressionMagic {
+		if magic, _ := raw.Peek(len(compression.magic)); bytes.Equal(magic, compression.magic) {
+			var err error
+			if stream, err = compression.decompress(raw); err != nil {
+				return nil, fmt.Errorf("failed to decompress: %w", err)
+			}
+			break
+		}
+	}
+	if decoder, ok := stream.(*zstd.Decoder); ok {
+		defer decoder.Close()
+	}
+
+	// Check for a cpio (new ASCII format) or tar (POSIX or GNU) header.
+	buffered := bufio.NewReaderSize(stream, 512)
+	header, _ := buffered.Peek(512)
+	switch {
+	case bytes.HasPrefix(header, []byte("07070")):
+		return extractCpio(ctx, buffered, outDir, extractLimitsFrom(ctx))
+	case len(header) >= 262 && bytes.Equal(header[257:262], []byte("ustar")):
+		return extractTar(ctx, buffered, outDir, extractLimitsFrom(ctx))
+	}
+	return nil, fmt.Errorf("unsupported archive format")
+}
+
+// errExtractLimit is returned when an archive exceeds one of the limits on
+// the size of the extracted sources.
+var errExtractLimit = errors.New("archive exceeds extraction limit")
+
+// byteSize is a flag for a number of bytes, with an optional K, M, G or T
+// (binary) suffix.
+type byteSize int64
+
+func (b *byteSize) String() string {
+	if b == nil {
+		return "<nil>"
+	}
+	return strconv.FormatInt(int64(*b), 10)
+}
+
+func (b *byteSize) Set(value string) error {
+	number, shift := value, 0
+	if i := strings.IndexAny(strings.ToUpper(value), "KMGT"); i >= 0 && i == len(value)-1 {
+		number, shift = value[:i], 10*(strings.IndexByte("KMGT", strings.ToUpper(value)[i])+1)
+	}
+	n, err := strconv.ParseInt(number, 10, 64)
+	if err != nil || n < 0 || n > math.MaxInt64>>shift {
+		return fmt.Errorf("invalid size %s", value)
+	}
+	*b = byteSize(n << shift)
+	return nil
+}
+
+// extractLimits tracks the members of an archive being extracted against the
+// -max-extract-* limits; a limit of zero is unlimited.
+type extractLimits struct {
+	maxFiles    int
+	maxFileSize int64
+	maxSize     int64
+	files       int
+	size        int64
+}
+
+func newExtractLimits(ctx context.Context) *extractLimits {
+	opts := optionsFrom(ctx)
+	return &extractLimits{
+		maxFiles:    opts.maxExtractFiles,
+		maxFileSize: int64(opts.maxExtractFileSize),
+		maxSize:     int64(opts.maxExtractSize),
+	}
+}
+
+type extractLimitsKey struct{}
+
+// Return a context in which every archive extracted counts against the same
+// limits, so that archives nested in others (such as the sources in a source
+// rpm) can not each use the whole budget.
+func withExtractLimits(ctx context.Context, limits *extractLimits) context.Context {
+	return context.WithValue(ctx, extractLimitsKey{}, limits)
+}
+
+// The limits of the run the context belongs to, or new ones if it has none.
+func extractLimitsFrom(ctx context.Context) *extractLimits {
+	if limits, ok := ctx.Value(extractLimitsKey{}).(*extractLimits); ok {
+		return limits
+	}
+	return newExtractLimits(ctx)
+}
+
+// Account for a member about to be extracted, failing if a limit is exceeded.
+// The readers of all supported formats fail if a member is larger than its
+// header says, so the size in the header can be trusted.  The size of every
+// member counts, as the bodies of symlinks are read too.
+func (l *extractLimits) add(fileInfo fileInfo) error {
+	l.files++
+	if l.maxFiles > 0 && l.files > l.maxFiles {
+		return fmt.Errorf("%w: more than %d files", errExtractLimit, l.maxFiles)
+	}
+	if l.maxFileSize > 0 && fileInfo.Size() > l.maxFileSize {
+		return fmt.Errorf("%w: %s is %d bytes, more than %d", errExtractLimit, fileInfo.name, fileInfo.Size(), l.maxFileSize)
+	}
+	l.size += fileInfo.Size()
+	if l.maxSize > 0 && l.size > l.maxSize {
+		return fmt.Errorf("%w: more than %d bytes in total", errExtractLimit, l.maxSize)
+	}
+	return nil
 }
 
 type fileInfo struct {
@@ -158,8 +679,98 @@ type fileInfo struct {
 	linkName   string // link target, for hard links and symlinks.
 }
 
+// errUnsafePath is returned for archive members that would be written outside
+// the directory they are extracted into.
+var errUnsafePath = errors.New("path leads outside the extraction directory")
+
+// Check that writing an archive member can not modify anything outside outDir:
+// its name, link target and any symlinks already extracted into its parent
+// directories must all stay inside.
+func checkMemberPath(outDir string, fileInfo fileInfo) error {
+	if !filepath.IsLocal(fileInfo.name) {
+		return fmt.Errorf("%w: %s", errUnsafePath, fileInfo.name)
+	}
+	outPath := filepath.Join(outDir, fileInfo.name)
+	paths := []string{outPath}
+	isSymlink := fileInfo.Mode()&fs.ModeType == fs.ModeSymlink
+	switch {
+	case fileInfo.isLink:
+		if !filepath.IsLocal(fileInfo.linkName) {
+			return fmt.Errorf("%w: hard link target %s", errUnsafePath, fileInfo.linkName)
+		}
+		paths = append(paths, filepath.Join(outDir, fileInfo.linkName))
+	case isSymlink:
+		// Only allow .. at the start of the target, as a symlink extracted
+		// later could otherwise make .. lead elsewhere than it does now.
+		parts := strings.Split(filepath.ToSlash(fileInfo.linkName), "/")
+		up := 0
+		for up < len(parts) && parts[up] == ".." {
+			up++
+		}
+		if filepath.IsAbs(fileInfo.linkName) || slices.Contains(parts[up:], "..") {
+			return fmt.Errorf("%w: symlink target %s", errUnsafePath, fileInfo.linkName)
+		}
+	}
+	root, err := filepath.EvalSymlinks(outDir)
+	if err != nil {
+		return err
+	}
+	for _, name := range paths {
+		dir, err := resolveParent(outDir, name)
+		if err != nil {
+			return err
+		}
+		if rel, err := filepath.Rel(root, dir); err != nil || !filepath.IsLocal(rel) {
+			return fmt.Errorf("%w: a parent of %s is a symlink", errUnsafePath, name)
+		}
+		if isSymlink && name == outPath {
+			// The target is relative to where the parent really is.
+			target := filepath.Join(dir, fileInfo.linkName)
+			if rel, err := filepath.Rel(root, target); err != nil || !filepath.IsLocal(rel) {
+				return fmt.Errorf("%w: symlink target %s", errUnsafePath, fileInfo.linkName)
+			}
+		}
+	}
+	return nil
+}
+
+// The directory name (inside outDir) will be created in, with the symlinks
+// among its parents that exist already resolved.
+func resolveParent(outDir, name string) (string, error) {
+	// Resolve the deepest parent directory that exists already.
+	dir := filepath.Dir(name)
+	for {
+		if _, err := os.Lstat(dir); err == nil || dir == outDir {
+			break
+		}
+		dir = filepath.Dir(dir)
+	}
+	resolved, err := filepath.EvalSymlinks(dir)
+	if err != nil {
+		return "", err
+	}
+	rest, err := filepath.Rel(dir, filepath.Dir(name))
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(resolved, rest), nil
+}
+
 func writeFile(ctx context.Context, outDir string, reader io.Reader, fileInfo fileInfo) error {
+	if err := checkMemberPath(outDir, fileInfo); err != nil {
+		if optionsFrom(ctx).strictPaths {
+			return fmt.Errorf("unsafe archive member %s: %w", fileInfo.name, err)
+		}
+		slog.WarnContext(ctx, "skipping unsafe archive member", "member", fileInfo.name, "error", err)
+		return nil
+	}
 	outPath := filepath.Join(outDir, fileInfo.name)
+	// Do not write through a symlink extracted earlier.
+	if info, err := os.Lstat(outPath); err == nil && info.Mode()&fs.ModeSymlink != 0 {
+		if err := os.Remove(outPath); err != nil {
+			return fmt.Errorf("failed to replace symlink %s: %w", fileInfo.name, err)
+		}
+	}
 	if err := os.MkdirAll(filepath.Dir(outPath), 0o755); err != nil {
 		return fmt.Errorf("failed to ensure parent directory %s: %w", filepath.Dir(outPath), err)
 	}
@@ -173,9 +784,11 @@ func writeFile(ctx context.Context, outDir string, reader io.Reader, fileInfo fi
 			return fmt.Errorf("failed to create hard link %s: %w", fileInfo.name, err)
 		}
 	case fileInfo.Mode()&fs.ModeType == fs.ModeSymlink:
-		if err := os.Symlink(filepath.Join(outDir, fileInfo.linkName), outPath); err != nil {
+		if err := os.Symlink(fileInfo.linkName, outPath); err != nil {
 			return fmt.Errorf("failed to create symlink %s: %w", fileInfo.name, err)
 		}
+		// Changing the mode or times would affect the target instead.
+		return nil
 	case fileInfo.Mode()&fs.ModeType == 0:
 		outFile, err := os.OpenFile(outPath, os.O_CREATE|os.O_WRONLY, fileInfo.Mode()&fs.ModePerm)
 		if err != nil {
@@ -201,38 +814,16 @@ func writeFile(ctx context.Context, outDir string, reader io.Reader, fileInfo fi
 	return nil
 }
 
-func extractTar(ctx context.Context, archivePath, outDir string) ([]string, error) {
-	rawReader, err := os.Open(archivePath)
-	if err != nil {
-		return nil, err
-	}
-	defer rawReader.Close()
-	var decompressor io.Reader
-	switch filepath.Ext(archivePath) {
-	case ".tar":
-		decompressor = rawReader
-	case ".gz":
-		decompressor, err = gzip.NewReader(rawReader)
-	case ".bz2":
-		decompressor = bzip2.NewReader(rawReader)
-	case ".zst":
-		decompressor, err = zstd.NewReader(rawReader)
-	default:
-		err = fmt.Errorf("could not detect tar compression for %s", archivePath)
-	}
-	if err != nil {
-		return nil, err
-	}
-
+func extractTar(ctx context.Context, stream io.Reader, outDir string, limits *extractLimits) ([]string, error) {
 	var solutions []string
-	reader := tar.NewReader(decompressor)
+	reader := tar.NewReader(stream)
 	for {
 		header, err := reader.Next()
 		if errors.Is(err, io.EOF) {
 			return solutions, nil
 		}
 		if err != nil {
-			return nil, fmt.Errorf("failed to read archive %s: %w", archivePath, err)
+			return nil, fmt.Errorf("failed to read tar header: %w", err)
 		}
 		fileInfo := fileInfo{
 			name:       header.Name,
@@ -241,6 +832,9 @@ func extractTar(ctx context.Context, archivePath, outDir string) ([]string, erro
 			isLink:     header.Typeflag == tar.TypeLink,
 			linkName:   header.Linkname,
 		}
+		if err := limits.add(fileInfo); err != nil {
+			return nil, err
+		}
 		if err := writeFile(ctx, outDir, reader, fileInfo); err != nil {
 			return nil, err
 		}
@@ -250,13 +844,8 @@ func extractTar(ctx context.Context, archivePath, outDir string) ([]string, erro
 	}
 }
 
-func extractCpio(ctx context.Context, archivePath, outDir string) ([]string, error) {
-	file, err := os.Open(archivePath)
-	if err != nil {
-		return nil, fmt.Errorf("failed to open archive %s: %w", archivePath, err)
-	}
-	defer file.Close()
-	reader := cpio.NewReader(file)
+func extractCpio(ctx context.Context, stream io.Reader, outDir string, limits *extractLimits) ([]string, error) {
+	reader := cpio.NewReader(stream)
 	var solutions []string
 	for {
 		header, err := reader.Next()
@@ -271,12 +860,13 @@ func extractCpio(ctx context.Context, archivePath, outDir string) ([]string, err
 			FileInfo:   header.FileInfo(),
 			accessTime: time.Time{},
 		}
+		if err := limits.add(fileInfo); err != nil {
+			return nil, err
+		}
 		if fileInfo.Mode()&fs.ModeType == fs.ModeSymlink {
-			buf, err := io.ReadAll(reader)
-			if err != nil {
-				return nil, fmt.Errorf("failed to read symlink %s: %w", header.Name, err)
+			if fileInfo.linkName, err = readLinkTarget(reader, header.Name); err != nil {
+				return nil, err
 			}
-			fileInfo.linkName = string(buf)
 		}
 		if err := writeFile(ctx, outDir, reader, fileInfo); err != nil {
 			return nil, err
@@ -286,3 +876,168 @@ func extractCpio(ctx context.Context, archivePath, outDir string) ([]string, err
 		}
 	}
 }
+
+// The longest symlink target read from the body of an archive member.
+const maxLinkTargetSize = 4096
+
+// Read the target of a symlink stored as the body of an archive member.
+func readLinkTarget(r io.Reader, name string) (string, error) {
+	buf, err := io.ReadAll(io.LimitReader(r, maxLinkTargetSize+1))
+	if err != nil {
+		return "", fmt.Errorf("failed to read symlink %s: %w", name, err)
+	}
+	if len(buf) > maxLinkTargetSize {
+		return "", fmt.Errorf("%w: symlink %s has a target longer than %d bytes", errExtractLimit, name, maxLinkTargetSize)
+	}
+	return string(buf), nil
+}
+
+func extractZip(ctx context.Context, archivePath, outDir string) ([]string, error) {
+	reader, err := zip.OpenReader(archivePath)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open archive %s: %w", archivePath, err)
+	}
+	defer reader.Close()
+	limits := extractLimitsFrom(ctx)
+	var solutions []string
+	for _, file := range reader.File {
+		member, err := file.Open()
+		if err != nil {
+			return nil, fmt.Errorf("failed to read member %s: %w", file.Name, err)
+		}
+		fileInfo := fileInfo{
+			name:       file.Name,
+			FileInfo:   file.FileInfo(),
+			accessTime: file.Modified,
+		}
+		if err := limits.add(fileInfo); err != nil {
+			member.Close()
+			return nil, err
+		}
+		if fileInfo.Mode()&fs.ModeType == fs.ModeSymlink {
+			if fileInfo.linkName, err = readLinkTarget(member, file.Name); err != nil {
+				member.Close()
+				return nil, err
+			}
+		}
+		err = writeFile(ctx, outDir, member, fileInfo)
+		member.Close()
+		if err != nil {
+			return nil, err
+		}
+		if path.Ext(file.Name) == ".sln" {
+			solutions = append(solutions, file.Name)
+		}
+	}
+	return solutions, nil
+}
+
+// The time given by SOURCE_DATE_EPOCH, if any.
+func sourceDateEpoch(ctx context.Context) (time.Time, bool) {
+	seconds, err := strconv.ParseInt(optionsFrom(ctx).sourceDateEpoch, 10, 64)
+	if err != nil {
+		return time.Time{}, false
+	}
+	return time.Unix(seconds, 0).UTC(), true
+}
+
+// The modification time of the newest file in a directory, or the zero time if
+// there are no files.
+func newestModTime(dir string) (time.Time, error) {
+	var newest time.Time
+	err := filepath.WalkDir(dir, func(name string, d fs.DirEntry, err error) error {
+		if err != nil || d.IsDir() {
+			return err
+		}
+		info, err := d.Info()
+		if err != nil {
+			return err
+		}
+		if info.ModTime().After(newest) {
+			newest = info.ModTime()
+		}
+		return nil
+	})
+	return newest, err
+}
+
+// Names of version control metadata files and directories.
+var vcsMetadataNames = []string{".git", ".svn", ".hg", ".bzr", "_darcs", "CVS"}
+
+// Remove version control metadata from an extracted source tree.
+func stripVCSMetadata(ctx context.Context, dir string) error {
+	return filepath.WalkDir(dir, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if !slices.Contains(vcsMetadataNames, d.Name()) {
+			return nil
+		}
+		slog.DebugContext(ctx, "removing version control metadata", "path", path)
+		if err := os.RemoveAll(path); err != nil {
+			return fmt.Errorf("failed to remove %s: %w", path, err)
+		}
+		if d.IsDir() {
+			return fs.SkipDir
+		}
+		return nil
+	})
+}
+
+// Extensions of prebuilt binaries that should not be in a source tree.
+var binaryExts = []string{".dll", ".exe", ".nupkg", ".snupkg"}
+
+// Find prebuilt binaries in an extracted source tree, returning their paths
+// relative to dir.
+func findBinaries(ctx context.Context, dir string) ([]string, error) {
+	var binaries []string
+	err := filepath.WalkDir(dir, func(name string, d fs.DirEntry, err error) error {
+		if err != nil || d.IsDir() {
+			return err
+		}
+		if !slices.Contains(binaryExts, strings.ToLower(filepath.Ext(name))) {
+			return nil
+		}
+		rel, err := filepath.Rel(dir, name)
+		if err != nil {
+			return err
+		}
+		slog.WarnContext(ctx, "found prebuilt binary in sources", "path", rel)
+		binaries = append(binaries, filepath.ToSlash(rel))
+		return nil
+	})
+	return binaries, err
+}
+
+// Compute a hex-encoded SHA-256 digest identifying the given archives; for a
+// single archive, this is the digest of the file.
+func archivesSHA256(archives []string) (string, error) {
+	var digests []string
+	for _, archive := range archives {
+		digest, err := fileSHA256(archive)
+		if err != nil {
+			return "", err
+		}
+		digests = append(digests, digest)
+	}
+	if len(digests) == 1 {
+		return digests[0], nil
+	}
+	hasher := sha256.New()
+	_, _ = io.WriteString(hasher, strings.Join(digests, "\n"))
+	return hex.EncodeToString(hasher.Sum(nil)), nil
+}
+
+// Compute the hex-encoded SHA-256 digest of a file.
+func fileSHA256(path string) (string, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer file.Close()
+	hasher := sha256.New()
+	if _, err := io.Copy(hasher, file); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(hasher.Sum(nil)), nil
+}
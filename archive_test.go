@@ -0,0 +1,47 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"flag"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestZipTimeZone(t *testing.T) {
+	sourceDir := t.TempDir()
+	writeFiles(t, sourceDir, "foo/1.0/foo.1.0.nupkg")
+	modified := time.Date(2024, 3, 1, 23, 30, 0, 0, time.UTC)
+	if err := os.Chtimes(filepath.Join(sourceDir, "foo/1.0/foo.1.0.nupkg"), modified, modified); err != nil {
+		t.Fatal(err)
+	}
+	local := time.Local
+	t.Cleanup(func() { time.Local = local })
+	ctx := withOptions(context.Background(), testOptions(t, "-format", "zip"))
+	var archives [][]byte
+	for _, zone := range []*time.Location{time.UTC, time.FixedZone("east", 5*60*60), time.FixedZone("west", -8*60*60)} {
+		time.Local = zone
+		outBase := filepath.Join(t.TempDir(), "out")
+		if err := createArchive(ctx, sourceDir, outBase, outputFormatZip, compressionTypeNone); err != nil {
+			t.Fatal(err)
+		}
+		buf, err := os.ReadFile(outBase + ".zip")
+		if err != nil {
+			t.Fatal(err)
+		}
+		archives = append(archives, buf)
+	}
+	for i, archive := range archives[1:] {
+		if !bytes.Equal(archive, archives[0]) {
+			t.Errorf("archive created in time zone %d differs from the one created in UTC", i+1)
+		}
+	}
+}
+
+func TestZipNestedRejected(t *testing.T) {
+	if _, err := parseOptions(flag.NewFlagSet("test", flag.ContinueOnError), []string{"-format", "zip", "-layout", "nested"}); err == nil {
+		t.Error("-format zip -layout nested was accepted")
+	}
+}
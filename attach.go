@@ -0,0 +1,199 @@
+//go:build !nodocker
+
+package main
+
+import (
+	"archive/tar"
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"log/slog"
+	"os"
+	"path"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+
+	"github.com/docker/docker/api/types/container"
+	"github.com/docker/docker/client"
+)
+
+// Restore in a container prepared by the user (given by -container-id) rather
+// than one created from the SDK image. Directories can not be mounted into an
+// existing container, so the sources are copied into a temporary directory in
+// it, and the packages are copied back out once restoring is finished.
+func newAttachedRestoreEnv(ctx context.Context, srcDir, outDir string) (*containerRestoreEnv, error) {
+	opts := optionsFrom(ctx)
+	dc, err := newContainerClient(ctx)
+	if err != nil {
+		return nil, err
+	}
+	info, err := dc.ContainerInspect(ctx, opts.containerID)
+	if err != nil {
+		return nil, fmt.Errorf("failed to inspect container %s: %w", opts.containerID, err)
+	}
+	if info.State == nil || !info.State.Running {
+		return nil, fmt.Errorf("container %s is not running", opts.containerID)
+	}
+	output := func(cmd ...string) (string, error) {
+		var buf bytes.Buffer
+		if err := execInContainer(ctx, dc, info.ID, &buf, cmd...); err != nil {
+			return "", fmt.Errorf("%w: %s", err, strings.TrimSpace(buf.String()))
+		}
+		return strings.TrimSpace(buf.String()), nil
+	}
+	workDir, err := output("mktemp", "-d", "/tmp/obs-service-dotnet-packages-XXXXXX")
+	if err != nil {
+		return nil, fmt.Errorf("failed to create directory in container: %w", err)
+	}
+	env := &containerRestoreEnv{
+		dc:          dc,
+		containerID: info.ID,
+		srcPath:     path.Join(workDir, "src"),
+		outPath:     path.Join(workDir, "out"),
+		execEnv:     append(slices.Clone(localeEnv), opts.env...),
+	}
+	env.cleanups = append(env.cleanups, func() {
+		if err := execInContainer(context.WithoutCancel(ctx), dc, info.ID, nil, "rm", "-rf", workDir); err != nil {
+			slog.ErrorContext(ctx, "failed to remove temporary directory in container", "dir", workDir, "error", err)
+		}
+	})
+	if _, err := output("mkdir", env.srcPath, env.outPath); err != nil {
+		env.close(ctx)
+		return nil, fmt.Errorf("failed to create directory in container: %w", err)
+	}
+
+	// Copy the sources with the owner set to the user commands run as, so
+	// that the restore can write into them.
+	var uid, gid int
+	for _, id := range []struct {
+		flag  string
+		value *int
+	}{{"-u", &uid}, {"-g", &gid}} {
+		text, err := output("id", id.flag)
+		if err == nil {
+			*id.value, err = strconv.Atoi(text)
+		}
+		if err != nil {
+			env.close(ctx)
+			return nil, fmt.Errorf("failed to get user in container: %w", err)
+		}
+	}
+	slog.InfoContext(ctx, "copying sources into container", "container", opts.containerID, "dir", env.srcPath)
+	reader, writer := io.Pipe()
+	go func() {
+		writer.CloseWithError(writeSourceTar(srcDir, writer, uid, gid))
+	}()
+	err = dc.CopyToContainer(ctx, info.ID, env.srcPath, reader, container.CopyToContainerOptions{CopyUIDGID: true})
+	reader.Close()
+	if err != nil {
+		env.close(ctx)
+		return nil, fmt.Errorf("failed to copy sources into container: %w", err)
+	}
+
+	env.collect = func(ctx context.Context) error {
+		// Packages are collected again after corrupt ones are restored
+		// again, so replace what was copied before.
+		entries, err := os.ReadDir(outDir)
+		if err != nil {
+			return err
+		}
+		for _, entry := range entries {
+			if err := os.RemoveAll(filepath.Join(outDir, entry.Name())); err != nil {
+				return err
+			}
+		}
+		return copyFromContainer(ctx, dc, info.ID, env.outPath, outDir)
+	}
+	return env, nil
+}
+
+// Write the contents of dir as a tar stream, owned by the given user and group.
+func writeSourceTar(dir string, w io.Writer, uid, gid int) error {
+	tarWriter := tar.NewWriter(w)
+	err := filepath.WalkDir(dir, func(name string, d fs.DirEntry, err error) error {
+		if err != nil || name == dir {
+			return err
+		}
+		info, err := d.Info()
+		if err != nil {
+			return err
+		}
+		var link string
+		if info.Mode()&fs.ModeSymlink != 0 {
+			if link, err = os.Readlink(name); err != nil {
+				return err
+			}
+		}
+		header, err := tar.FileInfoHeader(info, link)
+		if err != nil {
+			return err
+		}
+		rel, err := filepath.Rel(dir, name)
+		if err != nil {
+			return err
+		}
+		header.Name = filepath.ToSlash(rel)
+		header.Uid, header.Gid = uid, gid
+		header.Uname, header.Gname = "", ""
+		if err := tarWriter.WriteHeader(header); err != nil {
+			return err
+		}
+		if !info.Mode().IsRegular() {
+			return nil
+		}
+		file, err := os.Open(name)
+		if err != nil {
+			return err
+		}
+		defer file.Close()
+		_, err = io.Copy(tarWriter, file)
+		return err
+	})
+	if err != nil {
+		return err
+	}
+	return tarWriter.Close()
+}
+
+// Copy the contents of a directory in the container into outDir.
+func copyFromContainer(ctx context.Context, dc *client.Client, containerID, source, outDir string) error {
+	slog.InfoContext(ctx, "copying packages out of container", "dir", source)
+	stream, _, err := dc.CopyFromContainer(ctx, containerID, source)
+	if err != nil {
+		return fmt.Errorf("failed to copy packages out of container: %w", err)
+	}
+	defer stream.Close()
+	reader := tar.NewReader(stream)
+	for {
+		header, err := reader.Next()
+		if errors.Is(err, io.EOF) {
+			return nil
+		}
+		if err != nil {
+			return fmt.Errorf("failed to read packages from container: %w", err)
+		}
+		// The entries are prefixed by the name of the source directory.
+		_, name, _ := strings.Cut(header.Name, "/")
+		if name == "" {
+			continue
+		}
+		fileInfo := fileInfo{
+			name:       name,
+			FileInfo:   header.FileInfo(),
+			accessTime: header.AccessTime,
+			isLink:     header.Typeflag == tar.TypeLink,
+			linkName:   header.Linkname,
+		}
+		if fileInfo.isLink {
+			_, fileInfo.linkName, _ = strings.Cut(header.Linkname, "/")
+		}
+		if err := writeFile(ctx, outDir, reader, fileInfo); err != nil {
+			return err
+		}
+	}
+}
@@ -1,169 +1,818 @@
 package main
 
 import (
+	"bytes"
 	"context"
+	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
 	"io/fs"
 	"log/slog"
 	"os"
+	"path"
 	"path/filepath"
-
-	"github.com/docker/docker/api/types/container"
-	"github.com/docker/docker/api/types/mount"
-	"github.com/docker/docker/client"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
 )
 
+// The path of the output archive without the extension.
+func outputBase(opts *options) (string, error) {
+	outBase := opts.output
+	if opts.hashSuffix {
+		hash, err := archivesSHA256(opts.archives)
+		if err != nil {
+			return "", fmt.Errorf("failed to hash source archive: %w", err)
+		}
+		outBase += "-" + hash[:12]
+	}
+	if opts.outDir != "" {
+		outBase = filepath.Join(opts.outDir, outBase)
+	}
+	return outBase, nil
+}
+
 func build(ctx context.Context) error {
-	srcDir, err := os.MkdirTemp("", "obs-service-dotnet-packages-src-*")
+	opts := optionsFrom(ctx)
+	outBase, err := outputBase(opts)
+	if err != nil {
+		return err
+	}
+	outputPath := outBase + outputExtension(opts)
+	srcDir, removeSrcDir, err := sourcesDir(ctx)
+	if err != nil {
+		return err
+	}
+	defer removeSrcDir()
+	setPhase(ctx, "extracting")
+	ctx, targets, err := prepareSources(ctx, srcDir)
+	if err != nil {
+		return err
+	}
+	opts = optionsFrom(ctx)
+	if len(targets) == 0 && !opts.allowEmpty {
+		return fmt.Errorf("no .NET projects detected in %s", strings.Join(sourceNames(ctx), ", "))
+	}
+	digest, err := restoreInputsDigest(ctx, srcDir)
+	if err != nil {
+		return fmt.Errorf("failed to hash lock files: %w", err)
+	}
+	statePath, err := stateFilePath(ctx, outputPath)
 	if err != nil {
+		return fmt.Errorf("failed to locate state file: %w", err)
+	}
+	// A split matrix writes no archive by the usual name, but always the
+	// report.
+	writtenPath := outputPath
+	if opts.matrixOutput == matrixOutputSplit && (len(opts.matrixTags) > 0 || len(opts.matrixRIDs) > 0) {
+		writtenPath = outBase + ".matrix.json"
+	}
+	if !opts.force && outputUpToDate(statePath, writtenPath, digest) {
+		slog.InfoContext(ctx, "lock files unchanged since the last run, keeping the output; use -force to restore anyway", "output", writtenPath)
+		return nil
+	}
+	if err := checkClobber(opts, writtenPath); err != nil {
 		return err
 	}
-	defer os.RemoveAll(srcDir)
-	solutions, err := extractArchive(ctx, options.archive, srcDir)
+	ctx, closeLog, err := openRestoreLog(ctx, outBase)
 	if err != nil {
 		return err
 	}
+	defer closeLog()
+
 	outDir, err := os.MkdirTemp("", "obs-service-dotnet-packages-out-*")
 	if err != nil {
 		return err
 	}
 	defer os.RemoveAll(outDir)
 
-	dc, err := client.NewClientWithOpts(client.FromEnv)
-	if err != nil {
-		return fmt.Errorf("failed to create docker client: %w", err)
-	}
-	c, err := dc.ContainerCreate(
-		ctx,
-		&container.Config{
-			Cmd:        []string{"sleep", "inf"},
-			Image:      "registry.suse.com/bci/dotnet-sdk:" + options.tag,
-			WorkingDir: "/src",
-		},
-		&container.HostConfig{
-			Mounts: []mount.Mount{
-				{
-					Type:   mount.TypeBind,
-					Source: srcDir,
-					Target: "/src",
-					BindOptions: &mount.BindOptions{
-						CreateMountpoint: true,
-					},
-				},
-				{
-					Type:   mount.TypeBind,
-					Source: outDir,
-					Target: "/out",
-					BindOptions: &mount.BindOptions{
-						CreateMountpoint: true,
-					},
-				},
-			},
-			AutoRemove: true,
-		},
-		nil,
-		nil,
-		"")
-	if err != nil {
-		return fmt.Errorf("failed to create container: %w", err)
-	}
-	defer func() {
-		err := dc.ContainerRemove(ctx, c.ID, container.RemoveOptions{Force: true})
+	names := sourceNames(ctx)
+	m := &manifest{SchemaVersion: manifestSchemaVersion, Archive: filepath.Base(names[0])}
+	for _, name := range names[1:] {
+		m.AdditionalArchives = append(m.AdditionalArchives, filepath.Base(name))
+	}
+	if len(targets) == 0 {
+		slog.WarnContext(ctx, "no .NET projects detected, creating empty archive", "sources", names)
+		if err := os.WriteFile(filepath.Join(outDir, emptyMarker), nil, 0o644); err != nil {
+			return fmt.Errorf("failed to create empty archive marker: %w", err)
+		}
+		m.Empty = true
+	} else {
+		if m.Projects, err = lockFileCoverage(ctx, srcDir, targets); err != nil {
+			return err
+		}
+		done, err := restoreSources(ctx, srcDir, outDir, outBase, m, func() (bool, error) {
+			switch {
+			case len(opts.matrixTags) > 0 || len(opts.matrixRIDs) > 0:
+				return restoreMatrix(ctx, srcDir, outDir, outBase, targets, m)
+			case len(opts.sdkGroups) > 1:
+				return false, restoreSDKGroups(ctx, srcDir, outDir, m)
+			}
+			return false, restorePackages(ctx, srcDir, outDir, targets, m)
+		})
 		if err != nil {
-			slog.ErrorContext(ctx, "failed to remove container", "error", err)
+			return err
+		}
+		if done {
+			if err := vendorAuxiliary(ctx, srcDir, outBase); err != nil {
+				return err
+			}
+			return writeStateFile(statePath, digest)
 		}
-	}()
+	}
 
-	if err := dc.ContainerStart(ctx, c.ID, container.StartOptions{}); err != nil {
+	// Vendor only once restoring succeeded, so that a failed run does not
+	// leave vendor archives behind.
+	if err := vendorAuxiliary(ctx, srcDir, outBase); err != nil {
 		return err
 	}
+	if err := packageOutput(ctx, srcDir, outDir, outBase, targets, m); err != nil {
+		return err
+	}
+	return writeStateFile(statePath, digest)
+}
 
-	// Use a local function here to ensure we always set permissions after
-	// running dotnet restore.
-	err = func() error {
-		defer func() {
-			if err := setPermissions(ctx, dc, c.ID); err != nil {
-				slog.ErrorContext(
-					ctx,
-					"failed to reset permissions, temporary files may be left behind",
-					"error", err,
-					"src", srcDir,
-					"out", outDir,
-				)
-			}
-		}()
+// Refuse to replace the output with -no-clobber, unless -force is given too.
+func checkClobber(opts *options, outputPath string) error {
+	if !opts.noClobber || opts.force {
+		return nil
+	}
+	if _, err := os.Stat(outputPath); err == nil {
+		return fmt.Errorf("output %s already exists; use -force to replace it", outputPath)
+	} else if !errors.Is(err, fs.ErrNotExist) {
+		return err
+	}
+	return nil
+}
 
-		for _, solution := range solutions {
-			if err := restore(ctx, dc, c.ID, solution); err != nil {
-				return fmt.Errorf("error restoring %s: %w", solution, err)
-			}
+// Create the restore log if -restore-log is given, returning the context
+// writing to it and a function closing it.  The log is created before
+// restoring, as it is most useful if that fails, but only once a restore is
+// certain to happen, so that skipped runs keep the last one.
+func openRestoreLog(ctx context.Context, outBase string) (context.Context, func(), error) {
+	if !optionsFrom(ctx).restoreLog {
+		return ctx, func() {}, nil
+	}
+	logFile, err := os.Create(outBase + "-restore.log")
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to create restore log: %w", err)
+	}
+	return withRestoreLog(ctx, logFile), func() { _ = logFile.Close() }, nil
+}
+
+// Restore the sources into outDir with restore, warning first if package
+// versions are not locked, then record the cache statistics and write the
+// generated lock files as the options say.  restore reports whether it
+// already wrote the output, in which case nothing is recorded.
+func restoreSources(ctx context.Context, srcDir, outDir, outBase string, m *manifest, restore func() (bool, error)) (bool, error) {
+	opts := optionsFrom(ctx)
+	if !opts.lockedMode {
+		slog.WarnContext(ctx, "restoring without locked mode; package versions are not pinned and the result is NOT reproducible")
+	}
+	setPhase(ctx, "restoring")
+	var cached map[string]bool
+	var err error
+	if opts.cacheDir != "" {
+		if cached, err = cachedPackages(opts.cacheDir); err != nil {
+			return false, fmt.Errorf("failed to list cached packages: %w", err)
+		}
+	}
+	if done, err := restore(); err != nil || done {
+		return done, err
+	}
+	if opts.cacheDir != "" {
+		// The prepare command has not read the packages yet.
+		packages := m.Packages
+		if packages == nil {
+			packages, err = listPackages(outDir)
+		}
+		if err == nil {
+			err = recordCacheStats(ctx, cached, packages)
+		}
+		if err != nil {
+			slog.WarnContext(ctx, "failed to record cache statistics", "error", err)
+		}
+	}
+	if opts.generateLockFiles {
+		if err := writeGeneratedLockFiles(ctx, srcDir, outBase, m.Projects); err != nil {
+			return false, fmt.Errorf("failed to write generated lock files: %w", err)
+		}
+	}
+	return false, nil
+}
+
+// Verify the packages in outDir if requested, then write the output archive
+// and the files accompanying it.
+func packageOutput(ctx context.Context, srcDir, outDir, outBase string, targets []string, m *manifest) error {
+	opts := optionsFrom(ctx)
+	if opts.smokeTest && len(m.Excluded) > 0 {
+		// The container has no distribution packages to make up for them.
+		slog.WarnContext(ctx, "skipping smoke test, as packages provided by the distribution were left out", "excluded", len(m.Excluded))
+	} else if opts.smokeTest && !m.Empty {
+		setPhase(ctx, "verifying")
+		if err := smokeTest(ctx, srcDir, outDir, targets); err != nil {
+			return err
+		}
+	}
+
+	setPhase(ctx, "packing")
+	slog.InfoContext(ctx, "creating output archive", "base name", outBase)
+	if err := writeOutput(ctx, outDir, outBase); err != nil {
+		return err
+	}
+	if opts.manifest {
+		if err := writeManifest(m, outBase, opts.reportFormat); err != nil {
+			return fmt.Errorf("error writing manifest: %w", err)
+		}
+	}
+	if opts.bundledProvides {
+		if err := writeBundledProvides(m, outBase); err != nil {
+			return fmt.Errorf("error writing bundled provides: %w", err)
+		}
+	}
+	if opts.updateSpecProvides {
+		if err := updateSpecProvides(ctx, m); err != nil {
+			return fmt.Errorf("error updating spec file: %w", err)
 		}
+	}
+	if opts.downloadList {
+		if err := writeDownloadList(m, outBase); err != nil {
+			return fmt.Errorf("error writing download list: %w", err)
+		}
+	}
+	return nil
+}
+
+// Remove a path (relative to workDir) in the packages directory, refusing to if
+// any of its parent directories is a symlink leading outside workDir.  A
+// symlink itself is removed rather than what it points to.
+func removeInside(workDir, path string) error {
+	root, err := filepath.EvalSymlinks(workDir)
+	if err != nil {
+		return err
+	}
+	name := filepath.Join(workDir, path)
+	if !filepath.IsLocal(path) {
+		return fmt.Errorf("%w: %s", errUnsafePath, path)
+	}
+	dir, err := filepath.EvalSymlinks(filepath.Dir(name))
+	if err != nil {
+		return err
+	}
+	if rel, err := filepath.Rel(root, dir); err != nil || !filepath.IsLocal(rel) {
+		return fmt.Errorf("%w: %s", errUnsafePath, path)
+	}
+	return os.RemoveAll(name)
+}
+
+// cleanupProfile selects which files of each package are kept in the output.
+type cleanupProfile string
 
+const (
+	cleanupProfileMinimal = "minimal" // only the .nupkg and its hash
+	cleanupProfileCache   = "cache"   // also the .nuspec
+	cleanupProfileFull    = "full"    // everything NuGet extracted
+)
+
+func (p *cleanupProfile) String() string {
+	if p == nil {
+		return "<nil>"
+	}
+	return string(*p)
+}
+
+func (p *cleanupProfile) Set(value string) error {
+	switch value {
+	case cleanupProfileMinimal, cleanupProfileCache, cleanupProfileFull:
+		*p = cleanupProfile(value)
 		return nil
-	}()
+	}
+	return fmt.Errorf("invalid cleanup profile %s", value)
+}
+
+// The patterns of the files to keep, relative to the packages directory: those
+// of the cleanup profile, and those given with -cleanup-keep.
+func cleanupPatterns(opts *options) []string {
+	patterns := []string{"*/*/*.nupkg", "*/*/*.nupkg.sha512"}
+	if opts.cleanup != cleanupProfileMinimal {
+		patterns = append(patterns, "*/*/*.nuspec")
+	}
+	for _, pattern := range opts.cleanupKeep {
+		patterns = append(patterns, "*/*/"+pattern)
+	}
+	return patterns
+}
+
+// Restore the targets into outDir, then add the extra packages and record the
+// packages in the manifest.
+func restorePackages(ctx context.Context, srcDir, outDir string, targets []string, m *manifest) error {
+	feeds, err := findInTreeFeeds(ctx, srcDir)
 	if err != nil {
+		return fmt.Errorf("failed to find package feeds in sources: %w", err)
+	}
+	if m.Tools, err = readToolManifests(ctx, srcDir); err != nil {
+		return fmt.Errorf("failed to read tool manifests: %w", err)
+	}
+	if err := restoreAll(ctx, srcDir, outDir, targets, feeds, m); err != nil {
 		return err
 	}
+	return finishPackages(ctx, srcDir, outDir, feeds, m)
+}
 
+// Clean up the restored packages in outDir, add the extra packages, and record
+// the packages in the manifest.
+func finishPackages(ctx context.Context, srcDir, outDir string, feeds []inTreeFeed, m *manifest) error {
+	opts := optionsFrom(ctx)
+	var err error
 	if err := cleanup(ctx, outDir); err != nil {
 		slog.WarnContext(ctx, "failed to clean up, archive might be larger than needed", "error", err)
 	}
+	if len(opts.targetFrameworks) > 0 {
+		if err := pruneTargetFrameworks(ctx, srcDir, outDir, m.Projects); err != nil {
+			return fmt.Errorf("failed to filter packages by target framework: %w", err)
+		}
+	}
+	if opts.extraPackagesDir != "" {
+		if err := mergePackages(ctx, opts.extraPackagesDir, outDir); err != nil {
+			return err
+		}
+	}
+	if opts.systemPackages != "" {
+		if m.Excluded, err = excludeSystemPackages(ctx, outDir); err != nil {
+			return err
+		}
+	}
+	if m.Packages, err = readPackages(outDir); err != nil {
+		return err
+	}
+	updateRunStatus(ctx, func(status *runStatus) { status.Packages = len(m.Packages) })
+	markInTreePackages(m.Packages, feeds)
+	if m.Findings, err = scanPackageContents(ctx, outDir, m.Packages); err != nil {
+		return err
+	}
+	return checkDuplicateVersions(ctx, m.Packages)
+}
 
-	outBase := options.output
-	if options.outDir != "" {
-		outBase = filepath.Join(options.outDir, options.output)
+// The directory to restore the sources in: either the directory given by
+// -srcdir, or a new temporary directory. The returned function removes the
+// directory if it is temporary.
+func sourcesDir(ctx context.Context) (string, func(), error) {
+	opts := optionsFrom(ctx)
+	if opts.srcDir != "" {
+		return opts.srcDir, func() {}, nil
 	}
-	slog.InfoContext(ctx, "creating output archive", "base name", outBase)
-	if err := createArchive(outDir, outBase, options.compression); err != nil {
-		return fmt.Errorf("error creating output archive: %w", err)
+	dir, err := os.MkdirTemp("", "obs-service-dotnet-packages-src-*")
+	if err != nil {
+		return "", nil, err
 	}
-	return nil
+	return dir, func() { _ = os.RemoveAll(dir) }, nil
 }
 
-func execInContainer(ctx context.Context, dc *client.Client, containerID string, cmd ...string) error {
-	exec, err := dc.ContainerExecCreate(
-		ctx,
-		containerID,
-		container.ExecOptions{
-			Tty:          true,
-			AttachStdout: true,
-			AttachStderr: true,
-			Cmd:          cmd,
-		})
+// The names of the sources, for messages and the manifest.
+func sourceNames(ctx context.Context) []string {
+	opts := optionsFrom(ctx)
+	if opts.srcDir != "" {
+		return []string{opts.srcDir}
+	}
+	return opts.archives
+}
+
+// Verify and extract the source archives into srcDir, returning the solutions or
+// projects (relative to srcDir) to restore. With -srcdir, the sources are
+// used as they are.  The returned context carries the options derived from
+// the sources: SOURCE_DATE_EPOCH and the SDK version.
+func prepareSources(ctx context.Context, srcDir string) (context.Context, []string, error) {
+	opts := optionsFrom(ctx)
+	derived := *opts
+	var solutions []string
+	if opts.srcDir != "" {
+		var err error
+		if solutions, err = findSolutions(srcDir); err != nil {
+			return nil, nil, fmt.Errorf("failed to find solutions: %w", err)
+		}
+	}
+	// The limits apply to all archives of the run together.
+	extractCtx := withExtractLimits(ctx, newExtractLimits(ctx))
+	for _, archive := range opts.archives {
+		if err := verifyArchive(ctx, archive); err != nil {
+			return nil, nil, err
+		}
+		names, err := extractSources(extractCtx, archive, srcDir)
+		if err != nil {
+			return nil, nil, err
+		}
+		solutions = append(solutions, names...)
+	}
+	if derived.sourceDateEpoch == "" {
+		newest, err := newestModTime(srcDir)
+		if err != nil {
+			return nil, nil, fmt.Errorf("failed to derive SOURCE_DATE_EPOCH: %w", err)
+		}
+		if !newest.IsZero() {
+			derived.sourceDateEpoch = strconv.FormatInt(newest.Unix(), 10)
+			slog.InfoContext(ctx, "derived SOURCE_DATE_EPOCH from the sources", "SOURCE_DATE_EPOCH", derived.sourceDateEpoch)
+		}
+	}
+	if opts.stripVCS {
+		if err := stripVCSMetadata(ctx, srcDir); err != nil {
+			return nil, nil, err
+		}
+	}
+	if opts.forbidBinaries {
+		binaries, err := findBinaries(ctx, srcDir)
+		if err != nil {
+			return nil, nil, fmt.Errorf("failed to scan for binaries: %w", err)
+		}
+		if len(binaries) > 0 {
+			return nil, nil, fmt.Errorf("sources contain %d prebuilt binaries: %s", len(binaries), strings.Join(binaries, ", "))
+		}
+	}
+	targets, err := selectTargets(ctx, srcDir, solutions)
+	if err == nil && len(opts.pathScopes) > 0 {
+		targets, err = scopeTargets(ctx, srcDir, targets)
+	}
 	if err != nil {
-		return err
+		return nil, nil, err
+	}
+	if derived.tag, derived.sdkGroups, err = resolveTag(ctx, srcDir, targets); err != nil {
+		return nil, nil, err
+	}
+	return withOptions(ctx, &derived), targets, nil
+}
+
+// Determine the solutions or projects to restore (relative to srcDir), given
+// the solutions found in the sources.
+func selectTargets(ctx context.Context, srcDir string, solutions []string) ([]string, error) {
+	opts := optionsFrom(ctx)
+	if len(opts.solutions) > 0 {
+		var targets []string
+		for _, solution := range opts.solutions {
+			target := path.Clean(filepath.ToSlash(solution))
+			if _, err := os.Stat(filepath.Join(srcDir, target)); err != nil {
+				return nil, fmt.Errorf("solution %s not found in sources: %w", solution, err)
+			}
+			targets = append(targets, target)
+		}
+		slog.InfoContext(ctx, "using solutions from the command line", "solutions", targets, "detected", solutions)
+		return restoreTargets(ctx, srcDir, targets)
+	}
+	if len(solutions) == 0 {
+		projects, err := findProjects(srcDir)
+		if err != nil {
+			return nil, fmt.Errorf("failed to find projects: %w", err)
+		}
+		if len(projects) > 0 {
+			slog.InfoContext(ctx, "no solutions found; restoring projects individually", "projects", projects)
+		}
+		return projects, nil
 	}
-	resp, err := dc.ContainerExecAttach(ctx, exec.ID, container.ExecStartOptions{Tty: true})
+	return restoreTargets(ctx, srcDir, solutions)
+}
+
+// Determine the extra arguments to pass to dotnet restore for the sources in
+// srcDir, regardless of the environment it runs in.
+func sourceRestoreArgs(ctx context.Context, srcDir string) ([]string, error) {
+	opts := optionsFrom(ctx)
+	var restoreArgs []string
+	gitProperties, err := detectGitTasks(ctx, srcDir)
 	if err != nil {
-		return err
+		return nil, fmt.Errorf("failed to detect git tasks: %w", err)
+	}
+	if len(gitProperties) > 0 && !opts.disableGitTasks {
+		slog.WarnContext(ctx, "sources use tasks that need git metadata; consider -disable-git-tasks if restore fails")
+	} else if opts.disableGitTasks {
+		for _, property := range gitProperties {
+			restoreArgs = append(restoreArgs, "-p:"+property)
+		}
+	}
+	for _, property := range opts.properties {
+		// Semicolons would separate properties, so escape them.
+		restoreArgs = append(restoreArgs, "-p:"+strings.ReplaceAll(property, ";", "%3B"))
 	}
-	if err := dc.ContainerExecStart(ctx, exec.ID, container.ExecStartOptions{Tty: true}); err != nil {
+	return restoreArgs, nil
+}
+
+// Restore the given solutions or projects (relative to srcDir), placing the
+// downloaded packages in outDir.
+func restoreAll(ctx context.Context, srcDir, outDir string, targets []string, feeds []inTreeFeed, m *manifest) error {
+	opts := optionsFrom(ctx)
+	restoreArgs, err := sourceRestoreArgs(ctx, srcDir)
+	if err != nil {
 		return err
 	}
-	_, _ = io.Copy(io.Discard, resp.Reader)
-	return nil
+
+	var env restoreEnv
+	if opts.noContainer {
+		env = newHostEnv(srcDir, outDir)
+	} else if opts.containerID != "" {
+		env, err = newAttachedRestoreEnv(ctx, srcDir, outDir)
+		if err != nil {
+			return err
+		}
+	} else {
+		env, err = newContainerRestoreEnv(ctx, srcDir, outDir, m)
+		if err != nil {
+			return err
+		}
+	}
+	defer env.close(ctx)
+	restoreArgs = append(restoreArgs, env.restoreArgs()...)
+	restoreArgs = append(restoreArgs, inTreeFeedArgs(env, feeds)...)
+	for _, rid := range opts.rids {
+		restoreArgs = append(restoreArgs, "--runtime", rid)
+	}
+	if opts.generateLockFiles {
+		if err := generateLockFiles(ctx, env, m.Projects, restoreArgs); err != nil {
+			return err
+		}
+	}
+
+	for attempt := 0; ; attempt++ {
+		for _, target := range targets {
+			err := restore(ctx, env, target, restoreArgs...)
+			if errors.Is(err, ErrLockMismatch) && opts.forceEvaluate {
+				var changes []manifestLockChange
+				changes, err = restoreForceEvaluate(ctx, env, srcDir, target, restoreArgs)
+				m.LockChanges = append(m.LockChanges, changes...)
+			}
+			if err != nil {
+				return err
+			}
+		}
+		if err := restoreTargetingPacks(ctx, env, srcDir, targets, restoreArgs, m); err != nil {
+			return err
+		}
+
+		if opts.packTooling {
+			if err := restorePackTooling(ctx, env, srcDir, targets, restoreArgs); err != nil {
+				return err
+			}
+		}
+		if err := restoreTools(ctx, env, m.Tools, feeds); err != nil {
+			return err
+		}
+		if err := restoreWorkloads(ctx, env, srcDir, targets); err != nil {
+			return err
+		}
+
+		if err := env.finish(ctx); err != nil {
+			return err
+		}
+		if err := importWorkloadPacks(ctx, outDir); err != nil {
+			return fmt.Errorf("failed to add workload packs: %w", err)
+		}
+
+		// Restoring again only downloads the packages that are missing, so
+		// remove the corrupt ones and try again.
+		corrupt, err := findCorruptPackages(ctx, outDir)
+		if err != nil {
+			return err
+		}
+		if len(corrupt) == 0 {
+			return nil
+		}
+		if attempt == corruptPackageRetries {
+			var names []string
+			for _, pkg := range corrupt {
+				names = append(names, pkg.ID+" "+pkg.Version)
+			}
+			return fmt.Errorf("packages still corrupt after restoring again: %s", strings.Join(names, ", "))
+		}
+		for _, pkg := range corrupt {
+			slog.WarnContext(ctx, "restoring corrupt package again", "package", pkg.ID, "version", pkg.Version)
+			if err := env.exec(ctx, nil, "rm", "-rf", path.Join(env.packagesPath(), pkg.ID, pkg.Version)); err != nil {
+				return fmt.Errorf("failed to remove corrupt package %s %s: %w", pkg.ID, pkg.Version, err)
+			}
+			if err := os.RemoveAll(filepath.Join(outDir, pkg.ID, pkg.Version)); err != nil {
+				return err
+			}
+		}
+	}
+}
+
+// How often to restore again when restored packages fail verification.
+const corruptPackageRetries = 2
+
+// Find the restored packages whose .nupkg does not match its digest.
+func findCorruptPackages(ctx context.Context, outDir string) ([]manifestPackage, error) {
+	packages, err := listPackages(outDir)
+	if err != nil {
+		return nil, err
+	}
+	var corrupt []manifestPackage
+	for _, pkg := range packages {
+		if err := verifyPackage(filepath.Join(outDir, pkg.ID, pkg.Version)); err != nil {
+			slog.WarnContext(ctx, "restored package is corrupt", "package", pkg.ID, "version", pkg.Version, "error", err)
+			corrupt = append(corrupt, pkg)
+		}
+	}
+	return corrupt, nil
+}
+
+// The delay before the first retry of a failed restore; it doubles for every
+// further retry.
+const restoreRetryDelay = 10 * time.Second
+
+// Restore a solution, retrying with exponential backoff (up to -retries times)
+// if it fails in a way that looks transient.
+func restore(ctx context.Context, env restoreEnv, solutionPath string, extraArgs ...string) error {
+	opts := optionsFrom(ctx)
+	delay := restoreRetryDelay
+	for attempt := 0; ; attempt++ {
+		retry, err := restoreWithTimeout(ctx, env, solutionPath, extraArgs...)
+		if err == nil || !retry || attempt >= opts.retries {
+			return err
+		}
+		slog.WarnContext(ctx, "restore failed, retrying", "solution", solutionPath, "attempt", attempt+1, "delay", delay, "error", err)
+		select {
+		case <-ctx.Done():
+			return err
+		case <-time.After(delay):
+		}
+		delay *= 2
+	}
+}
+
+// Restore a solution once, limited by -solution-timeout.
+func restoreWithTimeout(ctx context.Context, env restoreEnv, solutionPath string, extraArgs ...string) (bool, error) {
+	opts := optionsFrom(ctx)
+	if opts.solutionTimeout <= 0 {
+		return restoreOnce(ctx, env, solutionPath, extraArgs...)
+	}
+	solutionCtx, cancel := context.WithTimeout(ctx, opts.solutionTimeout)
+	defer cancel()
+	retry, err := restoreOnce(solutionCtx, env, solutionPath, extraArgs...)
+	if err != nil && errors.Is(solutionCtx.Err(), context.DeadlineExceeded) && ctx.Err() == nil {
+		return false, fmt.Errorf("timed out restoring %s after %s: %w", solutionPath, opts.solutionTimeout, err)
+	}
+	return retry, err
+}
+
+// Messages in the restore output indicating that a failure may be transient:
+// network errors, timeouts and server errors.  These are in English, which
+// restore is run with (see localeEnv).
+var transientRestoreErrors = []string{
+	"NU1301", // Unable to load the service index / failed to retrieve information
+	"Response status code does not indicate success: 5",
+	"The operation was canceled",
+	"timed out",
+	"Connection reset by peer",
+}
+
+// Write the command and output of a restore to the restore log, without
+// secrets.
+func writeRestoreLogEntry(ctx context.Context, w io.Writer, solutionPath string, cmd []string, output string, err error) {
+	var entry strings.Builder
+	fmt.Fprintf(&entry, "==> %s\n", solutionPath)
+	fmt.Fprintf(&entry, "$ %s\n%s", strings.Join(cmd, " "), output)
+	if err != nil {
+		fmt.Fprintf(&entry, "==> %v\n", err)
+	}
+	fmt.Fprintln(&entry)
+	secrets, _ := secretValues(optionsFrom(ctx))
+	_, _ = io.WriteString(w, redactSecrets(secrets, entry.String()))
+}
+
+// Restore a solution once, returning whether a failure may be transient.
+func restoreOnce(ctx context.Context, env restoreEnv, solutionPath string, extraArgs ...string) (bool, error) {
+	slog.InfoContext(ctx, "restoring solution", "solution", solutionPath, "args", extraArgs)
+	opts := optionsFrom(ctx)
+	if opts.reportTimings > 0 {
+		extraArgs = append(slices.Clone(extraArgs), "-clp:PerformanceSummary")
+	}
+	var output bytes.Buffer
+	logWriter := newLogWriter(ctx, "dotnet restore")
+	cmd := restoreCommand(env, solutionPath, opts.lockedMode, extraArgs...)
+	updateRunStatus(ctx, func(status *runStatus) { status.Restores++ })
+	err := env.exec(ctx, io.MultiWriter(&output, logWriter), cmd...)
+	logWriter.Close()
+	if err != nil {
+		updateRunStatus(ctx, func(status *runStatus) { status.Failures++ })
+	}
+	if restoreLog := restoreLogFrom(ctx); restoreLog != nil {
+		writeRestoreLogEntry(ctx, restoreLog, solutionPath, cmd, output.String(), err)
+	}
+	if opts.reportTimings > 0 {
+		reportRestoreTimings(ctx, solutionPath, output.Bytes())
+	}
+	if err == nil {
+		return false, nil
+	}
+	exitCode := -1
+	var exitErr *exitError
+	if errors.As(err, &exitErr) {
+		exitCode = exitErr.exitCode
+	}
+	if bytes.Contains(output.Bytes(), []byte("NU1004")) {
+		err = fmt.Errorf("%w: %w", ErrLockMismatch, err)
+	}
+	restoreErr := &ErrRestoreFailed{Solution: solutionPath, ExitCode: exitCode, Err: err}
+	if slices.ContainsFunc(sdkResolutionErrors, func(code string) bool {
+		return bytes.Contains(output.Bytes(), []byte(code))
+	}) {
+		restoreErr.Diagnostics = sdkDiagnostics(ctx, env)
+	}
+	transient := slices.ContainsFunc(transientRestoreErrors, func(message string) bool {
+		return bytes.Contains(output.Bytes(), []byte(message))
+	})
+	return transient, restoreErr
+}
+
+// Messages in the restore output indicating that the SDK (or a workload) the
+// sources need could not be resolved.
+var sdkResolutionErrors = []string{
+	"MSB4236",    // The SDK specified could not be found
+	"NETSDK1045", // The current .NET SDK does not support targeting this version
+	"NETSDK1141", // Unable to resolve the .NET SDK version specified in global.json
+	"NETSDK1147", // Workloads must be installed
+	"A compatible .NET SDK was not found",
 }
 
-func restore(ctx context.Context, dc *client.Client, containerID, solutionPath string) error {
-	slog.InfoContext(ctx, "restoring solution", "solution", solutionPath)
-	return execInContainer(
-		ctx, dc, containerID,
+// Describe the SDKs and workloads available in the restore environment, to
+// explain SDK resolution failures.
+func sdkDiagnostics(ctx context.Context, env restoreEnv) string {
+	var diagnostics strings.Builder
+	for _, cmd := range [][]string{
+		{"dotnet", "--list-sdks"},
+		{"dotnet", "workload", "list"},
+	} {
+		var output bytes.Buffer
+		err := env.exec(ctx, &output, cmd...)
+		fmt.Fprintf(&diagnostics, "$ %s\n%s", strings.Join(cmd, " "), output.String())
+		if err != nil {
+			fmt.Fprintf(&diagnostics, "(%v)\n", err)
+		}
+	}
+	return diagnostics.String()
+}
+
+// The command line to restore a solution or project in the environment.
+func restoreCommand(env restoreEnv, solutionPath string, locked bool, extraArgs ...string) []string {
+	cmd := []string{
 		"dotnet", "restore", solutionPath,
-		"--packages", "/out",
+		"--packages", env.packagesPath(),
 		"--verbosity", "detailed",
-		"--locked-mode")
+	}
+	if locked {
+		cmd = append(cmd, "--locked-mode")
+	}
+	return append(cmd, extraArgs...)
 }
 
-func setPermissions(ctx context.Context, dc *client.Client, containerID string) error {
-	slog.InfoContext(ctx, "resetting file permissions")
-	return execInContainer(
-		ctx, dc, containerID,
-		"chown", "--recursive", "--reference=/src", "/src", "/out")
+// Restore additional packages needed by `dotnet pack` for projects that
+// produce NuGet packages; in particular, tools packed for specific runtime
+// identifiers need runtime packs that a plain restore does not download.
+func restorePackTooling(ctx context.Context, env restoreEnv, srcDir string, targets, restoreArgs []string) error {
+	for _, target := range targets {
+		projects, err := targetProjects(srcDir, target)
+		if err != nil {
+			return err
+		}
+		for _, project := range projects {
+			isPack, err := isPackProject(filepath.Join(srcDir, project))
+			if err != nil {
+				return err
+			} else if !isPack {
+				continue
+			}
+			slog.InfoContext(ctx, "probing packing project", "project", project)
+			var buf bytes.Buffer
+			err = env.exec(
+				ctx, &buf,
+				"dotnet", "msbuild", project,
+				"-getProperty:RuntimeIdentifier",
+				"-getProperty:RuntimeIdentifiers")
+			if err != nil {
+				return fmt.Errorf("failed to probe %s: %w", project, err)
+			}
+			var result struct {
+				Properties map[string]string
+			}
+			if err := json.Unmarshal(bytes.TrimSpace(buf.Bytes()), &result); err != nil {
+				return fmt.Errorf("failed to parse properties of %s: %w", project, err)
+			}
+			rids := strings.Split(result.Properties["RuntimeIdentifiers"], ";")
+			rids = append(rids, result.Properties["RuntimeIdentifier"])
+			slices.Sort(rids)
+			for _, rid := range slices.Compact(rids) {
+				if rid == "" {
+					continue
+				}
+				args := append([]string{"--runtime", rid}, restoreArgs...)
+				if err := restore(ctx, env, project, args...); err != nil {
+					return fmt.Errorf("runtime %s: %w", rid, err)
+				}
+			}
+		}
+	}
+	return nil
 }
 
 func cleanup(ctx context.Context, workDir string) error {
-	slog.InfoContext(ctx, "removing extraneous files")
+	opts := optionsFrom(ctx)
+	slog.InfoContext(ctx, "removing extraneous files", "profile", opts.cleanup)
 	match := func(path string, patterns ...string) bool {
 		for _, pattern := range patterns {
 			if m, err := filepath.Match(pattern, path); err != nil {
@@ -181,14 +830,19 @@ func cleanup(ctx context.Context, workDir string) error {
 				return nil
 			}
 			slog.DebugContext(ctx, "removing non-directory", "path", path)
-			if err := os.RemoveAll(filepath.Join(workDir, path)); err != nil {
+			if err := removeInside(workDir, path); err != nil {
 				return fmt.Errorf("failed to remove file %s: %w", path, err)
 			}
 			return nil
-		case match(path, "*/*/*.nupkg", "*/*/*.nupkg.sha512", "*/*/*.nuspec"):
+		case opts.cleanup == cleanupProfileFull && match(path, "*/*/*"):
+			if d.IsDir() {
+				return fs.SkipDir
+			}
+			return nil
+		case match(path, cleanupPatterns(opts)...):
 			if d.IsDir() {
 				slog.DebugContext(ctx, "removing directory", "path", path)
-				if err := os.RemoveAll(filepath.Join(workDir, path)); err != nil {
+				if err := removeInside(workDir, path); err != nil {
 					return fmt.Errorf("failed to remove directory %s: %w", path, err)
 				}
 				return fs.SkipDir
@@ -196,7 +850,7 @@ func cleanup(ctx context.Context, workDir string) error {
 			return nil
 		default:
 			slog.DebugContext(ctx, "removing extra", "path", path)
-			if err := os.RemoveAll(filepath.Join(workDir, path)); err != nil {
+			if err := removeInside(workDir, path); err != nil {
 				return fmt.Errorf("failed to remove %s: %w", path, err)
 			}
 			if d.IsDir() {
@@ -0,0 +1,169 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// Create the given files (with their directories) under dir.
+func writeFiles(t *testing.T, dir string, names ...string) {
+	t.Helper()
+	for _, name := range names {
+		name = filepath.Join(dir, name)
+		if err := os.MkdirAll(filepath.Dir(name), 0o755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(name, []byte(name), 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func assertExists(t *testing.T, names ...string) {
+	t.Helper()
+	for _, name := range names {
+		if _, err := os.Lstat(name); err != nil {
+			t.Errorf("%s should exist: %v", name, err)
+		}
+	}
+}
+
+func assertRemoved(t *testing.T, names ...string) {
+	t.Helper()
+	for _, name := range names {
+		if _, err := os.Lstat(name); !errors.Is(err, os.ErrNotExist) {
+			t.Errorf("%s should be removed: %v", name, err)
+		}
+	}
+}
+
+func TestRemoveInside(t *testing.T) {
+	t.Run("outside path", func(t *testing.T) {
+		workDir := t.TempDir()
+		for _, path := range []string{"../x", "/etc/passwd", ""} {
+			if err := removeInside(workDir, path); !errors.Is(err, errUnsafePath) {
+				t.Errorf("removeInside(%q) = %v, want %v", path, err, errUnsafePath)
+			}
+		}
+	})
+	t.Run("symlinked parent", func(t *testing.T) {
+		workDir, outside := t.TempDir(), t.TempDir()
+		writeFiles(t, outside, "1.0/secret")
+		if err := os.Symlink(outside, filepath.Join(workDir, "pkg")); err != nil {
+			t.Fatal(err)
+		}
+		if err := removeInside(workDir, "pkg/1.0/secret"); !errors.Is(err, errUnsafePath) {
+			t.Errorf("removeInside = %v, want %v", err, errUnsafePath)
+		}
+		if err := removeInside(workDir, "pkg/1.0"); !errors.Is(err, errUnsafePath) {
+			t.Errorf("removeInside = %v, want %v", err, errUnsafePath)
+		}
+		assertExists(t, filepath.Join(outside, "1.0/secret"))
+	})
+	t.Run("symlink itself", func(t *testing.T) {
+		workDir, outside := t.TempDir(), t.TempDir()
+		writeFiles(t, outside, "secret")
+		link := filepath.Join(workDir, "link")
+		if err := os.Symlink(outside, link); err != nil {
+			t.Fatal(err)
+		}
+		if err := removeInside(workDir, "link"); err != nil {
+			t.Fatal(err)
+		}
+		assertRemoved(t, link)
+		assertExists(t, filepath.Join(outside, "secret"))
+	})
+	t.Run("symlinked work directory", func(t *testing.T) {
+		realDir := t.TempDir()
+		writeFiles(t, realDir, "pkg/1.0/extra")
+		workDir := filepath.Join(t.TempDir(), "work")
+		if err := os.Symlink(realDir, workDir); err != nil {
+			t.Fatal(err)
+		}
+		if err := removeInside(workDir, "pkg/1.0/extra"); err != nil {
+			t.Fatal(err)
+		}
+		assertRemoved(t, filepath.Join(realDir, "pkg/1.0/extra"))
+	})
+}
+
+func TestCleanupHostileLayout(t *testing.T) {
+	ctx := withOptions(context.Background(), testOptions(t, "-cleanup", "cache"))
+	workDir, outside := t.TempDir(), t.TempDir()
+	writeFiles(t, outside, "secret", "1.0/lib/secret.dll", "1.0/foo.1.0.nupkg")
+	writeFiles(t, workDir,
+		"foo/1.0/foo.1.0.nupkg",
+		"foo/1.0/foo.1.0.nupkg.sha512",
+		"foo/1.0/foo.nuspec",
+		"foo/1.0/lib/foo.dll",
+		"foo/stray",
+		"stray",
+	)
+	for link, target := range map[string]string{
+		"linked":          outside,                          // a package directory
+		"bar/1.0":         filepath.Join(outside, "1.0"),    // a version directory
+		"foo/1.0/lib2":    outside,                          // inside a package
+		"foo/1.0/x.nupkg": filepath.Join(outside, "secret"), // a kept name
+	} {
+		name := filepath.Join(workDir, link)
+		if err := os.MkdirAll(filepath.Dir(name), 0o755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.Symlink(target, name); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if err := cleanup(ctx, workDir); err != nil {
+		t.Fatal(err)
+	}
+	assertExists(t,
+		filepath.Join(workDir, "foo/1.0/foo.1.0.nupkg"),
+		filepath.Join(workDir, "foo/1.0/foo.1.0.nupkg.sha512"),
+		filepath.Join(workDir, "foo/1.0/foo.nuspec"),
+		filepath.Join(outside, "secret"),
+		filepath.Join(outside, "1.0/lib/secret.dll"),
+		filepath.Join(outside, "1.0/foo.1.0.nupkg"),
+	)
+	assertRemoved(t,
+		filepath.Join(workDir, "foo/1.0/lib"),
+		filepath.Join(workDir, "foo/1.0/lib2"),
+		filepath.Join(workDir, "foo/stray"),
+		filepath.Join(workDir, "stray"),
+		filepath.Join(workDir, "linked"),
+		filepath.Join(workDir, "bar/1.0"),
+	)
+}
+
+func TestCleanupKeep(t *testing.T) {
+	ctx := withOptions(context.Background(), testOptions(t, "-cleanup", "minimal", "-cleanup-keep", "*.metadata", "-cleanup-keep", "icon.png"))
+	workDir := t.TempDir()
+	writeFiles(t, workDir,
+		"foo/1.0/foo.1.0.nupkg",
+		"foo/1.0/foo.nuspec",
+		"foo/1.0/.nupkg.metadata",
+		"foo/1.0/icon.png",
+		"foo/1.0/lib/icon.png",
+	)
+	if err := cleanup(ctx, workDir); err != nil {
+		t.Fatal(err)
+	}
+	assertExists(t,
+		filepath.Join(workDir, "foo/1.0/foo.1.0.nupkg"),
+		filepath.Join(workDir, "foo/1.0/.nupkg.metadata"),
+		filepath.Join(workDir, "foo/1.0/icon.png"),
+	)
+	assertRemoved(t,
+		filepath.Join(workDir, "foo/1.0/foo.nuspec"),
+		filepath.Join(workDir, "foo/1.0/lib"),
+	)
+	for _, pattern := range []string{"lib/*.dll", "[", ""} {
+		if _, err := parseOptions(flag.NewFlagSet("test", flag.ContinueOnError), []string{"-cleanup-keep", pattern}); err == nil {
+			t.Errorf("-cleanup-keep %q was accepted", pattern)
+		}
+	}
+}
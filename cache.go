@@ -0,0 +1,127 @@
+package main
+
+import (
+	"cmp"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"text/tabwriter"
+	"time"
+)
+
+// The file in the -cache-dir directory recording how packages are used.
+const cacheStatsFile = "stats.json"
+
+// cachePackageStats is how often a package was restored with -cache-dir, and
+// how often it was already in the HTTP cache.
+type cachePackageStats struct {
+	ID       string    `json:"id"`
+	Version  string    `json:"version"`
+	Uses     int       `json:"uses"`
+	Hits     int       `json:"hits"`
+	LastUsed time.Time `json:"lastUsed"`
+}
+
+// The name of the file NuGet stores a package in, in the HTTP cache.
+func httpCacheName(id, version string) string {
+	return strings.ToLower("nupkg_" + id + "." + version + ".dat")
+}
+
+// List the packages in the HTTP cache of a -cache-dir directory, by the names
+// of their files.
+func cachedPackages(cacheDir string) (map[string]bool, error) {
+	cached := make(map[string]bool)
+	err := filepath.WalkDir(filepath.Join(cacheDir, "http"), func(name string, d fs.DirEntry, err error) error {
+		if errors.Is(err, fs.ErrNotExist) {
+			return nil
+		} else if err != nil || d.IsDir() {
+			return err
+		}
+		if base := strings.ToLower(d.Name()); strings.HasPrefix(base, "nupkg_") {
+			cached[base] = true
+		}
+		return nil
+	})
+	return cached, err
+}
+
+// Read the package statistics of a -cache-dir directory.
+func readCacheStats(cacheDir string) ([]cachePackageStats, error) {
+	buf, err := os.ReadFile(filepath.Join(cacheDir, cacheStatsFile))
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+	var stats []cachePackageStats
+	if err := json.Unmarshal(buf, &stats); err != nil {
+		return nil, fmt.Errorf("invalid %s: %w", cacheStatsFile, err)
+	}
+	return stats, nil
+}
+
+// Record the use of the restored packages in the statistics of the -cache-dir
+// directory, counting those that were in the HTTP cache before restoring as
+// hits.
+func recordCacheStats(ctx context.Context, cached map[string]bool, packages []manifestPackage) error {
+	opts := optionsFrom(ctx)
+	stats, err := readCacheStats(opts.cacheDir)
+	if err != nil {
+		return err
+	}
+	now := time.Now().UTC()
+	for _, pkg := range packages {
+		i := slices.IndexFunc(stats, func(s cachePackageStats) bool {
+			return strings.EqualFold(s.ID, pkg.ID) && strings.EqualFold(s.Version, pkg.Version)
+		})
+		if i < 0 {
+			stats = append(stats, cachePackageStats{ID: pkg.ID, Version: pkg.Version})
+			i = len(stats) - 1
+		}
+		stats[i].Uses++
+		if cached[httpCacheName(pkg.ID, pkg.Version)] {
+			stats[i].Hits++
+		}
+		stats[i].LastUsed = now
+	}
+	buf, err := json.MarshalIndent(stats, "", "  ")
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(filepath.Join(opts.cacheDir, cacheStatsFile), buf, 0o644)
+}
+
+// Manage the -cache-dir directory (the cache command).
+func runCache(ctx context.Context, w io.Writer, args []string) error {
+	opts := optionsFrom(ctx)
+	if len(args) != 1 || args[0] != "stats" {
+		return fmt.Errorf("usage: cache stats")
+	}
+	if opts.cacheDir == "" {
+		return fmt.Errorf("-cache-dir must be given")
+	}
+	stats, err := readCacheStats(opts.cacheDir)
+	if err != nil {
+		return err
+	}
+	// The most used packages first, as those are the ones worth keeping.
+	slices.SortFunc(stats, func(a, b cachePackageStats) int {
+		if c := cmp.Compare(b.Uses, a.Uses); c != 0 {
+			return c
+		}
+		return cmp.Or(strings.Compare(a.ID, b.ID), strings.Compare(a.Version, b.Version))
+	})
+	writer := tabwriter.NewWriter(w, 0, 8, 2, ' ', 0)
+	fmt.Fprintf(writer, "PACKAGE\tVERSION\tUSES\tHITS\tLAST USED\n")
+	for _, s := range stats {
+		fmt.Fprintf(writer, "%s\t%s\t%d\t%d\t%s\n", s.ID, s.Version, s.Uses, s.Hits, s.LastUsed.Format(time.DateOnly))
+	}
+	return writer.Flush()
+}
@@ -0,0 +1,117 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io/fs"
+	"log/slog"
+	"maps"
+	"os"
+	"path/filepath"
+	"slices"
+)
+
+// Build the output again in a temporary directory and compare it with the
+// existing one (the check command), so that scheduled jobs can detect when the
+// sources and the committed packages archive have drifted apart.  Returns
+// [ErrDrift] if they differ, after printing what changed.
+func runCheck(ctx context.Context) error {
+	opts := optionsFrom(ctx)
+	outBase, err := outputBase(opts)
+	if err != nil {
+		return err
+	}
+	committed := outBase + outputExtension(opts)
+	if _, err := os.Stat(committed); err != nil {
+		return fmt.Errorf("failed to find output to check: %w", err)
+	}
+	tempDir, err := os.MkdirTemp("", "obs-service-dotnet-packages-check-*")
+	if err != nil {
+		return err
+	}
+	defer os.RemoveAll(tempDir)
+
+	checkOpts := *opts
+	checkOpts.outDir = filepath.Join(tempDir, "out")
+	checkOpts.force = true
+	checkOpts.noClobber = false
+	if err := os.Mkdir(checkOpts.outDir, 0o755); err != nil {
+		return err
+	}
+	if err := build(withOptions(ctx, &checkOpts)); err != nil {
+		return err
+	}
+	rebuiltBase, err := outputBase(&checkOpts)
+	if err != nil {
+		return err
+	}
+	rebuilt := rebuiltBase + outputExtension(opts)
+
+	committedHash, err := fileSHA256(committed)
+	if err != nil {
+		return err
+	}
+	rebuiltHash, err := fileSHA256(rebuilt)
+	if err != nil {
+		return err
+	}
+	if committedHash == rebuiltHash {
+		slog.InfoContext(ctx, "output is up to date", "output", committed, "sha256", committedHash)
+		return nil
+	}
+
+	committedFiles, err := archiveContents(ctx, committed, filepath.Join(tempDir, "committed"))
+	if err != nil {
+		return err
+	}
+	rebuiltFiles, err := archiveContents(ctx, rebuilt, filepath.Join(tempDir, "rebuilt"))
+	if err != nil {
+		return err
+	}
+	var changes []string
+	for _, name := range slices.Sorted(maps.Keys(committedFiles)) {
+		if hash, ok := rebuiltFiles[name]; !ok {
+			changes = append(changes, "- "+name)
+		} else if hash != committedFiles[name] {
+			changes = append(changes, "~ "+name)
+		}
+	}
+	for _, name := range slices.Sorted(maps.Keys(rebuiltFiles)) {
+		if _, ok := committedFiles[name]; !ok {
+			changes = append(changes, "+ "+name)
+		}
+	}
+	if len(changes) == 0 {
+		slog.WarnContext(ctx, "output only differs in metadata such as timestamps; set SOURCE_DATE_EPOCH for reproducible archives", "output", committed)
+		return nil
+	}
+	fmt.Printf("%s differs from a fresh build:\n", committed)
+	for _, change := range changes {
+		fmt.Println(change)
+	}
+	return fmt.Errorf("%w: %d files differ in %s", ErrDrift, len(changes), committed)
+}
+
+// Extract an output archive into dir, returning the SHA-256 of each file by
+// its path in the archive.
+func archiveContents(ctx context.Context, archive, dir string) (map[string]string, error) {
+	if err := os.Mkdir(dir, 0o755); err != nil {
+		return nil, err
+	}
+	if _, err := extractArchive(ctx, archive, dir); err != nil {
+		return nil, err
+	}
+	files := make(map[string]string)
+	err := filepath.WalkDir(dir, func(name string, d fs.DirEntry, err error) error {
+		if err != nil || !d.Type().IsRegular() {
+			return err
+		}
+		rel, err := filepath.Rel(dir, name)
+		if err != nil {
+			return err
+		}
+		files[filepath.ToSlash(rel)], err = fileSHA256(name)
+		return err
+	})
+	return files, err
+}
@@ -0,0 +1,44 @@
+//go:build !nodocker
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"os"
+
+	"github.com/docker/docker/client"
+)
+
+// Whether this build can restore in containers; see nodocker.go.
+const haveContainers = true
+
+// Create a client for the container runtime selected in the options. Podman is
+// used through its docker-compatible API.
+func newContainerClient(ctx context.Context) (*client.Client, error) {
+	runtime := optionsFrom(ctx).runtime
+	if runtime == containerRuntimeAuto {
+		runtime = containerRuntimeDocker
+		if os.Getenv("DOCKER_HOST") == "" {
+			if _, err := os.Stat(dockerSocket); err != nil && findPodmanSocket() != "" {
+				runtime = containerRuntimePodman
+			}
+		}
+		slog.DebugContext(ctx, "detected container runtime", "runtime", runtime)
+	}
+
+	opts := []client.Opt{client.FromEnv, client.WithAPIVersionNegotiation()}
+	if runtime == containerRuntimePodman {
+		socket := findPodmanSocket()
+		if socket == "" {
+			return nil, fmt.Errorf("could not find podman socket; is podman.socket running?")
+		}
+		opts = append(opts, client.WithHost("unix://"+socket))
+	}
+	dc, err := client.NewClientWithOpts(opts...)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create %s client: %w", runtime, err)
+	}
+	return dc, nil
+}
@@ -0,0 +1,465 @@
+//go:build !nodocker
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"os"
+	"slices"
+
+	"github.com/docker/docker/api/types/container"
+	"github.com/docker/docker/api/types/mount"
+	"github.com/docker/docker/api/types/network"
+	"github.com/docker/docker/client"
+	"github.com/docker/docker/pkg/stdcopy"
+	"github.com/moby/term"
+)
+
+// Create a bind mount of a host directory into the container.
+func bindMount(source, target string, readOnly bool) mount.Mount {
+	return mount.Mount{
+		Type:     mount.TypeBind,
+		Source:   source,
+		Target:   target,
+		ReadOnly: readOnly,
+		BindOptions: &mount.BindOptions{
+			CreateMountpoint: true,
+		},
+	}
+}
+
+// The directory in the container used for HOME and other per-user state, so
+// that the SDK works regardless of the user it runs as.
+const scratchDir = "/scratch"
+
+// The environment for commands in the container; later entries override
+// earlier ones.
+func containerEnv(ctx context.Context) []string {
+	opts := optionsFrom(ctx)
+	env := []string{
+		"HOME=" + scratchDir,
+		"DOTNET_CLI_HOME=" + scratchDir,
+		"XDG_CONFIG_HOME=" + scratchDir + "/.config",
+		"XDG_CACHE_HOME=" + scratchDir + "/.cache",
+		"XDG_DATA_HOME=" + scratchDir + "/.local/share",
+		"DOTNET_CLI_TELEMETRY_OPTOUT=1",
+		"DOTNET_NOLOGO=1",
+		"DOTNET_SKIP_FIRST_TIME_EXPERIENCE=1",
+	}
+	env = append(env, localeEnv...)
+	if opts.sourceDateEpoch != "" {
+		env = append(env, "SOURCE_DATE_EPOCH="+opts.sourceDateEpoch)
+	}
+	return append(env, opts.env...)
+}
+
+// Create and start a container from the SDK image with the given host
+// configuration. The returned function removes the container again.
+func startContainer(ctx context.Context, dc *client.Client, image string, hostConfig *container.HostConfig) (string, func(), error) {
+	opts := optionsFrom(ctx)
+	if image == sdkImage(ctx) {
+		if err := ensureImage(ctx, dc); err != nil {
+			return "", nil, err
+		}
+	}
+	hostConfig.AutoRemove = true
+	if !slices.ContainsFunc(hostConfig.Mounts, func(m mount.Mount) bool { return m.Target == scratchDir }) {
+		hostConfig.Tmpfs = map[string]string{scratchDir: "mode=1777"}
+	}
+	c, err := dc.ContainerCreate(
+		ctx,
+		&container.Config{
+			Cmd:        []string{"sleep", "inf"},
+			Image:      image,
+			WorkingDir: "/src",
+			Env:        containerEnv(ctx),
+			User:       opts.containerUser,
+		},
+		hostConfig,
+		nil,
+		nil,
+		"")
+	if err != nil {
+		return "", nil, fmt.Errorf("failed to create container: %w", err)
+	}
+	remove := func() {
+		// Remove the container even if the context is done (such as after
+		// -timeout), which also stops anything still running in it.
+		err := dc.ContainerRemove(context.WithoutCancel(ctx), c.ID, container.RemoveOptions{Force: true})
+		if err != nil {
+			slog.ErrorContext(ctx, "failed to remove container", "error", err)
+		}
+	}
+	if err := dc.ContainerStart(ctx, c.ID, container.StartOptions{}); err != nil {
+		remove()
+		return "", nil, err
+	}
+	return c.ID, remove, nil
+}
+
+// containerRestoreEnv restores packages in a container, with the sources
+// mounted at /src and the packages at /out.
+type containerRestoreEnv struct {
+	dc          *client.Client
+	containerID string
+	srcPath     string                          // sources in the container
+	outPath     string                          // packages in the container
+	execEnv     []string                        // environment for commands, in addition to the container's
+	args        []string                        // extra arguments for dotnet restore
+	collect     func(ctx context.Context) error // if set, copies the packages out
+	cleanups    []func()                        // run in reverse order on close
+}
+
+// Start a container for restoring the sources in srcDir into outDir. If
+// network access is disabled, downloads through the proxy are recorded in the
+// manifest when the environment is closed.
+func newContainerRestoreEnv(ctx context.Context, srcDir, outDir string, m *manifest) (*containerRestoreEnv, error) {
+	opts := optionsFrom(ctx)
+	dc, err := newContainerClient(ctx)
+	if err != nil {
+		return nil, err
+	}
+	env := &containerRestoreEnv{dc: dc, srcPath: "/src", outPath: "/out"}
+	hostConfig := &container.HostConfig{
+		Mounts: []mount.Mount{
+			bindMount(srcDir, "/src", false),
+			bindMount(outDir, "/out", false),
+		},
+	}
+	if opts.cacheDir != "" {
+		if err := os.MkdirAll(opts.cacheDir, 0o755); err != nil {
+			return nil, fmt.Errorf("failed to create cache directory: %w", err)
+		}
+		hostConfig.Mounts = append(hostConfig.Mounts, bindMount(opts.cacheDir, "/cache", false))
+		env.execEnv = append(env.execEnv, "NUGET_HTTP_CACHE_PATH=/cache/http")
+	}
+	if opts.noNetwork {
+		proxy, networkName, configDir, stop, err := startIsolatedProxy(ctx, dc)
+		if err != nil {
+			return nil, err
+		}
+		env.cleanups = append(env.cleanups, func() {
+			m.Fetches = proxy.recorded()
+			stop()
+		})
+		hostConfig.NetworkMode = container.NetworkMode(networkName)
+		hostConfig.Mounts = append(hostConfig.Mounts, bindMount(configDir, "/nuget", true))
+		env.args = append(env.args, "--configfile", "/nuget/NuGet.Config")
+	}
+	image, warmMounts, err := restoreImage(ctx, dc)
+	if err != nil {
+		env.close(ctx)
+		return nil, err
+	}
+	hostConfig.Mounts = append(hostConfig.Mounts, warmMounts...)
+	containerID, removeContainer, err := startContainer(ctx, dc, image, hostConfig)
+	if err != nil {
+		env.close(ctx)
+		return nil, err
+	}
+	env.containerID = containerID
+	if len(warmMounts) > 0 {
+		if err := prepareWarmVolume(ctx, dc, containerID); err != nil {
+			removeContainer()
+			env.close(ctx)
+			return nil, err
+		}
+	}
+	env.cleanups = append(env.cleanups, removeContainer, func() {
+		// Always reset permissions after running dotnet restore, so that the
+		// temporary directories can be removed.
+		if err := setPermissions(context.WithoutCancel(ctx), dc, containerID, "/src", "/out"); err != nil {
+			slog.ErrorContext(
+				ctx,
+				"failed to reset permissions, temporary files may be left behind",
+				"error", err,
+				"src", srcDir,
+				"out", outDir,
+			)
+		}
+	})
+	return env, nil
+}
+
+func (e *containerRestoreEnv) exec(ctx context.Context, output io.Writer, cmd ...string) error {
+	execOptions := container.ExecOptions{WorkingDir: e.srcPath, Env: e.execEnv, Cmd: cmd}
+	return runExec(ctx, e.dc, e.containerID, output, execOptions)
+}
+
+func (e *containerRestoreEnv) sourcesPath() string {
+	return e.srcPath
+}
+
+func (e *containerRestoreEnv) packagesPath() string {
+	return e.outPath
+}
+
+func (e *containerRestoreEnv) restoreArgs() []string {
+	return e.args
+}
+
+func (e *containerRestoreEnv) finish(ctx context.Context) error {
+	if e.collect == nil {
+		return nil
+	}
+	return e.collect(ctx)
+}
+
+func (e *containerRestoreEnv) close(ctx context.Context) {
+	for _, f := range slices.Backward(e.cleanups) {
+		f()
+	}
+	e.cleanups = nil
+}
+
+// Run a command in the container, copying its output to the given writer (if
+// it is not nil).
+func execInContainer(ctx context.Context, dc *client.Client, containerID string, output io.Writer, cmd ...string) error {
+	return runExec(ctx, dc, containerID, output, container.ExecOptions{Cmd: cmd})
+}
+
+// Run a command in the container as described by execOptions, copying its
+// output to the given writer (if it is not nil).
+func runExec(ctx context.Context, dc *client.Client, containerID string, output io.Writer, execOptions container.ExecOptions) error {
+	cmd := execOptions.Cmd
+	execOptions.AttachStdout = true
+	execOptions.AttachStderr = true
+	exec, err := dc.ContainerExecCreate(ctx, containerID, execOptions)
+	if err != nil {
+		return err
+	}
+	resp, err := dc.ContainerExecAttach(ctx, exec.ID, container.ExecStartOptions{})
+	if err != nil {
+		return err
+	}
+	defer resp.Close()
+	// Reading the output does not stop when the context is done.
+	stop := context.AfterFunc(ctx, resp.Close)
+	defer stop()
+	if err := dc.ContainerExecStart(ctx, exec.ID, container.ExecStartOptions{}); err != nil {
+		return err
+	}
+	if output == nil {
+		logWriter := newLogWriter(ctx, cmd[0])
+		defer logWriter.Close()
+		output = logWriter
+	}
+	// Without a TTY, stdout and stderr are multiplexed into one stream.
+	if _, err := stdcopy.StdCopy(output, output, resp.Reader); err != nil {
+		if ctx.Err() != nil {
+			return fmt.Errorf("%s: %w", cmd[0], context.Cause(ctx))
+		}
+		return fmt.Errorf("failed to read output of %s: %w", cmd[0], err)
+	}
+	inspect, err := dc.ContainerExecInspect(ctx, exec.ID)
+	if err != nil {
+		return err
+	}
+	if inspect.ExitCode != 0 {
+		return &exitError{command: cmd[0], exitCode: inspect.ExitCode}
+	}
+	return nil
+}
+
+// Run a command in the container, connected to the standard input and output
+// of this process.
+func execInteractive(ctx context.Context, dc *client.Client, containerID string, cmd ...string) error {
+	inFd, isTerminal := term.GetFdInfo(os.Stdin)
+	exec, err := dc.ContainerExecCreate(
+		ctx,
+		containerID,
+		container.ExecOptions{
+			Tty:          isTerminal,
+			AttachStdin:  true,
+			AttachStdout: true,
+			AttachStderr: true,
+			Cmd:          cmd,
+		})
+	if err != nil {
+		return err
+	}
+	resp, err := dc.ContainerExecAttach(ctx, exec.ID, container.ExecStartOptions{Tty: isTerminal})
+	if err != nil {
+		return err
+	}
+	defer resp.Close()
+	if isTerminal {
+		state, err := term.SetRawTerminal(inFd)
+		if err != nil {
+			return fmt.Errorf("failed to set up terminal: %w", err)
+		}
+		defer func() { _ = term.RestoreTerminal(inFd, state) }()
+		if size, err := term.GetWinsize(inFd); err == nil {
+			resizeOptions := container.ResizeOptions{Height: uint(size.Height), Width: uint(size.Width)}
+			if err := dc.ContainerExecResize(ctx, exec.ID, resizeOptions); err != nil {
+				slog.DebugContext(ctx, "failed to resize terminal", "error", err)
+			}
+		}
+	}
+	go func() {
+		_, _ = io.Copy(resp.Conn, os.Stdin)
+		_ = resp.CloseWrite()
+	}()
+	if isTerminal {
+		_, _ = io.Copy(os.Stdout, resp.Reader)
+	} else {
+		_, _ = stdcopy.StdCopy(os.Stdout, os.Stderr, resp.Reader)
+	}
+	inspect, err := dc.ContainerExecInspect(ctx, exec.ID)
+	if err != nil {
+		return err
+	}
+	if inspect.ExitCode != 0 {
+		return &exitError{command: cmd[0], exitCode: inspect.ExitCode}
+	}
+	return nil
+}
+
+// Create an internal network with no external access, and start a NuGet proxy
+// reachable from that network. Containers on the network must use the NuGet
+// configuration file in the returned directory. The returned function stops
+// the proxy and removes the network.
+func startIsolatedProxy(ctx context.Context, dc *client.Client) (*nugetProxy, string, string, func(), error) {
+	opts := optionsFrom(ctx)
+	var cleanups []func()
+	stop := func() {
+		for _, f := range slices.Backward(cleanups) {
+			f()
+		}
+	}
+	fail := func(err error) (*nugetProxy, string, string, func(), error) {
+		stop()
+		return nil, "", "", nil, err
+	}
+
+	name, gateway, removeNetwork, err := createInternalNetwork(ctx, dc)
+	if err != nil {
+		return fail(err)
+	}
+	cleanups = append(cleanups, removeNetwork)
+
+	proxy, err := startNugetProxy(
+		ctx,
+		net.JoinHostPort(gateway, "0"),
+		opts.upstream,
+		opts.recordDir,
+		opts.replayDir)
+	if err != nil {
+		return fail(err)
+	}
+	cleanups = append(cleanups, func() { _ = proxy.close() })
+
+	configDir, err := os.MkdirTemp("", "obs-service-dotnet-packages-nuget-*")
+	if err != nil {
+		return fail(err)
+	}
+	cleanups = append(cleanups, func() { _ = os.RemoveAll(configDir) })
+	if err := proxy.writeNugetConfig(configDir, opts.upstream); err != nil {
+		return fail(fmt.Errorf("failed to write NuGet configuration: %w", err))
+	}
+
+	return proxy, name, configDir, stop, nil
+}
+
+// Create a network without outside access for a container, returning its name
+// and the address of the host in it, where the host can serve the container.
+func createInternalNetwork(ctx context.Context, dc *client.Client) (string, string, func(), error) {
+	name := fmt.Sprintf("obs-service-dotnet-packages-%d", os.Getpid())
+	resp, err := dc.NetworkCreate(ctx, name, network.CreateOptions{Internal: true})
+	if err != nil {
+		return "", "", nil, fmt.Errorf("failed to create network: %w", err)
+	}
+	remove := func() {
+		if err := dc.NetworkRemove(context.WithoutCancel(ctx), resp.ID); err != nil {
+			slog.ErrorContext(ctx, "failed to remove network", "network", name, "error", err)
+		}
+	}
+	info, err := dc.NetworkInspect(ctx, resp.ID, network.InspectOptions{})
+	if err != nil {
+		remove()
+		return "", "", nil, fmt.Errorf("failed to inspect network: %w", err)
+	}
+	if len(info.IPAM.Config) < 1 || info.IPAM.Config[0].Gateway == "" {
+		remove()
+		return "", "", nil, fmt.Errorf("could not determine gateway of network %s", name)
+	}
+	return name, info.IPAM.Config[0].Gateway, remove, nil
+}
+
+// Reset the owner of the given paths in the container to match the (host)
+// owner of /src.
+func setPermissions(ctx context.Context, dc *client.Client, containerID string, paths ...string) error {
+	slog.InfoContext(ctx, "resetting file permissions")
+	cmd := []string{"chown", "--recursive", "--reference=/src"}
+	return execInContainer(ctx, dc, containerID, nil, append(cmd, paths...)...)
+}
+
+// Verify that the packages in outDir are sufficient to restore the targets
+// (relative to srcDir) in a container without network access. With
+// -smoke-test-feed, the packages are served to it as an HTTP feed rather than
+// mounted as a directory.
+func smokeTest(ctx context.Context, srcDir, outDir string, targets []string) error {
+	opts := optionsFrom(ctx)
+	slog.InfoContext(ctx, "verifying offline restore")
+	dc, err := newContainerClient(ctx)
+	if err != nil {
+		return err
+	}
+	hostConfig := &container.HostConfig{
+		NetworkMode: network.NetworkNone,
+		Mounts: []mount.Mount{
+			bindMount(srcDir, "/src", false),
+			bindMount(outDir, "/packages", true),
+		},
+	}
+	sourceArgs := []string{"--source", "/packages"}
+	if opts.smokeTestFeed {
+		networkName, gateway, removeNetwork, err := createInternalNetwork(ctx, dc)
+		if err != nil {
+			return err
+		}
+		defer removeNetwork()
+		feed, err := startLocalFeed(ctx, net.JoinHostPort(gateway, "0"), outDir)
+		if err != nil {
+			return err
+		}
+		defer feed.close()
+		configDir, err := os.MkdirTemp("", "obs-service-dotnet-packages-nuget-*")
+		if err != nil {
+			return err
+		}
+		defer os.RemoveAll(configDir)
+		if err := feed.writeNugetConfig(configDir); err != nil {
+			return fmt.Errorf("failed to write NuGet configuration: %w", err)
+		}
+		hostConfig.NetworkMode = container.NetworkMode(networkName)
+		hostConfig.Mounts = append(hostConfig.Mounts, bindMount(configDir, "/nuget", true))
+		sourceArgs = []string{"--configfile", "/nuget/NuGet.Config"}
+	}
+	containerID, removeContainer, err := startContainer(ctx, dc, sdkImage(ctx), hostConfig)
+	if err != nil {
+		return err
+	}
+	defer removeContainer()
+	defer func() {
+		if err := setPermissions(ctx, dc, containerID, "/src"); err != nil {
+			slog.ErrorContext(ctx, "failed to reset permissions, temporary files may be left behind", "error", err, "src", srcDir)
+		}
+	}()
+
+	for _, target := range targets {
+		slog.InfoContext(ctx, "restoring offline", "solution", target)
+		cmd := append([]string{"dotnet", "restore", target, "--packages", "/tmp/packages"}, sourceArgs...)
+		if opts.lockedMode {
+			cmd = append(cmd, "--locked-mode")
+		}
+		if err := execInContainer(ctx, dc, containerID, nil, cmd...); err != nil {
+			return fmt.Errorf("offline restore of %s failed: %w", target, err)
+		}
+	}
+	return nil
+}
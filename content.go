@@ -0,0 +1,114 @@
+package main
+
+import (
+	"archive/zip"
+	"context"
+	"fmt"
+	"log/slog"
+	"path"
+	"path/filepath"
+	"slices"
+	"strings"
+)
+
+// Kinds of package content that distributions review before shipping.
+const (
+	contentNative     = "native"     // Native shared libraries
+	contentScript     = "script"     // Install scripts and shell scripts
+	contentExecutable = "executable" // Executables
+)
+
+// contentKindList is a flag collecting kinds of package content.
+type contentKindList []string
+
+func (l *contentKindList) String() string {
+	if l == nil {
+		return "<nil>"
+	}
+	return strings.Join(*l, ",")
+}
+
+func (l *contentKindList) Set(value string) error {
+	switch value {
+	case contentNative, contentScript, contentExecutable:
+		*l = append(*l, value)
+		return nil
+	}
+	return fmt.Errorf("invalid content kind %s", value)
+}
+
+// manifestFinding is a file in a package that may need review.
+type manifestFinding struct {
+	ID      string `json:"id"`
+	Version string `json:"version"`
+	Path    string `json:"path"` // Path of the file in the .nupkg
+	Kind    string `json:"kind"`
+}
+
+// The kind of a file in a package, or the empty string if it needs no review.
+func contentKind(name string) string {
+	lower := strings.ToLower(name)
+	base := path.Base(lower)
+	switch {
+	case strings.HasSuffix(base, ".so") || strings.Contains(base, ".so.") || strings.HasSuffix(base, ".dylib"):
+		return contentNative
+	case strings.HasPrefix(lower, "runtimes/") && strings.Contains(lower, "/native/") && !strings.HasSuffix(lower, "/"):
+		return contentNative
+	case slices.Contains([]string{"install.ps1", "init.ps1", "uninstall.ps1"}, base):
+		return contentScript
+	case slices.Contains([]string{".sh", ".bat", ".cmd"}, path.Ext(base)):
+		return contentScript
+	case path.Ext(base) == ".exe":
+		return contentExecutable
+	}
+	return ""
+}
+
+// Scan the .nupkg files of the restored packages for native libraries,
+// scripts and executables, failing if -forbid-content forbids any of them.
+func scanPackageContents(ctx context.Context, dir string, packages []manifestPackage) ([]manifestFinding, error) {
+	opts := optionsFrom(ctx)
+	var findings []manifestFinding
+	for _, pkg := range packages {
+		names, err := filepath.Glob(filepath.Join(dir, pkg.ID, pkg.Version, "*.nupkg"))
+		if err != nil {
+			return nil, err
+		}
+		for _, name := range names {
+			reader, err := zip.OpenReader(name)
+			if err != nil {
+				return nil, fmt.Errorf("failed to open %s: %w", name, err)
+			}
+			for _, file := range reader.File {
+				if kind := contentKind(file.Name); kind != "" {
+					findings = append(findings, manifestFinding{ID: pkg.ID, Version: pkg.Version, Path: file.Name, Kind: kind})
+				}
+			}
+			reader.Close()
+		}
+	}
+
+	counts := make(map[string]int)
+	for _, finding := range findings {
+		level := slog.LevelDebug
+		if slices.Contains(opts.forbidContent, finding.Kind) {
+			level = slog.LevelWarn
+		}
+		slog.Log(ctx, level, "package content needs review", "package", finding.ID, "version", finding.Version, "path", finding.Path, "kind", finding.Kind)
+		counts[finding.Kind]++
+	}
+	var forbidden []string
+	for _, kind := range []string{contentNative, contentScript, contentExecutable} {
+		if counts[kind] == 0 {
+			continue
+		}
+		slog.InfoContext(ctx, "packages contain files that may need review", "kind", kind, "files", counts[kind])
+		if slices.Contains(opts.forbidContent, kind) {
+			forbidden = append(forbidden, fmt.Sprintf("%d %s", counts[kind], kind))
+		}
+	}
+	if len(forbidden) > 0 {
+		return nil, fmt.Errorf("packages contain forbidden files: %s", strings.Join(forbidden, ", "))
+	}
+	return findings, nil
+}
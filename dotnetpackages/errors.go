@@ -0,0 +1,41 @@
+// Package dotnetpackages holds the errors the service returns, so that programs
+// embedding or wrapping it can distinguish them; they are wrapped, so use
+// [errors.Is] and [errors.As] to check for them.
+package dotnetpackages
+
+import (
+	"errors"
+	"fmt"
+)
+
+var (
+	// ErrArchiveNotFound is returned when no source archive could be found.
+	ErrArchiveNotFound = errors.New("archive not found")
+	// ErrLockMismatch is returned when a lock file does not match the
+	// project's package references (NU1004).
+	ErrLockMismatch = errors.New("lock file does not match project")
+	// ErrDrift is returned by the check command when the output differs
+	// from a fresh build.
+	ErrDrift = errors.New("output differs from a fresh build")
+)
+
+// ErrRestoreFailed is returned when restoring a solution or project failed.
+type ErrRestoreFailed struct {
+	Solution string
+	ExitCode int // exit code of dotnet restore, or -1 if it did not run
+	Err      error
+	// Diagnostics describes the available SDKs and workloads if the failure
+	// looks like the SDK could not be resolved.
+	Diagnostics string
+}
+
+func (e *ErrRestoreFailed) Error() string {
+	if e.Diagnostics != "" {
+		return fmt.Sprintf("error restoring %s: %v\n%s", e.Solution, e.Err, e.Diagnostics)
+	}
+	return fmt.Sprintf("error restoring %s: %v", e.Solution, e.Err)
+}
+
+func (e *ErrRestoreFailed) Unwrap() error {
+	return e.Err
+}
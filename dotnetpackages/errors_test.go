@@ -0,0 +1,18 @@
+package dotnetpackages
+
+import (
+	"errors"
+	"fmt"
+	"testing"
+)
+
+func TestErrRestoreFailed(t *testing.T) {
+	err := fmt.Errorf("restore: %w", &ErrRestoreFailed{Solution: "app.sln", ExitCode: 1, Err: ErrLockMismatch})
+	var restoreErr *ErrRestoreFailed
+	if !errors.As(err, &restoreErr) || restoreErr.Solution != "app.sln" {
+		t.Errorf("errors.As did not find the restore failure in %v", err)
+	}
+	if !errors.Is(err, ErrLockMismatch) {
+		t.Errorf("errors.Is did not find the cause of %v", err)
+	}
+}
@@ -0,0 +1,35 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"net/url"
+	"os"
+	"path"
+	"strings"
+)
+
+// The number of the first spec file source written by -download-list, leaving
+// the lower ones for the sources of the package itself.
+const downloadListFirstSource = 1000
+
+// Write the packages downloaded through the proxy as spec file sources, with
+// their checksums, so that fetching and verifying them can be left to the
+// download_files service instead of shipping the output archive.
+func writeDownloadList(m *manifest, outputBase string) error {
+	var buf bytes.Buffer
+	fmt.Fprintf(&buf, "# Packages downloaded for %s; checksums are base64 SHA-512, as in .nupkg.sha512 files.\n", m.Archive)
+	number := downloadListFirstSource
+	seen := make(map[string]bool)
+	for _, fetch := range m.Fetches {
+		u, err := url.Parse(fetch.URL)
+		if err != nil || fetch.Status != 200 || !strings.HasSuffix(strings.ToLower(u.Path), ".nupkg") || seen[fetch.URL] {
+			continue
+		}
+		seen[fetch.URL] = true
+		fmt.Fprintf(&buf, "# %s sha512:%s\n", path.Base(u.Path), fetch.SHA512)
+		fmt.Fprintf(&buf, "%-16s%s\n", fmt.Sprintf("Source%d:", number), fetch.URL)
+		number++
+	}
+	return os.WriteFile(outputBase+".sources", buf.Bytes(), 0o644)
+}
@@ -0,0 +1,88 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"path/filepath"
+)
+
+// restoreEnv is an environment in which packages can be restored. Commands
+// run with the source directory as the working directory.
+type restoreEnv interface {
+	// Run a command, copying its output to the given writer (if not nil).
+	exec(ctx context.Context, output io.Writer, cmd ...string) error
+	// The path of the source directory, as seen by commands.
+	sourcesPath() string
+	// The path of the package output directory, as seen by commands.
+	packagesPath() string
+	// Extra arguments to pass to dotnet restore.
+	restoreArgs() []string
+	// Make the restored packages available in the output directory.
+	finish(ctx context.Context) error
+	// Release any resources held by the environment.
+	close(ctx context.Context)
+}
+
+// Environment variables fixing the time zone and language commands run with,
+// so that their output does not depend on the host: parsing the restore output
+// (for errors and timings) expects English messages, and dates in UTC.
+var localeEnv = []string{
+	"TZ=UTC",
+	"LC_ALL=C.UTF-8",
+	"DOTNET_CLI_UI_LANGUAGE=en",
+}
+
+// hostEnv restores packages using the dotnet SDK installed on the host.
+type hostEnv struct {
+	srcDir string
+	outDir string
+}
+
+func newHostEnv(srcDir, outDir string) *hostEnv {
+	return &hostEnv{srcDir: srcDir, outDir: outDir}
+}
+
+func (e *hostEnv) exec(ctx context.Context, output io.Writer, cmd ...string) error {
+	opts := optionsFrom(ctx)
+	if output == nil {
+		output = io.Discard
+	}
+	command := exec.CommandContext(ctx, cmd[0], cmd[1:]...)
+	command.Dir = e.srcDir
+	command.Env = append(os.Environ(), "DOTNET_CLI_TELEMETRY_OPTOUT=1", "DOTNET_NOLOGO=1")
+	command.Env = append(command.Env, localeEnv...)
+	if opts.cacheDir != "" {
+		command.Env = append(command.Env, "NUGET_HTTP_CACHE_PATH="+filepath.Join(opts.cacheDir, "http"))
+	}
+	command.Env = append(command.Env, opts.env...)
+	command.Stdout = output
+	command.Stderr = output
+	if err := command.Run(); err != nil {
+		if exitErr, ok := err.(*exec.ExitError); ok {
+			return &exitError{command: cmd[0], exitCode: exitErr.ExitCode()}
+		}
+		return fmt.Errorf("%s failed: %w", cmd[0], err)
+	}
+	return nil
+}
+
+func (e *hostEnv) sourcesPath() string {
+	return e.srcDir
+}
+
+func (e *hostEnv) packagesPath() string {
+	return e.outDir
+}
+
+func (e *hostEnv) restoreArgs() []string {
+	return nil
+}
+
+func (e *hostEnv) finish(context.Context) error {
+	return nil
+}
+
+func (e *hostEnv) close(context.Context) {}
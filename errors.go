@@ -0,0 +1,27 @@
+package main
+
+import (
+	"fmt"
+
+	"github.com/mook/obs-service-dotnet_packages/dotnetpackages"
+)
+
+// The errors callers may want to distinguish, defined in [dotnetpackages] so
+// that they can be imported.
+var (
+	ErrArchiveNotFound = dotnetpackages.ErrArchiveNotFound
+	ErrLockMismatch    = dotnetpackages.ErrLockMismatch
+	ErrDrift           = dotnetpackages.ErrDrift
+)
+
+type ErrRestoreFailed = dotnetpackages.ErrRestoreFailed
+
+// exitError is returned when a command exits unsuccessfully.
+type exitError struct {
+	command  string
+	exitCode int
+}
+
+func (e *exitError) Error() string {
+	return fmt.Sprintf("%s exited with code %d", e.command, e.exitCode)
+}
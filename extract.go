@@ -0,0 +1,25 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"os"
+)
+
+// Extract a source archive into a directory, as is done before restoring.
+func runExtract(ctx context.Context, args []string) error {
+	if len(args) != 2 {
+		return fmt.Errorf("usage: extract <archive> <directory>")
+	}
+	archive, dir := args[0], args[1]
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return fmt.Errorf("failed to create %s: %w", dir, err)
+	}
+	solutions, err := extractSources(ctx, archive, dir)
+	if err != nil {
+		return err
+	}
+	slog.InfoContext(ctx, "extracted archive", "archive", archive, "directory", dir, "solutions", solutions)
+	return nil
+}
@@ -0,0 +1,199 @@
+package main
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"bytes"
+	"context"
+	"errors"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/aibor/cpio"
+)
+
+func TestByteSize(t *testing.T) {
+	tests := []struct {
+		value string
+		want  byteSize
+	}{
+		{"0", 0},
+		{"1024", 1024},
+		{"4K", 4 << 10},
+		{"32g", 32 << 30},
+		{"8388607T", 8388607 << 40},
+	}
+	for _, tt := range tests {
+		var b byteSize
+		if err := b.Set(tt.value); err != nil || b != tt.want {
+			t.Errorf("Set(%q) = %d, %v, want %d", tt.value, b, err, tt.want)
+		}
+	}
+	for _, value := range []string{"", "-1", "1P", "K", "8388608T", "9223372036854775807K", "99999999999999999999"} {
+		var b byteSize
+		if err := b.Set(value); err == nil {
+			t.Errorf("Set(%q) = %d, want an error", value, b)
+		}
+	}
+}
+
+// Write a tar archive holding files of the given sizes.
+func writeTestTar(t *testing.T, name string, sizes ...int) {
+	t.Helper()
+	var buf bytes.Buffer
+	w := tar.NewWriter(&buf)
+	for i, size := range sizes {
+		h := &tar.Header{Name: filepath.Join("src", string(rune('a'+i))), Mode: 0o644, Size: int64(size), Typeflag: tar.TypeReg}
+		if err := w.WriteHeader(h); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := w.Write(make([]byte, size)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(name, buf.Bytes(), 0o644); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestExtractLimitsShared(t *testing.T) {
+	dir := t.TempDir()
+	first, second := filepath.Join(dir, "first.tar"), filepath.Join(dir, "second.tar")
+	writeTestTar(t, first, 600)
+	writeTestTar(t, second, 600)
+	ctx := withOptions(context.Background(), testOptions(t, "-max-extract-size", "1K"))
+
+	// Each archive is within the limit on its own.
+	for _, archive := range []string{first, second} {
+		if _, err := extractSources(ctx, archive, t.TempDir()); err != nil {
+			t.Errorf("extracting %s alone: %v", archive, err)
+		}
+	}
+	// Together, they are not.
+	shared := withExtractLimits(ctx, newExtractLimits(ctx))
+	if _, err := extractSources(shared, first, t.TempDir()); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := extractSources(shared, second, t.TempDir()); !errors.Is(err, errExtractLimit) {
+		t.Errorf("extracting both = %v, want %v", err, errExtractLimit)
+	}
+}
+
+// Write a tar archive of the given members; members with a link target are
+// symlinks, the others empty files.
+func writeTestLinkTar(t *testing.T, name string, members [][2]string) {
+	t.Helper()
+	var buf bytes.Buffer
+	w := tar.NewWriter(&buf)
+	for _, member := range members {
+		h := &tar.Header{Name: member[0], Mode: 0o644, Typeflag: tar.TypeReg}
+		if member[1] != "" {
+			h.Typeflag, h.Linkname, h.Mode = tar.TypeSymlink, member[1], 0o777
+		}
+		if err := w.WriteHeader(h); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(name, buf.Bytes(), 0o644); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestExtractSymlinkThroughSymlinkedParent(t *testing.T) {
+	for name, members := range map[string][][2]string{
+		"parent links to itself": {{"sub", "."}, {"sub/l", "../x"}},
+		"dot dot after a name":   {{"l", "a/../../x"}},
+		"later link changes ..":  {{"l", "a/../x"}, {"a", "."}},
+	} {
+		t.Run(name, func(t *testing.T) {
+			archive := filepath.Join(t.TempDir(), "sources.tar")
+			writeTestLinkTar(t, archive, members)
+			outDir := t.TempDir()
+			ctx := withOptions(context.Background(), testOptions(t, "-strict-paths"))
+			if _, err := extractSources(ctx, archive, outDir); !errors.Is(err, errUnsafePath) {
+				t.Errorf("extractSources = %v, want %v", err, errUnsafePath)
+			}
+			assertRemoved(t, filepath.Join(outDir, "l"))
+		})
+	}
+	t.Run("inside", func(t *testing.T) {
+		archive := filepath.Join(t.TempDir(), "sources.tar")
+		writeTestLinkTar(t, archive, [][2]string{{"file", ""}, {"dir/sub/l", "../../file"}, {"link", "dir/sub"}})
+		outDir := t.TempDir()
+		ctx := withOptions(context.Background(), testOptions(t, "-strict-paths"))
+		if _, err := extractSources(ctx, archive, outDir); err != nil {
+			t.Fatal(err)
+		}
+		assertExists(t, filepath.Join(outDir, "dir/sub/l"), filepath.Join(outDir, "link"))
+	})
+}
+
+// Write a zip and a cpio archive holding a symlink whose body is size bytes.
+func writeTestLongLinks(t *testing.T, dir string, size int) []string {
+	t.Helper()
+	body := bytes.Repeat([]byte("a"), size)
+
+	var zipBuf bytes.Buffer
+	zw := zip.NewWriter(&zipBuf)
+	h := &zip.FileHeader{Name: "link"}
+	h.SetMode(fs.ModeSymlink | 0o777)
+	member, err := zw.CreateHeader(h)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := member.Write(body); err != nil {
+		t.Fatal(err)
+	}
+	if err := zw.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	var cpioBuf bytes.Buffer
+	cw := cpio.NewWriter(&cpioBuf)
+	if err := cw.WriteHeader(&cpio.Header{Name: "link", Mode: cpio.TypeSymlink | 0o777, Size: int64(size)}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := cw.Write(body); err != nil {
+		t.Fatal(err)
+	}
+	if err := cw.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	names := []string{filepath.Join(dir, "long.zip"), filepath.Join(dir, "long.cpio")}
+	for i, buf := range []*bytes.Buffer{&zipBuf, &cpioBuf} {
+		if err := os.WriteFile(names[i], buf.Bytes(), 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return names
+}
+
+func TestExtractLongSymlink(t *testing.T) {
+	t.Run("target", func(t *testing.T) {
+		ctx := withOptions(context.Background(), testOptions(t))
+		for _, archive := range writeTestLongLinks(t, t.TempDir(), 1<<20) {
+			if _, err := extractSources(ctx, archive, t.TempDir()); !errors.Is(err, errExtractLimit) {
+				t.Errorf("extracting %s = %v, want %v", archive, err, errExtractLimit)
+			}
+		}
+	})
+	t.Run("size limit", func(t *testing.T) {
+		ctx := withOptions(context.Background(), testOptions(t, "-max-extract-file-size", "1K"))
+		for _, archive := range writeTestLongLinks(t, t.TempDir(), 2048) {
+			_, err := extractSources(ctx, archive, t.TempDir())
+			if !errors.Is(err, errExtractLimit) || !strings.Contains(err.Error(), "more than 1024") {
+				t.Errorf("extracting %s = %v, want the file size limit", archive, err)
+			}
+		}
+	})
+}
@@ -0,0 +1,160 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"log/slog"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+)
+
+// localFeed serves a package directory, laid out as <id>/<version>/..., as a
+// NuGet v3 feed over HTTP, to check that the packages work as a restore source
+// and not only as a directory of files.
+type localFeed struct {
+	dir      string
+	baseURL  string
+	listener net.Listener
+	server   *http.Server
+}
+
+// Start serving the packages in dir on the given address.
+func startLocalFeed(ctx context.Context, address, dir string) (*localFeed, error) {
+	listener, err := net.Listen("tcp", address)
+	if err != nil {
+		return nil, fmt.Errorf("failed to listen for package feed: %w", err)
+	}
+	f := &localFeed{
+		dir:      dir,
+		baseURL:  "http://" + listener.Addr().String(),
+		listener: listener,
+	}
+	f.server = &http.Server{
+		Handler:     f,
+		BaseContext: func(net.Listener) context.Context { return ctx },
+	}
+	go func() {
+		if err := f.server.Serve(listener); err != nil && !errors.Is(err, http.ErrServerClosed) {
+			slog.ErrorContext(ctx, "package feed failed", "error", err)
+		}
+	}()
+	slog.InfoContext(ctx, "started package feed", "address", f.baseURL, "dir", dir)
+	return f, nil
+}
+
+// The URL of the service index of the feed.
+func (f *localFeed) indexURL() string {
+	return f.baseURL + "/v3/index.json"
+}
+
+func (f *localFeed) close() error {
+	return f.server.Close()
+}
+
+// Serve the service index and the package base address (flat container)
+// resource, which is all that restoring needs.
+func (f *localFeed) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	slog.DebugContext(r.Context(), "package feed request", "method", r.Method, "path", r.URL.Path)
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if r.URL.Path == "/v3/index.json" {
+		writeJSON(w, map[string]any{
+			"version": "3.0.0",
+			"resources": []map[string]string{
+				{"@id": f.baseURL + "/v3-flatcontainer/", "@type": "PackageBaseAddress/3.0.0"},
+			},
+		})
+		return
+	}
+	rest, ok := strings.CutPrefix(r.URL.Path, "/v3-flatcontainer/")
+	if !ok {
+		http.NotFound(w, r)
+		return
+	}
+	parts := strings.Split(strings.ToLower(rest), "/")
+	for _, part := range parts {
+		if !filepath.IsLocal(part) {
+			http.NotFound(w, r)
+			return
+		}
+	}
+	switch {
+	case len(parts) == 2 && parts[1] == "index.json":
+		name, err := lookupFold(f.dir, parts[:1])
+		if err != nil {
+			http.NotFound(w, r)
+			return
+		}
+		entries, err := os.ReadDir(name)
+		if err != nil {
+			http.NotFound(w, r)
+			return
+		}
+		versions := []string{}
+		for _, entry := range entries {
+			if entry.IsDir() {
+				versions = append(versions, strings.ToLower(entry.Name()))
+			}
+		}
+		writeJSON(w, map[string][]string{"versions": versions})
+	case len(parts) == 3 && parts[2] == parts[0]+"."+parts[1]+".nupkg":
+		name, err := lookupFold(f.dir, parts)
+		if err != nil {
+			http.NotFound(w, r)
+			return
+		}
+		http.ServeFile(w, r, name)
+	default:
+		http.NotFound(w, r)
+	}
+}
+
+// Find the file at the given path under dir, ignoring the case of each
+// element: the feed protocol uses lower case, but packages merged from
+// elsewhere may not.
+func lookupFold(dir string, elements []string) (string, error) {
+	name := dir
+	for _, element := range elements {
+		entries, err := os.ReadDir(name)
+		if err != nil {
+			return "", err
+		}
+		i := slices.IndexFunc(entries, func(entry fs.DirEntry) bool {
+			return strings.EqualFold(entry.Name(), element)
+		})
+		if i < 0 {
+			return "", fmt.Errorf("%s: %w", filepath.Join(name, element), fs.ErrNotExist)
+		}
+		name = filepath.Join(name, entries[i].Name())
+	}
+	return name, nil
+}
+
+// Write a NuGet configuration file into dir that uses the feed as the only
+// package source.
+func (f *localFeed) writeNugetConfig(dir string) error {
+	config := fmt.Sprintf(`<?xml version="1.0" encoding="utf-8"?>
+<configuration>
+  <packageSources>
+    <clear />
+    <add key="output" value="%s" allowInsecureConnections="true" />
+  </packageSources>
+</configuration>
+`, f.indexURL())
+	return os.WriteFile(filepath.Join(dir, "NuGet.Config"), []byte(config), 0o644)
+}
+
+// Write a value as a JSON response.
+func writeJSON(w http.ResponseWriter, value any) {
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(value)
+}
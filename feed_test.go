@@ -0,0 +1,108 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+)
+
+func TestLocalFeed(t *testing.T) {
+	dir := t.TempDir()
+	writeFiles(t, dir,
+		"foo/1.0.0/foo.1.0.0.nupkg",
+		"foo/2.0.0-beta/foo.2.0.0-beta.nupkg",
+		"Mixed.Case/1.0.0-RC/Mixed.Case.1.0.0-RC.nupkg",
+		"secret",
+	)
+	f := &localFeed{dir: dir}
+	server := httptest.NewServer(f)
+	defer server.Close()
+	f.baseURL = server.URL
+
+	get := func(path string) (int, string) {
+		t.Helper()
+		resp, err := http.Get(server.URL + path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer resp.Body.Close()
+		body, err := io.ReadAll(resp.Body)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return resp.StatusCode, string(body)
+	}
+
+	t.Run("index", func(t *testing.T) {
+		code, body := get("/v3/index.json")
+		var index struct {
+			Resources []map[string]string `json:"resources"`
+		}
+		if err := json.Unmarshal([]byte(body), &index); code != http.StatusOK || err != nil {
+			t.Fatalf("index: %d %v %s", code, err, body)
+		}
+		if len(index.Resources) != 1 || index.Resources[0]["@id"] != server.URL+"/v3-flatcontainer/" {
+			t.Errorf("resources = %v", index.Resources)
+		}
+	})
+	t.Run("versions", func(t *testing.T) {
+		for path, want := range map[string]string{
+			"/v3-flatcontainer/foo/index.json":        `{"versions":["1.0.0","2.0.0-beta"]}` + "\n",
+			"/v3-flatcontainer/mixed.case/index.json": `{"versions":["1.0.0-rc"]}` + "\n",
+		} {
+			if code, body := get(path); code != http.StatusOK || body != want {
+				t.Errorf("GET %s = %d %q, want %q", path, code, body, want)
+			}
+		}
+	})
+	t.Run("nupkg", func(t *testing.T) {
+		for path, want := range map[string]string{
+			"/v3-flatcontainer/foo/1.0.0/foo.1.0.0.nupkg":                     "foo/1.0.0/foo.1.0.0.nupkg",
+			"/v3-flatcontainer/mixed.case/1.0.0-rc/mixed.case.1.0.0-rc.nupkg": "Mixed.Case/1.0.0-RC/Mixed.Case.1.0.0-RC.nupkg",
+		} {
+			code, body := get(path)
+			if code != http.StatusOK || body != dir+"/"+want {
+				t.Errorf("GET %s = %d %q", path, code, body)
+			}
+		}
+	})
+	t.Run("not found", func(t *testing.T) {
+		for _, path := range []string{
+			"/v3-flatcontainer/bar/index.json",
+			"/v3-flatcontainer/foo/1.0.0/bar.1.0.0.nupkg",
+			"/v3-flatcontainer/foo/3.0.0/foo.3.0.0.nupkg",
+			"/v3-flatcontainer/../secret",
+			"/v3-flatcontainer/../../etc/passwd",
+			"/v3-flatcontainer/" + url.PathEscape("..") + "/index.json",
+			"/v3-flatcontainer/./index.json",
+			"/v3-flatcontainer/foo/../foo/1.0.0/foo.1.0.0.nupkg",
+			"/v3-flatcontainer//index.json",
+			"/secret",
+		} {
+			if code, _ := get(path); code != http.StatusNotFound {
+				t.Errorf("GET %s = %d, want %d", path, code, http.StatusNotFound)
+			}
+		}
+	})
+	t.Run("method", func(t *testing.T) {
+		resp, err := http.Post(server.URL+"/v3/index.json", "application/json", nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		if resp.StatusCode != http.StatusMethodNotAllowed {
+			t.Errorf("POST = %d", resp.StatusCode)
+		}
+	})
+}
+
+func TestSmokeTestFeedOption(t *testing.T) {
+	if _, err := parseOptions(flag.NewFlagSet("test", flag.ContinueOnError), []string{"-smoke-test-feed"}); err == nil {
+		t.Error("-smoke-test-feed was accepted without -smoke-test")
+	}
+	testOptions(t, "-smoke-test", "-smoke-test-feed")
+}
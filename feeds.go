@@ -0,0 +1,119 @@
+package main
+
+import (
+	"archive/zip"
+	"context"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"io/fs"
+	"log/slog"
+	"path"
+	"path/filepath"
+	"slices"
+	"strings"
+)
+
+// originInTree marks packages that were found in the source tree.
+const originInTree = "in-tree"
+
+// inTreeFeed is a directory in the source tree containing .nupkg files, which
+// is used as an additional package source.
+type inTreeFeed struct {
+	dir      string // relative to the source directory, using forward slashes
+	packages []manifestPackage
+}
+
+// Find directories of .nupkg files in the source tree.
+func findInTreeFeeds(ctx context.Context, srcDir string) ([]inTreeFeed, error) {
+	var feeds []inTreeFeed
+	err := filepath.WalkDir(srcDir, func(name string, d fs.DirEntry, err error) error {
+		if err != nil || d.IsDir() || strings.ToLower(filepath.Ext(name)) != ".nupkg" {
+			return err
+		}
+		rel, err := filepath.Rel(srcDir, filepath.Dir(name))
+		if err != nil {
+			return err
+		}
+		rel = filepath.ToSlash(rel)
+		pkg, err := readNuspec(name)
+		if err != nil {
+			slog.WarnContext(ctx, "ignoring unreadable package in sources", "path", name, "error", err)
+			return nil
+		}
+		i := slices.IndexFunc(feeds, func(feed inTreeFeed) bool { return feed.dir == rel })
+		if i < 0 {
+			slog.InfoContext(ctx, "found package feed in sources", "dir", rel)
+			feeds = append(feeds, inTreeFeed{dir: rel})
+			i = len(feeds) - 1
+		}
+		feeds[i].packages = append(feeds[i].packages, pkg)
+		return nil
+	})
+	return feeds, err
+}
+
+// Read the ID and version of a package from the .nuspec in a .nupkg file.
+func readNuspec(nupkg string) (manifestPackage, error) {
+	buf, name, err := readNuspecFile(nupkg)
+	if err != nil {
+		return manifestPackage{}, err
+	}
+	var nuspec struct {
+		ID      string `xml:"metadata>id"`
+		Version string `xml:"metadata>version"`
+	}
+	if err := xml.Unmarshal(buf, &nuspec); err != nil {
+		return manifestPackage{}, fmt.Errorf("invalid %s: %w", name, err)
+	}
+	return manifestPackage{ID: nuspec.ID, Version: nuspec.Version}, nil
+}
+
+// Read the .nuspec file at the top level of a .nupkg file, returning its
+// contents and name.
+func readNuspecFile(nupkg string) ([]byte, string, error) {
+	reader, err := zip.OpenReader(nupkg)
+	if err != nil {
+		return nil, "", err
+	}
+	defer reader.Close()
+	for _, file := range reader.File {
+		if strings.Contains(file.Name, "/") || !strings.HasSuffix(strings.ToLower(file.Name), ".nuspec") {
+			continue
+		}
+		nuspecFile, err := file.Open()
+		if err != nil {
+			return nil, "", err
+		}
+		defer nuspecFile.Close()
+		buf, err := io.ReadAll(nuspecFile)
+		return buf, file.Name, err
+	}
+	return nil, "", fmt.Errorf("no .nuspec found")
+}
+
+// Arguments to dotnet restore to use the in-tree feeds as additional sources.
+func inTreeFeedArgs(env restoreEnv, feeds []inTreeFeed) []string {
+	if len(feeds) == 0 {
+		return nil
+	}
+	var dirs []string
+	for _, feed := range feeds {
+		dirs = append(dirs, path.Join(env.sourcesPath(), feed.dir))
+	}
+	// Semicolons would separate properties on the command line, so escape them.
+	return []string{"-p:RestoreAdditionalProjectSources=" + strings.Join(dirs, "%3B")}
+}
+
+// Mark restored packages that are available from the in-tree feeds.
+func markInTreePackages(packages []manifestPackage, feeds []inTreeFeed) {
+	for i, pkg := range packages {
+		for _, feed := range feeds {
+			if slices.ContainsFunc(feed.packages, func(p manifestPackage) bool {
+				return strings.EqualFold(p.ID, pkg.ID) && strings.EqualFold(p.Version, pkg.Version)
+			}) {
+				packages[i].Origin = originInTree
+			}
+		}
+	}
+}
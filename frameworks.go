@@ -0,0 +1,185 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"log/slog"
+	"os"
+	"path"
+	"path/filepath"
+	"slices"
+	"strings"
+)
+
+// Remove the restored packages that the lock files only reference for target
+// frameworks other than those given with -target-framework. Packages that are
+// not in any lock file (such as SDK packs) are kept.  It is an error for a
+// given framework not to be a target of any lock file, as that would remove
+// every package.
+func pruneTargetFrameworks(ctx context.Context, srcDir, outDir string, projects []manifestProject) error {
+	opts := optionsFrom(ctx)
+	requested := make(map[string]bool)
+	for _, tfm := range opts.targetFrameworks {
+		requested[normalizeFramework(tfm)] = false
+	}
+	wanted := make(map[manifestPackage]bool)
+	for _, project := range projects {
+		if project.LockFile == "" {
+			slog.WarnContext(ctx, "project has no lock file, can not filter by target framework", "project", project.Path)
+			return nil
+		}
+		buf, err := os.ReadFile(filepath.Join(srcDir, project.LockFile))
+		if err != nil {
+			return err
+		}
+		var lockFile struct {
+			Dependencies map[string]map[string]struct {
+				Resolved string `json:"resolved"`
+			} `json:"dependencies"`
+		}
+		if err := json.Unmarshal(buf, &lockFile); err != nil {
+			return fmt.Errorf("invalid lock file %s: %w", project.LockFile, err)
+		}
+		// Targets are either a framework, or a framework and runtime
+		// identifier separated by a slash.
+		for target, dependencies := range lockFile.Dependencies {
+			framework, _, _ := strings.Cut(target, "/")
+			framework = normalizeFramework(framework)
+			_, matches := requested[framework]
+			if matches {
+				requested[framework] = true
+			}
+			for id, dependency := range dependencies {
+				if dependency.Resolved == "" {
+					continue // project references
+				}
+				pkg := manifestPackage{ID: strings.ToLower(id), Version: strings.ToLower(dependency.Resolved)}
+				wanted[pkg] = wanted[pkg] || matches
+			}
+		}
+	}
+	var missing []string
+	for tfm, found := range requested {
+		if !found {
+			missing = append(missing, tfm)
+		}
+	}
+	if len(missing) > 0 {
+		slices.Sort(missing)
+		return fmt.Errorf("target frameworks not in any lock file: %s", strings.Join(missing, ", "))
+	}
+
+	packages, err := listPackages(outDir)
+	if err != nil {
+		return err
+	}
+	for _, pkg := range packages {
+		key := manifestPackage{ID: strings.ToLower(pkg.ID), Version: strings.ToLower(pkg.Version)}
+		if keep, found := wanted[key]; !found || keep {
+			continue
+		}
+		slog.InfoContext(ctx, "removing package only used by other target frameworks", "package", pkg.ID, "version", pkg.Version)
+		if err := os.RemoveAll(filepath.Join(outDir, pkg.ID, pkg.Version)); err != nil {
+			return fmt.Errorf("failed to remove %s %s: %w", pkg.ID, pkg.Version, err)
+		}
+	}
+	return nil
+}
+
+// Convert a target framework to its short, lower case name, so that the long
+// names older lock files use (such as ".NETCoreApp,Version=v8.0") compare
+// equal to the short ones (such as "net8.0").  Unknown names are only lower
+// cased.
+func normalizeFramework(tfm string) string {
+	tfm = strings.ToLower(strings.TrimSpace(tfm))
+	identifier, rest, found := strings.Cut(tfm, ",")
+	if !found {
+		return tfm
+	}
+	var version string
+	for _, part := range strings.Split(rest, ",") {
+		if value, ok := strings.CutPrefix(strings.TrimSpace(part), "version="); ok {
+			version = strings.TrimPrefix(value, "v")
+		}
+	}
+	if version == "" {
+		return tfm
+	}
+	switch identifier {
+	case ".netcoreapp":
+		if major, _, _ := strings.Cut(version, "."); len(major) > 1 || major >= "5" {
+			return "net" + version
+		}
+		return "netcoreapp" + version
+	case ".netstandard":
+		return "netstandard" + version
+	case ".netframework":
+		return "net" + strings.ReplaceAll(version, ".", "")
+	}
+	return tfm
+}
+
+// Restore argument making the SDK download the targeting packs of framework
+// references into the packages directory, instead of using the packs it was
+// installed with.
+const downloadTargetingPacksArg = "-p:NetCoreTargetingPackRoot=/nonexistent"
+
+// Report whether the restored projects reference shared frameworks but no
+// packages at all, going by their project.assets.json files.  Such projects
+// restore nothing with an SDK that includes the targeting packs, but fail to
+// build offline with one that does not.
+func frameworkReferencesOnly(ctx context.Context, srcDir string, projects []manifestProject) (bool, error) {
+	found := false
+	for _, project := range projects {
+		name := filepath.Join(srcDir, filepath.FromSlash(path.Dir(project.Path)), "obj", "project.assets.json")
+		buf, err := os.ReadFile(name)
+		if errors.Is(err, fs.ErrNotExist) {
+			slog.DebugContext(ctx, "no assets file, not checking framework references", "project", project.Path)
+			continue
+		} else if err != nil {
+			return false, err
+		}
+		var assets struct {
+			Libraries map[string]struct {
+				Type string `json:"type"`
+			} `json:"libraries"`
+			Project struct {
+				Frameworks map[string]struct {
+					FrameworkReferences map[string]json.RawMessage `json:"frameworkReferences"`
+				} `json:"frameworks"`
+			} `json:"project"`
+		}
+		if err := json.Unmarshal(buf, &assets); err != nil {
+			return false, fmt.Errorf("invalid assets file %s: %w", name, err)
+		}
+		for _, library := range assets.Libraries {
+			if library.Type == "package" {
+				return false, nil
+			}
+		}
+		for _, framework := range assets.Project.Frameworks {
+			found = found || len(framework.FrameworkReferences) > 0
+		}
+	}
+	return found, nil
+}
+
+// Restore the targets again with the targeting packs downloaded if they only
+// use framework references, so that the output is not empty.
+func restoreTargetingPacks(ctx context.Context, env restoreEnv, srcDir string, targets, restoreArgs []string, m *manifest) error {
+	only, err := frameworkReferencesOnly(ctx, srcDir, m.Projects)
+	if err != nil || !only {
+		return err
+	}
+	slog.InfoContext(ctx, "projects only use framework references, restoring their targeting packs")
+	args := append(slices.Clone(restoreArgs), downloadTargetingPacksArg)
+	for _, target := range targets {
+		if err := restore(ctx, env, target, args...); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,74 @@
+package main
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestNormalizeFramework(t *testing.T) {
+	tests := []struct {
+		tfm, want string
+	}{
+		{"net8.0", "net8.0"},
+		{"NET8.0", "net8.0"},
+		{".NETCoreApp,Version=v8.0", "net8.0"},
+		{".NETCoreApp,Version=v10.0", "net10.0"},
+		{".NETCoreApp,Version=v3.1", "netcoreapp3.1"},
+		{".NETStandard,Version=v2.0", "netstandard2.0"},
+		{".NETFramework,Version=v4.7.2", "net472"},
+		{".NETFramework,Version=v4.0,Profile=Client", "net40"},
+		{"net8.0-windows7.0", "net8.0-windows7.0"},
+	}
+	for _, tt := range tests {
+		if got := normalizeFramework(tt.tfm); got != tt.want {
+			t.Errorf("normalizeFramework(%q) = %q, want %q", tt.tfm, got, tt.want)
+		}
+	}
+}
+
+// Write a lock file for the given targets, each needing one package named
+// after the target, and restore those packages into outDir.
+func writeTestLockFile(t *testing.T, srcDir, outDir string, targets map[string]string) []manifestProject {
+	t.Helper()
+	var deps []string
+	for target, id := range targets {
+		deps = append(deps, `"`+target+`": {"`+id+`": {"type": "Direct", "resolved": "1.0.0"}}`)
+		writeFiles(t, outDir, id+"/1.0.0/"+id+".1.0.0.nupkg")
+	}
+	lockFile := `{"version": 1, "dependencies": {` + strings.Join(deps, ", ") + `}}`
+	if err := os.WriteFile(filepath.Join(srcDir, "packages.lock.json"), []byte(lockFile), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	return []manifestProject{{Path: "app.csproj", LockFile: "packages.lock.json"}}
+}
+
+func TestPruneTargetFrameworks(t *testing.T) {
+	targets := map[string]string{
+		".NETCoreApp,Version=v8.0":           "modern",
+		".NETCoreApp,Version=v8.0/linux-x64": "native",
+		"netstandard2.0":                     "legacy",
+	}
+	t.Run("long names", func(t *testing.T) {
+		srcDir, outDir := t.TempDir(), t.TempDir()
+		projects := writeTestLockFile(t, srcDir, outDir, targets)
+		ctx := withOptions(context.Background(), testOptions(t, "-target-framework", "net8.0"))
+		if err := pruneTargetFrameworks(ctx, srcDir, outDir, projects); err != nil {
+			t.Fatal(err)
+		}
+		assertExists(t, filepath.Join(outDir, "modern/1.0.0"), filepath.Join(outDir, "native/1.0.0"))
+		assertRemoved(t, filepath.Join(outDir, "legacy/1.0.0"))
+	})
+	t.Run("unknown framework", func(t *testing.T) {
+		srcDir, outDir := t.TempDir(), t.TempDir()
+		projects := writeTestLockFile(t, srcDir, outDir, targets)
+		ctx := withOptions(context.Background(), testOptions(t, "-target-framework", "net8.0", "-target-framework", "net9.0"))
+		err := pruneTargetFrameworks(ctx, srcDir, outDir, projects)
+		if err == nil || !strings.Contains(err.Error(), "net9.0") {
+			t.Errorf("pruneTargetFrameworks = %v, want an error naming net9.0", err)
+		}
+		assertExists(t, filepath.Join(outDir, "modern/1.0.0"), filepath.Join(outDir, "legacy/1.0.0"))
+	})
+}
@@ -0,0 +1,42 @@
+package main
+
+import (
+	"context"
+	"fmt"
+)
+
+// The default repository for SDK images; the tag is the dotnet version.
+const defaultImageRepository = "registry.suse.com/bci/dotnet-sdk"
+
+// The reference of the SDK image to use.
+func sdkImage(ctx context.Context) string {
+	opts := optionsFrom(ctx)
+	if opts.image != "" {
+		return opts.image
+	}
+	return defaultImageRepository + ":" + opts.tag
+}
+
+type pullPolicy string
+
+const (
+	pullPolicyAlways  = "always"
+	pullPolicyMissing = "missing"
+	pullPolicyNever   = "never"
+)
+
+func (p *pullPolicy) String() string {
+	if p == nil {
+		return "<nil>"
+	}
+	return string(*p)
+}
+
+func (p *pullPolicy) Set(value string) error {
+	switch value {
+	case pullPolicyAlways, pullPolicyMissing, pullPolicyNever:
+		*p = pullPolicy(value)
+		return nil
+	}
+	return fmt.Errorf("invalid pull policy %s", value)
+}
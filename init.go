@@ -0,0 +1,95 @@
+package main
+
+import (
+	"context"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"log/slog"
+	"strings"
+)
+
+// Inspect the package in the current directory and write a suggested
+// _service entry for this service.
+func runInit(ctx context.Context, w io.Writer) error {
+	opts := optionsFrom(ctx)
+	entry := serviceEntry{Name: serviceName, Mode: "manual"}
+	if located, err := locateArchive(ctx); err != nil {
+		slog.WarnContext(ctx, "could not find source archive; it will be detected when the service runs", "error", err)
+	} else {
+		opts = optionsFrom(located)
+		for _, archive := range opts.archives {
+			entry.Params = append(entry.Params, serviceParam{Name: "archive", Value: archive})
+		}
+	}
+
+	// Match the compression of the source archive, preferring zstd for cpio
+	// archives as the other OBS services do.
+	compression := compressionTypeGZip
+	if len(opts.archives) > 0 {
+		if archive := opts.archives[0]; strings.HasSuffix(archive, ".zst") || strings.HasSuffix(archive, ".obscpio") {
+			compression = compressionTypeZstd
+		}
+	}
+	entry.Params = append(entry.Params, serviceParam{Name: "compression", Value: compression})
+
+	var buf strings.Builder
+	fmt.Fprintf(&buf, "<services>\n  <service name=\"%s\" mode=\"%s\">\n", entry.Name, entry.Mode)
+	for _, param := range entry.Params {
+		fmt.Fprintf(&buf, "    <param name=\"%s\">", param.Name)
+		if err := xml.EscapeText(&buf, []byte(param.Value)); err != nil {
+			return err
+		}
+		fmt.Fprintf(&buf, "</param>\n")
+	}
+	fmt.Fprintf(&buf, "  </service>\n</services>\n")
+	_, err := io.WriteString(w, buf.String())
+	return err
+}
+
+// Write a suggested spec file fragment for using the output archive to
+// restore packages offline.
+func runSpecSnippet(ctx context.Context, w io.Writer) error {
+	opts := optionsFrom(ctx)
+	archiveName := opts.output + outputExtension(opts)
+	var unpack string
+	if opts.layout == outputLayoutNested {
+		unpack = `for archive in nuget-packages/*.tar.zst; do
+  package="${archive%.tar.zst}"
+  mkdir -p "$package"
+  tar -xf "$archive" -C "$package"
+  rm "$archive"
+done
+`
+	}
+	// The sources are not extracted here, so auto can not be resolved.
+	tag := opts.tag
+	if tag == tagAuto {
+		tag = defaultTag
+	}
+	extract := "tar -xf %{SOURCE1} -C nuget-packages"
+	switch opts.format {
+	case outputFormatCpio:
+		extract = "(cd nuget-packages && cpio -idm < %{SOURCE1})"
+	case outputFormatZip:
+		extract = "unzip -q %{SOURCE1} -d nuget-packages"
+	}
+	var locked string
+	if opts.lockedMode {
+		locked = " --locked-mode"
+	}
+	_, err := fmt.Fprintf(w, `# Adjust the source number as needed.
+Source1:        %[1]s
+BuildRequires:  dotnet-sdk-%[2]s
+
+%%prep
+%%autosetup -p1
+mkdir -p nuget-packages
+%[5]s
+%[3]s
+%%build
+dotnet restore --source "$PWD/nuget-packages"%[4]s
+dotnet build --no-restore --configuration Release
+`, archiveName, tag, unpack, locked, extract)
+	return err
+}
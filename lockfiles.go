@@ -0,0 +1,181 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"log/slog"
+	"maps"
+	"os"
+	"path/filepath"
+	"slices"
+)
+
+// Create lock files for the projects that do not have one (-generate-lockfiles)
+// by restoring them without locked mode, so that they can be restored in
+// locked mode afterwards.
+func generateLockFiles(ctx context.Context, env restoreEnv, projects []manifestProject, restoreArgs []string) error {
+	for _, project := range projects {
+		if project.LockFile != "" {
+			continue
+		}
+		slog.InfoContext(ctx, "generating lock file", "project", project.Path)
+		cmd := append(restoreCommand(env, project.Path, false, restoreArgs...), "--use-lock-file")
+		if err := env.exec(ctx, newLogWriter(ctx, "dotnet restore"), cmd...); err != nil {
+			return fmt.Errorf("failed to generate lock file for %s: %w", project.Path, err)
+		}
+	}
+	return nil
+}
+
+// Write the lock files generated with -generate-lockfiles to an archive next to
+// the output, so that they can be added to the sources (or sent upstream), and
+// record them in the manifest projects.
+func writeGeneratedLockFiles(ctx context.Context, srcDir, outBase string, projects []manifestProject) error {
+	opts := optionsFrom(ctx)
+	dir, err := os.MkdirTemp("", "obs-service-dotnet-packages-lockfiles-*")
+	if err != nil {
+		return err
+	}
+	defer os.RemoveAll(dir)
+	generated := 0
+	for i, project := range projects {
+		if project.LockFile != "" {
+			continue
+		}
+		lockFile, err := projectLockFile(srcDir, project.Path)
+		if err != nil {
+			return err
+		}
+		if lockFile == "" {
+			slog.WarnContext(ctx, "no lock file was generated", "project", project.Path)
+			continue
+		}
+		buf, err := os.ReadFile(filepath.Join(srcDir, lockFile))
+		if err != nil {
+			return err
+		}
+		target := filepath.Join(dir, filepath.FromSlash(lockFile))
+		if err := os.MkdirAll(filepath.Dir(target), 0o755); err != nil {
+			return err
+		}
+		if err := os.WriteFile(target, buf, 0o644); err != nil {
+			return err
+		}
+		projects[i].LockFile = lockFile
+		generated++
+	}
+	if generated == 0 {
+		return nil
+	}
+	slog.WarnContext(ctx, "generated lock files; add them to the sources for reproducible restores", "count", generated, "archive", outBase+"-lockfiles"+archiveExtension(opts.compression))
+	return createArchive(ctx, dir, outBase+"-lockfiles", outputFormatTar, opts.compression)
+}
+
+// manifestLockChange is a package whose resolved version differs from the lock
+// file, found by restoring with -force-evaluate after a lock file mismatch.
+type manifestLockChange struct {
+	LockFile        string `json:"lockFile"`
+	Framework       string `json:"framework"`
+	ID              string `json:"id"`
+	LockedVersion   string `json:"lockedVersion,omitempty"`   // empty if the package was added
+	ResolvedVersion string `json:"resolvedVersion,omitempty"` // empty if the package was removed
+}
+
+// Read the resolved package versions of a lock file, by target framework and
+// package ID.  A missing lock file has no packages.
+func readLockFile(name string) (map[string]map[string]string, error) {
+	buf, err := os.ReadFile(name)
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+	var lockFile struct {
+		Dependencies map[string]map[string]struct {
+			Resolved string `json:"resolved"`
+		} `json:"dependencies"`
+	}
+	if err := json.Unmarshal(buf, &lockFile); err != nil {
+		return nil, fmt.Errorf("invalid lock file %s: %w", name, err)
+	}
+	versions := make(map[string]map[string]string)
+	for framework, packages := range lockFile.Dependencies {
+		versions[framework] = make(map[string]string)
+		for id, pkg := range packages {
+			versions[framework][id] = pkg.Resolved
+		}
+	}
+	return versions, nil
+}
+
+// Restore a target whose lock files do not match its projects again with
+// --force-evaluate (and without locked mode), which updates the lock files, and
+// report the packages that changed so that the lock files can be refreshed
+// upstream.
+func restoreForceEvaluate(ctx context.Context, env restoreEnv, srcDir, target string, restoreArgs []string) ([]manifestLockChange, error) {
+	projects, err := targetProjects(srcDir, target)
+	if err != nil {
+		return nil, err
+	}
+	locked := make(map[string]map[string]map[string]string)
+	for _, project := range projects {
+		lockFile, err := projectLockFile(srcDir, project)
+		if err != nil || lockFile == "" {
+			continue
+		}
+		if locked[lockFile], err = readLockFile(filepath.Join(srcDir, lockFile)); err != nil {
+			return nil, err
+		}
+	}
+
+	slog.WarnContext(ctx, "lock files do not match, restoring again with --force-evaluate", "solution", target)
+	unlockedOpts := *optionsFrom(ctx)
+	unlockedOpts.lockedMode = false
+	args := append(slices.Clone(restoreArgs), "--force-evaluate")
+	if err := restore(withOptions(ctx, &unlockedOpts), env, target, args...); err != nil {
+		return nil, err
+	}
+
+	var changes []manifestLockChange
+	for _, lockFile := range slices.Sorted(maps.Keys(locked)) {
+		resolved, err := readLockFile(filepath.Join(srcDir, lockFile))
+		if err != nil {
+			return nil, err
+		}
+		before := locked[lockFile]
+		frameworks := slices.Collect(maps.Keys(before))
+		for framework := range resolved {
+			if _, ok := before[framework]; !ok {
+				frameworks = append(frameworks, framework)
+			}
+		}
+		slices.Sort(frameworks)
+		for _, framework := range frameworks {
+			ids := slices.Collect(maps.Keys(before[framework]))
+			for id := range resolved[framework] {
+				if _, ok := before[framework][id]; !ok {
+					ids = append(ids, id)
+				}
+			}
+			slices.Sort(ids)
+			for _, id := range ids {
+				change := manifestLockChange{
+					LockFile:        lockFile,
+					Framework:       framework,
+					ID:              id,
+					LockedVersion:   before[framework][id],
+					ResolvedVersion: resolved[framework][id],
+				}
+				if change.LockedVersion == change.ResolvedVersion {
+					continue
+				}
+				slog.WarnContext(ctx, "package differs from lock file", "lock file", lockFile, "framework", framework, "id", id, "locked", change.LockedVersion, "resolved", change.ResolvedVersion)
+				changes = append(changes, change)
+			}
+		}
+	}
+	return changes, nil
+}
@@ -5,30 +5,96 @@ package main
 
 import (
 	"context"
+	"errors"
+	"flag"
+	"fmt"
 	"log/slog"
 	"os"
+	"time"
 )
 
 func run(ctx context.Context) error {
-	if err := initializeOptions(); err != nil {
+	opts, err := parseOptions(flag.CommandLine, os.Args[1:])
+	if err != nil {
 		return err
 	}
+	ctx = withOptions(ctx, opts)
 
 	logOptions := &slog.HandlerOptions{
 		Level: slog.LevelInfo,
 	}
-	if options.verbose {
+	if opts.verbose {
 		logOptions.Level = slog.LevelDebug
 	}
 	// logger := slog.New(logging.NewJSONHandler(os.Stdout, logOptions))
-	logger := slog.New(slog.NewTextHandler(os.Stderr, logOptions))
+	secrets, shortSecrets := secretValues(opts)
+	logger := slog.New(newRedactingHandler(slog.NewTextHandler(os.Stderr, logOptions), secrets))
 	slog.SetDefault(logger)
+	if len(shortSecrets) > 0 {
+		slog.WarnContext(ctx, "secrets are too short to be redacted from logs", "count", len(shortSecrets), "minimum length", minSecretLength)
+	}
 
-	if err := locateArchive(ctx); err != nil {
+	command := flag.Arg(0)
+	switch command {
+	case "", "check", "prepare":
+	case "init":
+		return runInit(ctx, os.Stdout)
+	case "spec":
+		return runSpecSnippet(ctx, os.Stdout)
+	case "shell":
+		return runShell(ctx)
+	case "extract":
+		return runExtract(ctx, flag.Args()[1:])
+	case "pack":
+		return runPack(ctx, flag.Args()[1:])
+	case "package":
+		return runPackage(ctx, flag.Args()[1:])
+	case "list-tags":
+		return runListTags(ctx, os.Stdout)
+	case "cache":
+		return runCache(ctx, os.Stdout, flag.Args()[1:])
+	case "schema":
+		_, err := os.Stdout.Write(manifestSchema)
 		return err
+	default:
+		return fmt.Errorf("unknown command %q", command)
 	}
 
-	err := build(ctx)
+	if opts.srcDir == "" {
+		if ctx, err = locateArchive(ctx); err != nil {
+			return err
+		}
+		opts = optionsFrom(ctx)
+	}
+
+	if opts.statusAddr != "" {
+		status := &runStatus{Phase: "starting", Started: time.Now()}
+		serverCtx, stop := context.WithCancel(ctx)
+		defer stop()
+		if err := serveRunStatus(serverCtx, opts.statusAddr, status); err != nil {
+			return fmt.Errorf("failed to serve status: %w", err)
+		}
+		ctx = withRunStatus(ctx, status)
+	}
+
+	if opts.timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, opts.timeout)
+		defer cancel()
+	}
+	switch command {
+	case "check":
+		err = runCheck(ctx)
+	case "prepare":
+		err = runPrepare(ctx, flag.Args()[1:])
+	default:
+		err = build(ctx)
+	}
+	if err != nil && errors.Is(ctx.Err(), context.DeadlineExceeded) {
+		err = fmt.Errorf("timed out after %s: %w", opts.timeout, err)
+	}
+	finishRunStatus(ctx, err)
+	lingerRunStatus(ctx)
 	if err != nil {
 		return err
 	}
@@ -39,6 +105,10 @@ func run(ctx context.Context) error {
 func main() {
 	if err := run(context.Background()); err != nil {
 		slog.Error("package download failed", "error", err)
+		// Let scheduled checks tell drift apart from failing to check.
+		if errors.Is(err, ErrDrift) {
+			os.Exit(2)
+		}
 		os.Exit(1)
 	}
 }
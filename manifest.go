@@ -0,0 +1,346 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha512"
+	_ "embed"
+	"encoding/base64"
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"maps"
+	"os"
+	"path/filepath"
+	"runtime"
+	"slices"
+	"strings"
+	"sync"
+)
+
+// emptyMarker is the name of the file placed in the output archive when there
+// are no packages, so that consumers can tell it apart from a broken archive.
+const emptyMarker = ".dotnet-packages-empty"
+
+// The version of the manifest format, as described by manifest.schema.json.
+// Fields may be added without changing the version; it is incremented when
+// fields are removed or their meaning changes.
+const manifestSchemaVersion = 1
+
+//go:embed manifest.schema.json
+var manifestSchema []byte
+
+// manifest describes the contents of an output archive.
+type manifest struct {
+	SchemaVersion      int                  `json:"schemaVersion"`
+	Archive            string               `json:"archive"`                      // Base name of the source archive
+	AdditionalArchives []string             `json:"additionalArchives,omitempty"` // Base names of other source archives
+	Empty              bool                 `json:"empty,omitempty"`              // Set if there were no .NET projects
+	Projects           []manifestProject    `json:"projects,omitempty"`
+	Packages           []manifestPackage    `json:"packages"`
+	Tools              []manifestTool       `json:"tools,omitempty"`       // Tools from dotnet-tools.json files
+	Findings           []manifestFinding    `json:"findings,omitempty"`    // Package contents that may need review
+	LockChanges        []manifestLockChange `json:"lockChanges,omitempty"` // Packages differing from the lock files, with -force-evaluate
+	Excluded           []manifestExclusion  `json:"excluded,omitempty"`    // Packages provided by the distribution, with -system-packages
+	Fetches            []proxyFetch         `json:"fetches,omitempty"`     // Downloads observed by the proxy
+}
+
+type manifestProject struct {
+	Path     string `json:"path"`
+	LockFile string `json:"lockFile,omitempty"` // Path to the lock file, if any
+}
+
+type manifestPackage struct {
+	ID      string `json:"id"`
+	Version string `json:"version"`
+	SHA512  string `json:"sha512"`           // base64, as used in .nupkg.sha512 files
+	Origin  string `json:"origin,omitempty"` // originInTree if found in the sources
+}
+
+// Read the packages in a (cleaned up) package directory, which is laid out as
+// <id>/<version>/..., including their digests.
+func readPackages(dir string) ([]manifestPackage, error) {
+	packages, err := listPackages(dir)
+	if err != nil {
+		return nil, err
+	}
+	if err := hashPackages(dir, packages); err != nil {
+		return nil, err
+	}
+	return packages, nil
+}
+
+// List the packages in a directory laid out as <id>/<version>/...
+func listPackages(dir string) ([]manifestPackage, error) {
+	ids, err := os.ReadDir(dir)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list packages: %w", err)
+	}
+	packages := []manifestPackage{}
+	for _, id := range ids {
+		if !id.IsDir() {
+			continue
+		}
+		versions, err := os.ReadDir(filepath.Join(dir, id.Name()))
+		if err != nil {
+			return nil, fmt.Errorf("failed to list versions of %s: %w", id.Name(), err)
+		}
+		for _, version := range versions {
+			if version.IsDir() {
+				packages = append(packages, manifestPackage{ID: id.Name(), Version: version.Name()})
+			}
+		}
+	}
+	slices.SortFunc(packages, func(a, b manifestPackage) int {
+		if c := strings.Compare(a.ID, b.ID); c != 0 {
+			return c
+		}
+		return strings.Compare(a.Version, b.Version)
+	})
+	return packages, nil
+}
+
+// Compute the SHA-512 digests of the .nupkg files of the given packages,
+// hashing multiple packages concurrently.
+func hashPackages(dir string, packages []manifestPackage) error {
+	var wg sync.WaitGroup
+	var mu sync.Mutex
+	var errs []error
+	indices := make(chan int)
+	for range runtime.NumCPU() {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := range indices {
+				digest, err := hashPackage(filepath.Join(dir, packages[i].ID, packages[i].Version))
+				if err != nil {
+					mu.Lock()
+					errs = append(errs, fmt.Errorf("failed to hash %s %s: %w", packages[i].ID, packages[i].Version, err))
+					mu.Unlock()
+					continue
+				}
+				packages[i].SHA512 = digest
+			}
+		}()
+	}
+	for i := range packages {
+		indices <- i
+	}
+	close(indices)
+	wg.Wait()
+	return errors.Join(errs...)
+}
+
+// Compute the base64 SHA-512 digest of the .nupkg file in a package directory.
+func hashPackage(packageDir string) (string, error) {
+	names, err := filepath.Glob(filepath.Join(packageDir, "*.nupkg"))
+	if err != nil {
+		return "", err
+	}
+	if len(names) != 1 {
+		return "", fmt.Errorf("expected one .nupkg file, found %d", len(names))
+	}
+	file, err := os.Open(names[0])
+	if err != nil {
+		return "", err
+	}
+	defer file.Close()
+	hasher := sha512.New()
+	if _, err := io.Copy(hasher, file); err != nil {
+		return "", err
+	}
+	return base64.StdEncoding.EncodeToString(hasher.Sum(nil)), nil
+}
+
+type reportFormat string
+
+const (
+	reportFormatJSON     = "json"
+	reportFormatCSV      = "csv"
+	reportFormatMarkdown = "markdown"
+)
+
+func (f *reportFormat) String() string {
+	if f == nil {
+		return "<nil>"
+	}
+	return string(*f)
+}
+
+func (f *reportFormat) Set(value string) error {
+	switch value {
+	case reportFormatJSON, reportFormatCSV, reportFormatMarkdown:
+		*f = reportFormat(value)
+		return nil
+	}
+	return fmt.Errorf("invalid report format %s", value)
+}
+
+// Write the manifest next to the output archive.
+func writeManifest(m *manifest, outputBase string, format reportFormat) error {
+	var buf bytes.Buffer
+	var extension string
+	switch format {
+	case reportFormatJSON:
+		extension = ".json"
+		encoder := json.NewEncoder(&buf)
+		encoder.SetIndent("", "  ")
+		if err := encoder.Encode(m); err != nil {
+			return err
+		}
+	case reportFormatCSV:
+		extension = ".csv"
+		writer := csv.NewWriter(&buf)
+		_ = writer.Write([]string{"id", "version", "sha512", "origin"})
+		for _, pkg := range m.Packages {
+			_ = writer.Write([]string{pkg.ID, pkg.Version, pkg.SHA512, pkg.Origin})
+		}
+		writer.Flush()
+		if err := writer.Error(); err != nil {
+			return err
+		}
+	case reportFormatMarkdown:
+		extension = ".md"
+		fmt.Fprintf(&buf, "# Packages for %s\n\n", m.Archive)
+		if m.Empty {
+			fmt.Fprintf(&buf, "No .NET projects were found.\n")
+			break
+		}
+		fmt.Fprintf(&buf, "| Package | Version |\n")
+		fmt.Fprintf(&buf, "| ------- | ------- |\n")
+		for _, pkg := range m.Packages {
+			fmt.Fprintf(&buf, "| %s | %s |\n", pkg.ID, pkg.Version)
+		}
+		if len(m.Findings) > 0 {
+			fmt.Fprintf(&buf, "\n## Contents to review\n\n")
+			fmt.Fprintf(&buf, "| Package | Version | Path | Kind |\n")
+			fmt.Fprintf(&buf, "| ------- | ------- | ---- | ---- |\n")
+			for _, finding := range m.Findings {
+				fmt.Fprintf(&buf, "| %s | %s | %s | %s |\n", finding.ID, finding.Version, finding.Path, finding.Kind)
+			}
+		}
+		if len(m.Excluded) > 0 {
+			fmt.Fprintf(&buf, "\n## Provided by the distribution\n\n")
+			fmt.Fprintf(&buf, "| Package | Version | Provided by |\n")
+			fmt.Fprintf(&buf, "| ------- | ------- | ----------- |\n")
+			for _, exclusion := range m.Excluded {
+				fmt.Fprintf(&buf, "| %s | %s | %s |\n", exclusion.ID, exclusion.Version, exclusion.ProvidedBy)
+			}
+		}
+		if len(m.LockChanges) > 0 {
+			fmt.Fprintf(&buf, "\n## Lock file changes\n\n")
+			fmt.Fprintf(&buf, "| Lock file | Framework | Package | Locked | Resolved |\n")
+			fmt.Fprintf(&buf, "| --------- | --------- | ------- | ------ | -------- |\n")
+			for _, change := range m.LockChanges {
+				fmt.Fprintf(&buf, "| %s | %s | %s | %s | %s |\n", change.LockFile, change.Framework, change.ID, change.LockedVersion, change.ResolvedVersion)
+			}
+		}
+	default:
+		return fmt.Errorf("unsupported report format %s", format)
+	}
+	return os.WriteFile(outputBase+".manifest"+extension, buf.Bytes(), 0o644)
+}
+
+// Write a spec file fragment declaring the packages in the output as bundled,
+// as the packaging guidelines require.
+func writeBundledProvides(m *manifest, outputBase string) error {
+	var buf bytes.Buffer
+	fmt.Fprintf(&buf, "# NuGet packages bundled for %s\n", m.Archive)
+	buf.WriteString(bundledProvides(m))
+	return os.WriteFile(outputBase+".provides", buf.Bytes(), 0o644)
+}
+
+// The Provides lines declaring the packages in the output as bundled.
+func bundledProvides(m *manifest) string {
+	var buf strings.Builder
+	for _, pkg := range m.Packages {
+		fmt.Fprintf(&buf, "Provides:       bundled(nuget(%s)) = %s\n", pkg.ID, rpmVersion(pkg.Version))
+	}
+	return buf.String()
+}
+
+// Convert a NuGet version to one RPM accepts and sorts the same way: build
+// metadata is dropped, the prerelease starts with a tilde so that it sorts
+// before the release, and further hyphens become underscores, as RPM versions
+// can not contain hyphens.
+func rpmVersion(version string) string {
+	version, _, _ = strings.Cut(version, "+")
+	release, prerelease, found := strings.Cut(version, "-")
+	if !found {
+		return release
+	}
+	return release + "~" + strings.ReplaceAll(prerelease, "-", "_")
+}
+
+// Report packages that have been restored in multiple versions, failing if
+// only a single version of each package is allowed.
+func checkDuplicateVersions(ctx context.Context, packages []manifestPackage) error {
+	opts := optionsFrom(ctx)
+	versions := make(map[string][]string)
+	for _, pkg := range packages {
+		versions[pkg.ID] = append(versions[pkg.ID], pkg.Version)
+	}
+	var duplicates []string
+	for _, id := range slices.Sorted(maps.Keys(versions)) {
+		if len(versions[id]) > 1 {
+			slog.WarnContext(ctx, "package restored in multiple versions", "package", id, "versions", versions[id])
+			duplicates = append(duplicates, id)
+		}
+	}
+	if len(duplicates) > 0 && opts.singleVersion {
+		return fmt.Errorf("packages restored in multiple versions: %s", strings.Join(duplicates, ", "))
+	}
+	return nil
+}
+
+// Verify that the .nupkg file in a package directory matches the digest in its
+// .nupkg.sha512 file.
+func verifyPackage(packageDir string) error {
+	names, err := filepath.Glob(filepath.Join(packageDir, "*.nupkg.sha512"))
+	if err != nil {
+		return err
+	}
+	if len(names) != 1 {
+		return fmt.Errorf("expected one .nupkg.sha512 file, found %d", len(names))
+	}
+	expected, err := os.ReadFile(names[0])
+	if err != nil {
+		return err
+	}
+	actual, err := hashPackage(packageDir)
+	if err != nil {
+		return err
+	}
+	if strings.TrimSpace(string(expected)) != actual {
+		return fmt.Errorf("digest mismatch: expected %s, got %s", strings.TrimSpace(string(expected)), actual)
+	}
+	return nil
+}
+
+// Copy packages from a directory laid out as <id>/<version>/... into outDir,
+// after verifying their digests. Packages already in outDir are skipped.
+func mergePackages(ctx context.Context, extraDir, outDir string) error {
+	packages, err := listPackages(extraDir)
+	if err != nil {
+		return err
+	}
+	for _, pkg := range packages {
+		source := filepath.Join(extraDir, pkg.ID, pkg.Version)
+		target := filepath.Join(outDir, strings.ToLower(pkg.ID), strings.ToLower(pkg.Version))
+		if _, err := os.Stat(target); err == nil {
+			slog.DebugContext(ctx, "skipping extra package already restored", "package", pkg.ID, "version", pkg.Version)
+			continue
+		}
+		if err := verifyPackage(source); err != nil {
+			return fmt.Errorf("failed to verify extra package %s %s: %w", pkg.ID, pkg.Version, err)
+		}
+		slog.InfoContext(ctx, "adding extra package", "package", pkg.ID, "version", pkg.Version)
+		if err := os.CopyFS(target, os.DirFS(source)); err != nil {
+			return fmt.Errorf("failed to copy extra package %s %s: %w", pkg.ID, pkg.Version, err)
+		}
+	}
+	return nil
+}
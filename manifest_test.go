@@ -0,0 +1,67 @@
+package main
+
+import (
+	"crypto/rand"
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestRPMVersion(t *testing.T) {
+	tests := []struct {
+		version, want string
+	}{
+		{"1.2.3", "1.2.3"},
+		{"1.2.3-beta.1", "1.2.3~beta.1"},
+		{"1.2.3-rc-final", "1.2.3~rc_final"},
+		{"1.2.3+abcdef", "1.2.3"},
+		{"1.2.3-preview.4+sha.abc-def", "1.2.3~preview.4"},
+	}
+	for _, tt := range tests {
+		if got := rpmVersion(tt.version); got != tt.want {
+			t.Errorf("rpmVersion(%q) = %q, want %q", tt.version, got, tt.want)
+		}
+	}
+}
+
+func TestBundledProvides(t *testing.T) {
+	m := &manifest{Packages: []manifestPackage{
+		{ID: "Foo", Version: "1.0.0"},
+		{ID: "Bar", Version: "2.0.0-beta+build.5"},
+	}}
+	want := "Provides:       bundled(nuget(Foo)) = 1.0.0\n" +
+		"Provides:       bundled(nuget(Bar)) = 2.0.0~beta\n"
+	if got := bundledProvides(m); got != want {
+		t.Errorf("bundledProvides = %q, want %q", got, want)
+	}
+}
+
+// Hash a directory of packages of realistic sizes, to compare hashing them
+// one after another with hashing them in parallel.
+func BenchmarkHashPackages(b *testing.B) {
+	dir := b.TempDir()
+	var packages []manifestPackage
+	var size int64
+	for i := range 64 {
+		pkg := manifestPackage{ID: fmt.Sprintf("package%d", i), Version: "1.0.0"}
+		name := filepath.Join(dir, pkg.ID, pkg.Version, pkg.ID+".1.0.0.nupkg")
+		if err := os.MkdirAll(filepath.Dir(name), 0o755); err != nil {
+			b.Fatal(err)
+		}
+		buf := make([]byte, (i%8+1)<<17) // 128 KiB to 1 MiB
+		_, _ = rand.Read(buf)
+		if err := os.WriteFile(name, buf, 0o644); err != nil {
+			b.Fatal(err)
+		}
+		packages = append(packages, pkg)
+		size += int64(len(buf))
+	}
+	b.SetBytes(size)
+	b.ResetTimer()
+	for range b.N {
+		if err := hashPackages(dir, packages); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
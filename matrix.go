@@ -0,0 +1,278 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+)
+
+type matrixOutput string
+
+const (
+	matrixOutputMerged = "merged" // One output with the packages of all combinations
+	matrixOutputSplit  = "split"  // One output per combination
+)
+
+func (o *matrixOutput) String() string {
+	if o == nil {
+		return "<nil>"
+	}
+	return string(*o)
+}
+
+func (o *matrixOutput) Set(value string) error {
+	switch value {
+	case matrixOutputMerged, matrixOutputSplit:
+		*o = matrixOutput(value)
+		return nil
+	}
+	return fmt.Errorf("invalid matrix output %s", value)
+}
+
+// matrixCombination is one entry of the restore matrix.
+type matrixCombination struct {
+	tag string
+	rid string // empty to restore without a runtime identifier
+}
+
+// The name of the combination, used as the suffix of its output.
+func (c matrixCombination) String() string {
+	if c.rid == "" {
+		return c.tag
+	}
+	return c.tag + "-" + c.rid
+}
+
+// The combinations of -matrix-tag and -matrix-rid to restore; -tag is used if
+// no tags are given.
+func matrixCombinations(opts *options) []matrixCombination {
+	tags := opts.matrixTags
+	if len(tags) == 0 {
+		tags = stringList{opts.tag}
+	}
+	rids := opts.matrixRIDs
+	if len(rids) == 0 {
+		rids = stringList{""}
+	}
+	var combinations []matrixCombination
+	for _, tag := range tags {
+		for _, rid := range rids {
+			combinations = append(combinations, matrixCombination{tag: tag, rid: rid})
+		}
+	}
+	return combinations
+}
+
+// matrixReport lists the packages that were not restored by every combination
+// of the matrix.
+type matrixReport struct {
+	Combinations []string           `json:"combinations"`
+	Differences  []matrixDifference `json:"differences"`
+}
+
+type matrixDifference struct {
+	ID           string   `json:"id"`
+	Version      string   `json:"version"`
+	Combinations []string `json:"combinations"` // The combinations that restored the package
+}
+
+// Restore the targets once for every combination of the matrix, and write a
+// report of the differences next to the output. With -matrix-output=merged,
+// the packages of all combinations are put into outDir and recorded in the
+// manifest; with -matrix-output=split, every combination gets its own output,
+// and true is returned as nothing is left to do.
+func restoreMatrix(ctx context.Context, srcDir, outDir, outBase string, targets []string, m *manifest) (bool, error) {
+	opts := optionsFrom(ctx)
+	report := matrixReport{Differences: []matrixDifference{}}
+	restoredBy := make(map[manifestPackage][]string)
+	var packages []manifestPackage
+	for _, combination := range matrixCombinations(opts) {
+		name := combination.String()
+		slog.InfoContext(ctx, "restoring matrix combination", "tag", combination.tag, "rid", combination.rid)
+		combinationOpts := *opts
+		combinationOpts.tag = combination.tag
+		if combination.rid != "" {
+			combinationOpts.rids = stringList{combination.rid}
+		}
+		combinationCtx := withOptions(ctx, &combinationOpts)
+
+		dir, err := os.MkdirTemp("", "obs-service-dotnet-packages-out-*")
+		if err != nil {
+			return false, err
+		}
+		defer os.RemoveAll(dir)
+		cm := &manifest{
+			SchemaVersion:      m.SchemaVersion,
+			Archive:            m.Archive,
+			AdditionalArchives: m.AdditionalArchives,
+			Projects:           m.Projects,
+		}
+		if err := restorePackages(combinationCtx, srcDir, dir, targets, cm); err != nil {
+			return false, fmt.Errorf("matrix combination %s: %w", name, err)
+		}
+
+		report.Combinations = append(report.Combinations, name)
+		for _, pkg := range cm.Packages {
+			key := manifestPackage{ID: strings.ToLower(pkg.ID), Version: strings.ToLower(pkg.Version)}
+			if len(restoredBy[key]) == 0 {
+				packages = append(packages, pkg)
+				for _, finding := range cm.Findings {
+					if finding.ID == pkg.ID && finding.Version == pkg.Version {
+						m.Findings = append(m.Findings, finding)
+					}
+				}
+			}
+			restoredBy[key] = append(restoredBy[key], name)
+		}
+		m.Fetches = append(m.Fetches, cm.Fetches...)
+		m.LockChanges = append(m.LockChanges, cm.LockChanges...)
+		for _, exclusion := range cm.Excluded {
+			if !slices.Contains(m.Excluded, exclusion) {
+				m.Excluded = append(m.Excluded, exclusion)
+			}
+		}
+		m.Tools = mergeToolVersions(m.Tools, cm.Tools)
+
+		if opts.matrixOutput == matrixOutputSplit {
+			combinationBase := outBase + "-" + name
+			slog.InfoContext(ctx, "creating output archive", "base name", combinationBase)
+			if err := writeOutput(combinationCtx, dir, combinationBase); err != nil {
+				return false, err
+			}
+			if opts.manifest {
+				if err := writeManifest(cm, combinationBase, opts.reportFormat); err != nil {
+					return false, fmt.Errorf("error writing manifest: %w", err)
+				}
+			}
+		} else if err := mergeRestored(dir, outDir); err != nil {
+			return false, fmt.Errorf("matrix combination %s: %w", name, err)
+		}
+	}
+
+	for _, pkg := range packages {
+		key := manifestPackage{ID: strings.ToLower(pkg.ID), Version: strings.ToLower(pkg.Version)}
+		if len(restoredBy[key]) < len(report.Combinations) {
+			report.Differences = append(report.Differences, matrixDifference{
+				ID:           pkg.ID,
+				Version:      pkg.Version,
+				Combinations: restoredBy[key],
+			})
+		}
+	}
+	slices.SortFunc(report.Differences, func(a, b matrixDifference) int {
+		if c := strings.Compare(a.ID, b.ID); c != 0 {
+			return c
+		}
+		return strings.Compare(a.Version, b.Version)
+	})
+	for _, difference := range report.Differences {
+		slog.InfoContext(ctx, "package not restored by all matrix combinations",
+			"package", difference.ID, "version", difference.Version, "combinations", difference.Combinations)
+	}
+	buf, err := json.MarshalIndent(report, "", "  ")
+	if err != nil {
+		return false, err
+	}
+	if err := os.WriteFile(outBase+".matrix.json", append(buf, '\n'), 0o644); err != nil {
+		return false, fmt.Errorf("error writing matrix report: %w", err)
+	}
+
+	if opts.matrixOutput == matrixOutputSplit {
+		return true, nil
+	}
+	slices.SortFunc(packages, func(a, b manifestPackage) int {
+		if c := strings.Compare(a.ID, b.ID); c != 0 {
+			return c
+		}
+		return strings.Compare(a.Version, b.Version)
+	})
+	m.Packages = packages
+	return false, checkDuplicateVersions(ctx, m.Packages)
+}
+
+// Move the packages restored for one matrix combination into outDir, keeping
+// the ones already there.
+func mergeRestored(dir, outDir string) error {
+	packages, err := listPackages(dir)
+	if err != nil {
+		return err
+	}
+	for _, pkg := range packages {
+		target := filepath.Join(outDir, pkg.ID, pkg.Version)
+		if _, err := os.Stat(target); err == nil {
+			continue
+		}
+		if err := os.MkdirAll(filepath.Dir(target), 0o755); err != nil {
+			return err
+		}
+		if err := os.Rename(filepath.Join(dir, pkg.ID, pkg.Version), target); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Restore each group of targets needing a different SDK version (see
+// [resolveTag]) in its own container, merging the packages into outDir and
+// recording them in the manifest.
+func restoreSDKGroups(ctx context.Context, srcDir, outDir string, m *manifest) error {
+	opts := optionsFrom(ctx)
+	seen := make(map[manifestPackage]bool)
+	var packages []manifestPackage
+	for _, group := range opts.sdkGroups {
+		slog.InfoContext(ctx, "restoring with SDK", "tag", group.tag, "targets", group.targets)
+		groupOpts := *opts
+		groupOpts.tag = group.tag
+		groupCtx := withOptions(ctx, &groupOpts)
+
+		dir, err := os.MkdirTemp("", "obs-service-dotnet-packages-out-*")
+		if err != nil {
+			return err
+		}
+		defer os.RemoveAll(dir)
+		gm := &manifest{
+			SchemaVersion: m.SchemaVersion,
+			Archive:       m.Archive,
+			Projects:      m.Projects,
+		}
+		if err := restorePackages(groupCtx, srcDir, dir, group.targets, gm); err != nil {
+			return fmt.Errorf("SDK %s: %w", group.tag, err)
+		}
+		for _, pkg := range gm.Packages {
+			key := manifestPackage{ID: strings.ToLower(pkg.ID), Version: strings.ToLower(pkg.Version)}
+			if !seen[key] {
+				seen[key] = true
+				packages = append(packages, pkg)
+			}
+		}
+		for _, finding := range gm.Findings {
+			if !slices.Contains(m.Findings, finding) {
+				m.Findings = append(m.Findings, finding)
+			}
+		}
+		for _, exclusion := range gm.Excluded {
+			if !slices.Contains(m.Excluded, exclusion) {
+				m.Excluded = append(m.Excluded, exclusion)
+			}
+		}
+		m.Fetches = append(m.Fetches, gm.Fetches...)
+		m.LockChanges = append(m.LockChanges, gm.LockChanges...)
+		m.Tools = mergeToolVersions(m.Tools, gm.Tools)
+		if err := mergeRestored(dir, outDir); err != nil {
+			return fmt.Errorf("SDK %s: %w", group.tag, err)
+		}
+	}
+	slices.SortFunc(packages, func(a, b manifestPackage) int {
+		if c := strings.Compare(a.ID, b.ID); c != 0 {
+			return c
+		}
+		return strings.Compare(a.Version, b.Version)
+	})
+	m.Packages = packages
+	return checkDuplicateVersions(ctx, m.Packages)
+}
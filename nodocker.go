@@ -0,0 +1,31 @@
+//go:build nodocker
+
+package main
+
+import (
+	"context"
+	"errors"
+)
+
+// Whether this build can restore in containers.
+const haveContainers = false
+
+// errNoContainers is returned for everything needing a container runtime in
+// builds with the nodocker tag, which only restore on the host.
+var errNoContainers = errors.New("built without container support; use -no-container")
+
+func newContainerRestoreEnv(context.Context, string, string, *manifest) (restoreEnv, error) {
+	return nil, errNoContainers
+}
+
+func newAttachedRestoreEnv(context.Context, string, string) (restoreEnv, error) {
+	return nil, errNoContainers
+}
+
+func smokeTest(context.Context, string, string, []string) error {
+	return errNoContainers
+}
+
+func runShell(context.Context) error {
+	return errNoContainers
+}
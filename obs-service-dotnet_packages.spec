@@ -28,13 +28,14 @@ BuildRequires:  golang-packaging
 # Needed for go -mod=vendor
 BuildRequires:  golang(API) >= 1.24
 BuildRequires:  zstd
-Requires:       docker
+Requires:       (docker or podman)
+Recommends:     gpg2
 
 %description
 An OBS Source Service that will download and vendor dependencies of dotnet
 applications from NuGet into an archive.
 
-This is done by running `dotnet restore` inside a docker container.
+This is done by running `dotnet restore` inside a docker or podman container.
 
 Note that because NuGet provides binaries, not sources, the outputs of this
 source service is not appropriate for packages intended to be submitted into
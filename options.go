@@ -2,50 +2,466 @@ package main
 
 import (
 	"context"
+	"errors"
 	"flag"
 	"fmt"
+	"io/fs"
 	"log/slog"
+	"os"
 	"path/filepath"
+	"slices"
+	"strconv"
 	"strings"
+	"time"
+
+	"github.com/mook/obs-service-dotnet_packages/version"
 )
 
-var options struct {
-	verbose     bool
-	tag         string
-	archive     string
-	compression compressionType
-	output      string
-	outDir      string
+// options are the settings for a run. They are passed through the context; see
+// [withOptions] and [optionsFrom]. Values derived during the run (such as the
+// detected SDK version) go into a copy in a derived context, never into the
+// options another context holds.
+type options struct {
+	verbose            bool
+	tag                string
+	archives           stringList
+	compression        compressionType
+	cleanup            cleanupProfile
+	cleanupKeep        stringList // file name patterns kept in each package besides the profile's
+	output             string
+	outDir             string
+	allowEmpty         bool
+	manifest           bool
+	packTooling        bool
+	requireLockFiles   bool
+	lockedMode         bool
+	forceEvaluate      bool
+	singleVersion      bool
+	reportFormat       reportFormat
+	fromService        string
+	smokeTest          bool
+	noNetwork          bool
+	upstream           string
+	containerUser      string
+	env                envList
+	stripVCS           bool
+	disableGitTasks    bool
+	archiveSelect      archiveSelection
+	hashSuffix         bool
+	noClobber          bool
+	force              bool
+	runtime            containerRuntime
+	noContainer        bool
+	windowsPaths       windowsPathMode
+	extraPackagesDir   string
+	image              string
+	pull               pullPolicy
+	recordDir          string
+	replayDir          string
+	forbidBinaries     bool
+	solutions          stringList
+	pullTimeout        time.Duration
+	containerID        string
+	layout             outputLayout
+	format             outputFormat
+	srcDir             string
+	hermetic           bool
+	sourceDateEpoch    string // SOURCE_DATE_EPOCH, from the environment or derived from the sources
+	matrixTags         stringList
+	matrixRIDs         stringList
+	matrixOutput       matrixOutput
+	rids               stringList // runtime identifiers to restore for
+	stripComponents    stripComponents
+	strictPaths        bool
+	requirePinned      bool
+	maxExtractSize     byteSize
+	maxExtractFileSize byteSize
+	maxExtractFiles    int
+	vendors            vendorList
+	reportTimings      int
+	showRestoreOutput  bool
+	restoreLog         bool
+	targetFrameworks   stringList
+	forbidContent      contentKindList
+	retries            int
+	zstdLong           bool
+	timeout            time.Duration
+	solutionTimeout    time.Duration
+	warmStart          bool
+	cacheDir           string
+	generateLockFiles  bool
+	properties         envList // MSBuild properties (NAME=VALUE) to restore with
+	redact             stringList
+	downloadList       bool
+	pathScopes         stringList
+	workloads          bool
+	statusAddr         string
+	statusLinger       time.Duration
+	systemPackages     string
+	bundledProvides    bool
+	updateSpecProvides bool
+	smokeTestFeed      bool
+	sdkGroups          []sdkGroup // with -tag auto, if the targets need different SDK versions
+}
+
+// stringList is a flag that can be repeated to collect values.
+type stringList []string
+
+func (l *stringList) String() string {
+	if l == nil {
+		return "<nil>"
+	}
+	return strings.Join(*l, ",")
+}
+
+func (l *stringList) Set(value string) error {
+	*l = append(*l, value)
+	return nil
+}
+
+// envList is a flag that can be repeated to collect NAME=VALUE pairs.
+type envList []string
+
+func (l *envList) String() string {
+	if l == nil {
+		return "<nil>"
+	}
+	return strings.Join(*l, ",")
+}
+
+func (l *envList) Set(value string) error {
+	if name, _, ok := strings.Cut(value, "="); !ok || name == "" {
+		return fmt.Errorf("invalid value %q, expected NAME=VALUE", value)
+	}
+	*l = append(*l, value)
+	return nil
 }
 
-func initializeOptions() error {
-	options.compression = compressionTypeGZip
-	flag.BoolVar(&options.verbose, "verbose", false, "Enable extra logging")
-	flag.StringVar(&options.tag, "tag", "9.0", "dotnet version to run")
-	flag.StringVar(&options.archive, "archive", "", "Source code archive to scan for references")
-	flag.Var(&options.compression, "compression", "Compression to use")
-	flag.StringVar(&options.output, "output", "packages", "Base name of output archive")
-	flag.StringVar(&options.outDir, "outdir", "", "Output directory")
-	flag.Parse()
+// Parse the command line arguments (without the program name) into options,
+// registering the flags on the given flag set.
+func parseOptions(flags *flag.FlagSet, args []string) (*options, error) {
+	opts := &options{}
+	opts.compression = compressionTypeGZip
+	opts.cleanup = cleanupProfileCache
+	opts.reportFormat = reportFormatJSON
+	opts.archiveSelect = archiveSelectionNewest
+	opts.runtime = containerRuntimeAuto
+	opts.windowsPaths = windowsPathModeWarn
+	opts.pull = pullPolicyMissing
+	opts.matrixOutput = matrixOutputMerged
+	opts.maxExtractSize = 32 << 30
+	opts.maxExtractFileSize = 4 << 30
+	opts.layout = outputLayoutFlat
+	opts.format = outputFormatTar
+	flags.BoolVar(&opts.showRestoreOutput, "show-restore-output", false, "Log the output of dotnet restore at info level instead of debug level")
+	flags.StringVar(&opts.statusAddr, "status-addr", "", "Serve the progress of the run as JSON on this address (such as localhost:8080)")
+	flags.DurationVar(&opts.statusLinger, "status-linger", 30*time.Second, "With -status-addr, keep serving the result this long after the run, or until interrupted")
+	flags.BoolVar(&opts.verbose, "verbose", false, "Enable extra logging")
+	flags.StringVar(&opts.tag, "tag", tagAuto, "dotnet version to run, or auto to detect it from the sources")
+	flags.StringVar(&opts.image, "image", "", "SDK container image to use, overriding -tag")
+	flags.BoolVar(&opts.warmStart, "warm-start", false, "Keep the SDK state and caches in a volume for later runs")
+	flags.Var(&opts.pull, "pull", "When to pull the SDK image (always, missing, never)")
+	flags.DurationVar(&opts.pullTimeout, "pull-timeout", 0, "Maximum time to spend pulling the SDK image (0 for no limit)")
+	flags.Var(&opts.runtime, "runtime", "Container runtime to use (docker, podman, auto)")
+	flags.StringVar(&opts.containerID, "container-id", "", "Restore in this already running container instead of creating one")
+	flags.BoolVar(&opts.noContainer, "no-container", !haveContainers, "Restore using the dotnet SDK on the host instead of a container")
+	flags.StringVar(&opts.srcDir, "srcdir", "", "Directory of already extracted sources to use instead of an archive")
+	flags.Var(&opts.archives, "archive", "Source code archive to scan for references; may be repeated")
+	flags.Var(&opts.pathScopes, "path-scope", "Only restore projects in this subtree of the sources (such as src/tools/mytool/**); may be repeated")
+	flags.Var(&opts.solutions, "solution", "Solution or project in the archive to restore, instead of detecting them; may be repeated")
+	flags.Var(&opts.stripComponents, "strip-components", "Leading path components to remove from archive members (a number, or auto)")
+	flags.BoolVar(&opts.strictPaths, "strict-paths", false, "Fail on archive members that would be written outside the sources, instead of skipping them")
+	flags.Var(&opts.maxExtractSize, "max-extract-size", "Maximum total size of the files in a source archive (with K, M, G or T suffix; 0 for no limit)")
+	flags.Var(&opts.maxExtractFileSize, "max-extract-file-size", "Maximum size of a single file in a source archive (0 for no limit)")
+	flags.IntVar(&opts.maxExtractFiles, "max-extract-files", 1000000, "Maximum number of members in a source archive (0 for no limit)")
+	flags.Var(&opts.archiveSelect, "archive-select", "How to select from multiple candidate archives (newest, error-on-multiple)")
+	flags.Var(&opts.compression, "compression", "Compression to use")
+	flags.Var(&opts.cleanup, "cleanup", "Files to keep for each package (minimal, cache, full)")
+	flags.Var(&opts.cleanupKeep, "cleanup-keep", "Also keep the files of each package matching this name pattern (such as *.nupkg.metadata); may be repeated")
+	flags.Var(&opts.windowsPaths, "windows-paths", "How to handle paths that can not be used on Windows (ignore, warn, error, sanitize)")
+	flags.BoolVar(&opts.zstdLong, "zstd-long", false, "Compress zstd output with a large window for better compression of similar files")
+	flags.Var(&opts.layout, "layout", "Layout of the output archive (flat, nested)")
+	flags.Var(&opts.format, "format", "Format of the output archive (tar, cpio, zip)")
+	flags.StringVar(&opts.output, "output", "packages", "Base name of output archive")
+	flags.StringVar(&opts.outDir, "outdir", "", "Output directory")
+	flags.BoolVar(&opts.noClobber, "no-clobber", false, "Refuse to replace an existing output archive")
+	flags.BoolVar(&opts.force, "force", false, "Restore even if the lock files are unchanged, and replace an existing output archive even with -no-clobber")
+	flags.BoolVar(&opts.hashSuffix, "hash-suffix", false, "Append a short hash of the source archive to the output name")
+	flags.BoolVar(&opts.allowEmpty, "allow-empty", false, "Create an empty archive if no .NET projects are found")
+	flags.BoolVar(&opts.restoreLog, "restore-log", false, "Write the output of dotnet restore to a log file next to the output archive")
+	flags.BoolVar(&opts.manifest, "manifest", false, "Write a manifest describing the output archive")
+	flags.Var(&opts.reportFormat, "report-format", "Format of the manifest (json, csv, markdown)")
+	flags.Var(&opts.targetFrameworks, "target-framework", "Only keep packages that the lock files need for this target framework; may be repeated")
+	flags.DurationVar(&opts.timeout, "timeout", 0, "Give up if the whole run takes longer than this (such as 1h)")
+	flags.DurationVar(&opts.solutionTimeout, "solution-timeout", 0, "Give up if restoring a single solution takes longer than this")
+	flags.IntVar(&opts.retries, "retries", 0, "Retry a restore that failed due to network errors this many times, with exponential backoff")
+	flags.BoolVar(&opts.workloads, "workloads", false, "Also download the workload packs (MAUI, WebAssembly, ...) the projects need")
+	flags.BoolVar(&opts.packTooling, "pack-tooling", false, "Also restore packages needed to pack NuGet packages and tools")
+	flags.IntVar(&opts.reportTimings, "report-timings", 0, "Log this many of the slowest projects and package downloads of each restore")
+	flags.BoolVar(&opts.requireLockFiles, "require-lockfiles", false, "Fail if any project does not have a lock file")
+	flags.BoolVar(&opts.forceEvaluate, "force-evaluate", false, "If a lock file does not match its project, restore again with --force-evaluate and report the changed packages")
+	flags.BoolVar(&opts.lockedMode, "locked-mode", true, "Restore in locked mode; disabling this makes the result not reproducible")
+	flags.BoolVar(&opts.requirePinned, "require-pinned-tools", false, "Fail if a dotnet-tools.json tool does not have an exact version, or rolls forward")
+	flags.BoolVar(&opts.generateLockFiles, "generate-lockfiles", false, "Generate missing lock files before restoring, and write them to an archive next to the output")
+	flags.BoolVar(&opts.singleVersion, "single-version-per-package", false, "Fail if a package is restored in multiple versions")
+	flags.BoolVar(&opts.smokeTestFeed, "smoke-test-feed", false, "With -smoke-test, serve the packages as an HTTP feed instead of a directory")
+	flags.BoolVar(&opts.smokeTest, "smoke-test", false, "Verify that the packages can be restored without network access")
+	flags.BoolVar(&opts.noNetwork, "no-network", false, "Restore without network access, downloading only through a recording proxy")
+	flags.BoolVar(&opts.downloadList, "download-list", false, "With -no-network, also write the downloaded packages as spec file sources with checksums")
+	flags.StringVar(&opts.upstream, "upstream", "https://api.nuget.org/v3/index.json", "NuGet service index to download from with -no-network")
+	flags.StringVar(&opts.containerUser, "container-user", "", "User (and optionally group) to run as in the container")
+	flags.Var(&opts.properties, "property", "Set an MSBuild property (NAME=VALUE) when restoring; may be repeated")
+	flags.Var(&opts.redact, "redact", "Value to hide in logs, such as a token; may be repeated")
+	flags.Var(&opts.env, "env", "Set an environment variable (NAME=VALUE) in the container; may be repeated")
+	flags.BoolVar(&opts.stripVCS, "strip-vcs", false, "Remove version control metadata from the sources before restoring")
+	flags.Var(&opts.forbidContent, "forbid-content", "Fail if the packages contain files of this kind (native, script, executable); may be repeated")
+	flags.BoolVar(&opts.forbidBinaries, "forbid-binaries", false, "Fail if the sources contain prebuilt binaries (.dll, .exe, .nupkg)")
+	flags.BoolVar(&opts.disableGitTasks, "disable-git-tasks", false, "Disable SourceLink/GitVersion tasks that need git metadata")
+	flags.Var(&opts.vendors, "vendor", "Also vendor another ecosystem (npm, or NAME=COMMAND) into an additional archive; may be repeated")
+	flags.StringVar(&opts.cacheDir, "cache-dir", "", "Directory to keep the NuGet HTTP cache in between runs")
+	flags.BoolVar(&opts.bundledProvides, "bundled-provides", false, "Also write Provides: bundled(nuget(...)) lines for the packages next to the output")
+	flags.BoolVar(&opts.updateSpecProvides, "update-spec-provides", false, "Replace the marked region of the spec files with Provides: bundled(nuget(...)) lines")
+	flags.StringVar(&opts.systemPackages, "system-packages", "", "File mapping package IDs to the distribution packages providing them, to leave out of the output")
+	flags.StringVar(&opts.extraPackagesDir, "extra-packages-dir", "", "Directory of additional packages (<id>/<version>/...) to include")
+	flags.StringVar(&opts.recordDir, "record", "", "Record NuGet responses into this directory (implies -no-network)")
+	flags.StringVar(&opts.replayDir, "replay", "", "Serve NuGet responses recorded with -record from this directory (implies -no-network)")
+	flags.BoolVar(&opts.hermetic, "hermetic", false, "Require all inputs to be given explicitly, and ignore host configuration")
+	flags.Var(&opts.matrixTags, "matrix-tag", "dotnet version to restore with, instead of -tag; may be repeated")
+	flags.Var(&opts.rids, "rid", "Runtime identifier to restore runtime packs for, such as linux-x64; may be repeated")
+	flags.Var(&opts.matrixRIDs, "matrix-rid", "Runtime identifier to restore for with each -matrix-tag; may be repeated")
+	flags.Var(&opts.matrixOutput, "matrix-output", "How to write the outputs of a restore matrix (merged, split)")
+	flags.StringVar(&opts.fromService, "from-service", "", "Read parameters from the given _service file")
+	args, err := serviceArgs(flags, args)
+	if err != nil {
+		return nil, err
+	}
+	if err := flags.Parse(args); err != nil {
+		return nil, err
+	}
+	if opts.fromService != "" {
+		if err := applyServiceFile(flags, opts.fromService); err != nil {
+			return nil, err
+		}
+	}
+	if opts.sourceDateEpoch = os.Getenv("SOURCE_DATE_EPOCH"); opts.sourceDateEpoch != "" {
+		if _, err := strconv.ParseInt(opts.sourceDateEpoch, 10, 64); err != nil {
+			return nil, fmt.Errorf("invalid SOURCE_DATE_EPOCH %q", opts.sourceDateEpoch)
+		}
+	}
+	if opts.format != outputFormatTar && opts.compression != compressionTypeNone {
+		compressionSet := false
+		flags.Visit(func(f *flag.Flag) { compressionSet = compressionSet || f.Name == "compression" })
+		if compressionSet {
+			return nil, fmt.Errorf("-compression can only be used with -format tar")
+		}
+	}
+	for _, pattern := range opts.cleanupKeep {
+		if _, err := filepath.Match(pattern, ""); err != nil || pattern == "" || strings.Contains(pattern, "/") {
+			return nil, fmt.Errorf("invalid -cleanup-keep pattern %q: must match file names", pattern)
+		}
+	}
+	if opts.smokeTestFeed && !opts.smokeTest {
+		return nil, fmt.Errorf("-smoke-test-feed requires -smoke-test")
+	}
+	if opts.format == outputFormatZip && opts.layout == outputLayoutNested {
+		return nil, fmt.Errorf("-layout nested can not be used with -format zip")
+	}
+	if opts.recordDir != "" && opts.replayDir != "" {
+		return nil, fmt.Errorf("-record and -replay can not be used together")
+	}
+	if opts.hermetic {
+		if err := checkHermetic(flags, opts); err != nil {
+			return nil, err
+		}
+	}
+	if opts.recordDir != "" || opts.replayDir != "" {
+		opts.noNetwork = true
+	}
+	if len(opts.vendors) > 0 && opts.noNetwork {
+		return nil, fmt.Errorf("-vendor can not be used with -no-network, -hermetic, -record or -replay, as vendorers run with network access")
+	}
+	if opts.noContainer && opts.noNetwork {
+		return nil, fmt.Errorf("-no-network requires a container")
+	}
+	if opts.srcDir != "" {
+		if len(opts.archives) > 0 || opts.stripVCS || opts.hashSuffix || opts.stripComponents != 0 {
+			return nil, fmt.Errorf("-srcdir can not be used with -archive, -strip-vcs, -strip-components or -hash-suffix")
+		}
+		var err error
+		if opts.srcDir, err = filepath.Abs(opts.srcDir); err != nil {
+			return nil, err
+		}
+	}
+	if opts.generateLockFiles && (opts.requireLockFiles || opts.containerID != "") {
+		return nil, fmt.Errorf("-generate-lockfiles can not be used with -require-lockfiles or -container-id")
+	}
+	if opts.downloadList && !opts.noNetwork {
+		return nil, fmt.Errorf("-download-list can only be used with -no-network")
+	}
+	if opts.forceEvaluate && opts.containerID != "" {
+		return nil, fmt.Errorf("-force-evaluate can not be used with -container-id")
+	}
+	if opts.cacheDir != "" {
+		if opts.noNetwork || opts.containerID != "" {
+			return nil, fmt.Errorf("-cache-dir can not be used with -no-network or -container-id")
+		}
+		var err error
+		if opts.cacheDir, err = filepath.Abs(opts.cacheDir); err != nil {
+			return nil, err
+		}
+	}
+	if opts.containerID != "" && (opts.noContainer || opts.noNetwork) {
+		return nil, fmt.Errorf("-container-id can not be used with -no-container or -no-network")
+	}
+	if opts.matrixOutput == matrixOutputSplit && (len(opts.matrixTags) > 0 || len(opts.matrixRIDs) > 0) &&
+		(opts.smokeTest || opts.bundledProvides || opts.updateSpecProvides || opts.downloadList) {
+		return nil, fmt.Errorf("-matrix-output split can not be used with -smoke-test, -bundled-provides, -update-spec-provides or -download-list")
+	}
+	if len(opts.rids) > 0 && len(opts.matrixRIDs) > 0 {
+		return nil, fmt.Errorf("-rid can not be used with -matrix-rid")
+	}
+	if len(opts.matrixTags) > 0 && (opts.image != "" || opts.noContainer || opts.containerID != "") {
+		return nil, fmt.Errorf("-matrix-tag can not be used with -image, -no-container or -container-id")
+	}
+	return opts, nil
+}
+
+// Check that everything that influences a hermetic run is given explicitly,
+// and apply the settings that keep host state out of it: packages are only
+// downloaded from the upstream feed, through the proxy.
+func checkHermetic(flags *flag.FlagSet, opts *options) error {
+	explicit := make(map[string]bool)
+	flags.Visit(func(f *flag.Flag) { explicit[f.Name] = true })
+	var problems []string
+	if !explicit["archive"] && !explicit["srcdir"] {
+		problems = append(problems, "-archive or -srcdir must be given")
+	}
+	if !strings.Contains(opts.image, "@sha256:") {
+		problems = append(problems, "-image must be given with a digest")
+	}
+	if !explicit["upstream"] {
+		problems = append(problems, "-upstream must be given")
+	}
+	if opts.noContainer || opts.containerID != "" || opts.warmStart {
+		problems = append(problems, "-no-container, -container-id and -warm-start can not be used")
+	}
+	if !opts.lockedMode || opts.forceEvaluate {
+		problems = append(problems, "-locked-mode can not be disabled, and -force-evaluate can not be used")
+	}
+	if opts.sourceDateEpoch == "" {
+		problems = append(problems, "SOURCE_DATE_EPOCH must be set")
+	}
+	if len(problems) > 0 {
+		return fmt.Errorf("hermetic mode: %s", strings.Join(problems, "; "))
+	}
+	opts.noNetwork = true
 	return nil
 }
 
+type optionsKey struct{}
+
+// Return a context carrying the given options.
+func withOptions(ctx context.Context, opts *options) context.Context {
+	return context.WithValue(ctx, optionsKey{}, opts)
+}
+
+// The options of the run the context belongs to, or the defaults if the
+// context carries none.  The options must not be modified, as the context may
+// be shared; derive a context with a modified copy instead.
+func optionsFrom(ctx context.Context) *options {
+	if opts, ok := ctx.Value(optionsKey{}).(*options); ok {
+		return opts
+	}
+	opts, err := parseOptions(flag.NewFlagSet("defaults", flag.ContinueOnError), nil)
+	if err != nil {
+		// Only an invalid SOURCE_DATE_EPOCH fails without arguments.
+		return &options{}
+	}
+	return opts
+}
+
 // If the archive option was not provided, try to find an appropriate archive to
-// use. Modifies [options.archive].
-func locateArchive(ctx context.Context) error {
-	if options.archive != "" {
-		return nil
+// use; archives that are glob patterns are replaced by one of the matching
+// files. The returned context carries the options with the archives found.
+func locateArchive(ctx context.Context) (context.Context, error) {
+	opts := optionsFrom(ctx)
+	derived := *opts
+	derived.archives = slices.Clone(opts.archives)
+	for i, archive := range opts.archives {
+		if !strings.ContainsAny(archive, "*?[") {
+			continue
+		}
+		names, err := filepath.Glob(archive)
+		if err != nil {
+			return nil, fmt.Errorf("invalid archive pattern %s: %w", archive, err)
+		}
+		if len(names) == 0 {
+			return nil, fmt.Errorf("%w: no archive matches %s", ErrArchiveNotFound, archive)
+		}
+		if derived.archives[i], err = selectArchive(ctx, names); err != nil {
+			return nil, err
+		}
+	}
+	if len(derived.archives) > 0 {
+		return withOptions(ctx, &derived), nil
+	}
+	// Prefer the archives that the services in _service produce.
+	if patterns, err := serviceArchivePatterns("_service"); err != nil && !errors.Is(err, fs.ErrNotExist) {
+		slog.WarnContext(ctx, "failed to read _service", "error", err)
+	} else if len(patterns) > 0 {
+		var candidates []string
+		for _, pattern := range patterns {
+			for _, prefix := range []string{"", "_service:*:"} {
+				names, err := filepath.Glob(prefix + pattern)
+				if err != nil {
+					return nil, fmt.Errorf("invalid archive pattern %s: %w", pattern, err)
+				}
+				candidates = append(candidates, names...)
+			}
+		}
+		if len(candidates) > 0 {
+			slog.InfoContext(ctx, "found archives from _service", "patterns", patterns, "archives", candidates)
+			archive, err := selectArchive(ctx, candidates)
+			if err != nil {
+				return nil, err
+			}
+			derived.archives = stringList{archive}
+			return withOptions(ctx, &derived), nil
+		}
+		slog.InfoContext(ctx, "no archives from _service found", "patterns", patterns)
 	}
+
 	specFiles, err := filepath.Glob("*.spec")
 	if err != nil {
-		return fmt.Errorf("failed to detect spec files: %w", err)
+		return nil, fmt.Errorf("failed to detect spec files: %w", err)
 	}
 
-	exts := []string{
-		".obscpio",
-		".tar",
-		".tar.gz",
-		".tar.zst",
+	// Use the main sources named in the spec files, if they exist.
+	var candidates []string
+	for _, specFile := range specFiles {
+		source, err := specSource0(specFile)
+		if err != nil {
+			slog.WarnContext(ctx, "failed to read spec file", "spec", specFile, "error", err)
+			continue
+		} else if source == "" || strings.ContainsAny(source, "%*?[") {
+			continue
+		}
+		for _, pattern := range []string{source, "_service:*:" + source} {
+			names, err := filepath.Glob(pattern)
+			if err != nil {
+				return nil, fmt.Errorf("invalid archive pattern %s: %w", pattern, err)
+			}
+			candidates = append(candidates, names...)
+		}
+	}
+	if len(candidates) > 0 {
+		slog.InfoContext(ctx, "found archives from spec files", "archives", candidates)
+		archive, err := selectArchive(ctx, candidates)
+		if err != nil {
+			return nil, err
+		}
+		derived.archives = stringList{archive}
+		return withOptions(ctx, &derived), nil
 	}
 
 	for _, specFile := range specFiles {
@@ -54,7 +470,7 @@ func locateArchive(ctx context.Context) error {
 			stem = stem[strings.LastIndex(stem, ":"):]
 		}
 		for _, pattern := range []string{stem, "_service:*" + stem} {
-			for _, ext := range exts {
+			for _, ext := range sourceArchiveExts {
 				slog.InfoContext(ctx, "globbing", "pattern", pattern+"*"+ext)
 				names, err := filepath.Glob(pattern + "*" + ext)
 				if err != nil {
@@ -62,12 +478,90 @@ func locateArchive(ctx context.Context) error {
 				} else {
 					for _, archive := range names {
 						slog.InfoContext(ctx, "got archive", "name", archive)
-						options.archive = archive
-						return nil
+						if !slices.Contains(candidates, archive) {
+							candidates = append(candidates, archive)
+						}
 					}
 				}
 			}
 		}
 	}
-	return fmt.Errorf("failed to auto-detect archive name")
+	if len(candidates) == 0 {
+		return nil, fmt.Errorf("%w: failed to auto-detect archive name", ErrArchiveNotFound)
+	}
+	archive, err := selectArchive(ctx, candidates)
+	if err != nil {
+		return nil, err
+	}
+	derived.archives = stringList{archive}
+	return withOptions(ctx, &derived), nil
+}
+
+type archiveSelection string
+
+const (
+	archiveSelectionNewest          = "newest"
+	archiveSelectionErrorOnMultiple = "error-on-multiple"
+)
+
+func (a *archiveSelection) String() string {
+	if a == nil {
+		return "<nil>"
+	}
+	return string(*a)
+}
+
+func (a *archiveSelection) Set(value string) error {
+	switch value {
+	case archiveSelectionNewest, archiveSelectionErrorOnMultiple:
+		*a = archiveSelection(value)
+		return nil
+	}
+	return fmt.Errorf("invalid archive selection %s", value)
+}
+
+// Select one of multiple candidate archives, according to the archive
+// selection option. Candidates are ranked by the version in their name, then
+// by modification time, then by name so that the selection is deterministic.
+func selectArchive(ctx context.Context, names []string) (string, error) {
+	opts := optionsFrom(ctx)
+	if len(names) == 1 {
+		return names[0], nil
+	}
+	if opts.archiveSelect == archiveSelectionErrorOnMultiple {
+		return "", fmt.Errorf("multiple candidate archives: %s", strings.Join(names, ", "))
+	}
+	type candidate struct {
+		name    string
+		version string
+		modTime time.Time
+	}
+	var candidates []candidate
+	for _, name := range names {
+		info, err := os.Stat(name)
+		if err != nil {
+			return "", err
+		}
+		candidates = append(candidates, candidate{name, version.FromFilename(name), info.ModTime()})
+	}
+	// Compare two candidates, returning the result and what decided it.
+	compare := func(a, b candidate) (int, string) {
+		if c := version.Compare(a.version, b.version); c != 0 {
+			return c, "version"
+		}
+		if c := a.modTime.Compare(b.modTime); c != 0 {
+			return c, "modification time"
+		}
+		return strings.Compare(a.name, b.name), "name"
+	}
+	best, reason := candidates[0], ""
+	for _, c := range candidates[1:] {
+		if result, why := compare(c, best); result > 0 {
+			best, reason = c, why
+		} else if reason == "" {
+			reason = why
+		}
+	}
+	slog.InfoContext(ctx, "selected archive", "name", best.name, "version", best.version, "decided by", reason, "candidates", names)
+	return best.name, nil
 }
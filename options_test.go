@@ -0,0 +1,84 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestOptionsFromDefaults(t *testing.T) {
+	opts := optionsFrom(context.Background())
+	if opts.format != outputFormatTar || opts.output != testOptions(t).output {
+		t.Errorf("options without a context are not the defaults: %+v", opts)
+	}
+}
+
+// Sources in two directories that need different SDK versions and were
+// modified at different times.
+func TestPrepareSourcesConcurrently(t *testing.T) {
+	t.Setenv("SOURCE_DATE_EPOCH", "")
+	dirs := map[string]string{"8.0": t.TempDir(), "9.0": t.TempDir()}
+	for tag, dir := range dirs {
+		project := `<Project Sdk="Microsoft.NET.Sdk"><PropertyGroup><TargetFramework>net` + tag + `</TargetFramework></PropertyGroup></Project>`
+		name := filepath.Join(dir, "app.csproj")
+		if err := os.WriteFile(name, []byte(project), 0o644); err != nil {
+			t.Fatal(err)
+		}
+		modified := time.Date(2024, 1, int(tag[0]-'0'), 0, 0, 0, 0, time.UTC)
+		if err := os.Chtimes(name, modified, modified); err != nil {
+			t.Fatal(err)
+		}
+	}
+	base := testOptions(t, "-srcdir", dirs["8.0"])
+	ctx := withOptions(context.Background(), base)
+
+	var wg sync.WaitGroup
+	derived := make(map[string]*options)
+	var mu sync.Mutex
+	for tag, dir := range dirs {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			prepared, _, err := prepareSources(ctx, dir)
+			if err != nil {
+				t.Error(err)
+				return
+			}
+			mu.Lock()
+			defer mu.Unlock()
+			derived[tag] = optionsFrom(prepared)
+		}()
+	}
+	wg.Wait()
+
+	for tag, opts := range derived {
+		if opts.tag != tag {
+			t.Errorf("sources needing %s got tag %s", tag, opts.tag)
+		}
+		info, err := os.Stat(filepath.Join(dirs[tag], "app.csproj"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if epoch, ok := sourceDateEpoch(withOptions(ctx, opts)); !ok || !epoch.Equal(info.ModTime().Truncate(time.Second)) {
+			t.Errorf("sources needing %s got SOURCE_DATE_EPOCH %s, want %s", tag, epoch, info.ModTime())
+		}
+	}
+	if base.tag != tagAuto || base.sourceDateEpoch != "" || base.sdkGroups != nil {
+		t.Errorf("shared options were modified: tag %s, SOURCE_DATE_EPOCH %q, SDK groups %v", base.tag, base.sourceDateEpoch, base.sdkGroups)
+	}
+}
+
+func TestMatrixSplitRejectsPackageOptions(t *testing.T) {
+	for _, arg := range [][]string{{"-smoke-test"}, {"-bundled-provides"}, {"-update-spec-provides"}, {"-no-network", "-download-list"}} {
+		args := append([]string{"-matrix-tag", "8.0", "-matrix-tag", "9.0", "-matrix-output", "split"}, arg...)
+		_, err := parseOptions(flag.NewFlagSet("test", flag.ContinueOnError), args)
+		if err == nil || !strings.Contains(err.Error(), "-matrix-output split") {
+			t.Errorf("%v was accepted with a split matrix: %v", arg, err)
+		}
+	}
+}
@@ -0,0 +1,74 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"log/slog"
+	"regexp"
+	"strings"
+)
+
+// Lines of dotnet or NuGet output that report warnings or errors, such as
+// "warning NU1603: ..." or "error MSB4236: ...".
+var problemLinePattern = regexp.MustCompile(`(?i)\b(warning|error)\s*[A-Z]*[0-9]*\s*:`)
+
+// logWriter logs what is written to it line by line: at debug level, or at
+// info level for warnings and errors or with -show-restore-output.
+type logWriter struct {
+	ctx     context.Context
+	command string
+	buf     []byte
+}
+
+func newLogWriter(ctx context.Context, command string) *logWriter {
+	return &logWriter{ctx: ctx, command: command}
+}
+
+func (w *logWriter) Write(p []byte) (int, error) {
+	w.buf = append(w.buf, p...)
+	for {
+		i := bytes.IndexByte(w.buf, '\n')
+		if i < 0 {
+			break
+		}
+		w.log(string(w.buf[:i]))
+		w.buf = w.buf[i+1:]
+	}
+	return len(p), nil
+}
+
+// Log any incomplete last line.
+func (w *logWriter) Close() error {
+	if len(w.buf) > 0 {
+		w.log(string(w.buf))
+		w.buf = nil
+	}
+	return nil
+}
+
+func (w *logWriter) log(line string) {
+	line = strings.TrimRight(line, "\r")
+	if strings.TrimSpace(line) == "" {
+		return
+	}
+	level := slog.LevelDebug
+	if optionsFrom(w.ctx).showRestoreOutput || problemLinePattern.MatchString(line) {
+		level = slog.LevelInfo
+	}
+	slog.Log(w.ctx, level, "output", "command", w.command, "line", line)
+}
+
+type restoreLogKey struct{}
+
+// Return a context in which the output of every restore is also written to
+// the given writer (for -restore-log).
+func withRestoreLog(ctx context.Context, w io.Writer) context.Context {
+	return context.WithValue(ctx, restoreLogKey{}, w)
+}
+
+// The writer for the restore log, or nil if there is none.
+func restoreLogFrom(ctx context.Context) io.Writer {
+	w, _ := ctx.Value(restoreLogKey{}).(io.Writer)
+	return w
+}
@@ -0,0 +1,30 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"os"
+	"strings"
+)
+
+// Create an output archive from a package directory, with the same settings
+// as a normal run; for example, after pruning the packages by hand.
+func runPack(ctx context.Context, args []string) error {
+	opts := optionsFrom(ctx)
+	if len(args) != 2 {
+		return fmt.Errorf("usage: pack <directory> <output>")
+	}
+	dir := args[0]
+	outBase := strings.TrimSuffix(args[1], outputExtension(opts))
+	if info, err := os.Stat(dir); err != nil {
+		return err
+	} else if !info.IsDir() {
+		return fmt.Errorf("%s is not a directory", dir)
+	}
+	if err := writeOutput(ctx, dir, outBase); err != nil {
+		return err
+	}
+	slog.InfoContext(ctx, "created archive", "archive", outBase+outputExtension(opts))
+	return nil
+}
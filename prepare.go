@@ -0,0 +1,175 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// The file in a prepared directory recording what the package phase needs.
+const preparedStateFile = "prepared.json"
+
+// preparedState is what the prepare command records for the package command.
+type preparedState struct {
+	SrcDir          string    `json:"srcDir"`
+	Targets         []string  `json:"targets"`
+	SourceDateEpoch string    `json:"sourceDateEpoch,omitempty"`
+	Manifest        *manifest `json:"manifest"`
+}
+
+// Extract the sources and restore them into a directory without cleaning up
+// the packages (the prepare command), so that they can be inspected or changed
+// before running the package command on the directory.  The directory must be
+// empty or not exist, and gets src (unless -srcdir is given) and packages
+// subdirectories.  The restore log and generated lock files are written next
+// to the output as when building; vendoring happens in the package command.
+func runPrepare(ctx context.Context, args []string) error {
+	opts := optionsFrom(ctx)
+	if len(args) != 1 {
+		return fmt.Errorf("usage: prepare <directory>")
+	}
+	if len(opts.matrixTags) > 0 || len(opts.matrixRIDs) > 0 {
+		return fmt.Errorf("prepare can not be used with -matrix-tag or -matrix-rid")
+	}
+	dir, err := filepath.Abs(args[0])
+	if err != nil {
+		return err
+	}
+	if entries, err := os.ReadDir(dir); err == nil && len(entries) > 0 {
+		return fmt.Errorf("prepare directory %s is not empty", dir)
+	} else if err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return err
+	}
+	outBase, err := outputBase(opts)
+	if err != nil {
+		return err
+	}
+	ctx, closeLog, err := openRestoreLog(ctx, outBase)
+	if err != nil {
+		return err
+	}
+	defer closeLog()
+	srcDir := opts.srcDir
+	if srcDir == "" {
+		srcDir = filepath.Join(dir, "src")
+	}
+	packagesDir := filepath.Join(dir, "packages")
+	for _, d := range []string{srcDir, packagesDir} {
+		if err := os.MkdirAll(d, 0o755); err != nil {
+			return fmt.Errorf("failed to create %s: %w", d, err)
+		}
+	}
+
+	setPhase(ctx, "extracting")
+	ctx, targets, err := prepareSources(ctx, srcDir)
+	if err != nil {
+		return err
+	}
+	opts = optionsFrom(ctx)
+	if len(targets) == 0 && !opts.allowEmpty {
+		return fmt.Errorf("no .NET projects detected in %s", strings.Join(sourceNames(ctx), ", "))
+	}
+	if len(opts.sdkGroups) > 1 {
+		return fmt.Errorf("prepare can not restore with multiple SDK versions; use -tag to select one")
+	}
+	names := sourceNames(ctx)
+	m := &manifest{SchemaVersion: manifestSchemaVersion, Archive: filepath.Base(names[0])}
+	for _, name := range names[1:] {
+		m.AdditionalArchives = append(m.AdditionalArchives, filepath.Base(name))
+	}
+	if len(targets) == 0 {
+		m.Empty = true
+	} else {
+		if m.Projects, err = lockFileCoverage(ctx, srcDir, targets); err != nil {
+			return err
+		}
+		feeds, err := findInTreeFeeds(ctx, srcDir)
+		if err != nil {
+			return fmt.Errorf("failed to find package feeds in sources: %w", err)
+		}
+		if m.Tools, err = readToolManifests(ctx, srcDir); err != nil {
+			return fmt.Errorf("failed to read tool manifests: %w", err)
+		}
+		if _, err := restoreSources(ctx, srcDir, packagesDir, outBase, m, func() (bool, error) {
+			return false, restoreAll(ctx, srcDir, packagesDir, targets, feeds, m)
+		}); err != nil {
+			return err
+		}
+	}
+
+	state := preparedState{
+		SrcDir:          srcDir,
+		Targets:         targets,
+		SourceDateEpoch: opts.sourceDateEpoch,
+		Manifest:        m,
+	}
+	buf, err := json.MarshalIndent(state, "", "  ")
+	if err != nil {
+		return err
+	}
+	if err := os.WriteFile(filepath.Join(dir, preparedStateFile), append(buf, '\n'), 0o644); err != nil {
+		return fmt.Errorf("failed to write prepared state: %w", err)
+	}
+	slog.InfoContext(ctx, "prepared packages; run the package command to create the output", "directory", dir)
+	return nil
+}
+
+// Clean up the packages in a directory created by the prepare command, and
+// create the output archive and manifest from them (the package command).
+func runPackage(ctx context.Context, args []string) error {
+	opts := optionsFrom(ctx)
+	if len(args) != 1 {
+		return fmt.Errorf("usage: package <directory>")
+	}
+	dir := args[0]
+	buf, err := os.ReadFile(filepath.Join(dir, preparedStateFile))
+	if err != nil {
+		return fmt.Errorf("failed to read prepared state; run prepare first: %w", err)
+	}
+	var state preparedState
+	if err := json.Unmarshal(buf, &state); err != nil {
+		return fmt.Errorf("invalid %s: %w", preparedStateFile, err)
+	}
+	if state.Manifest == nil {
+		return fmt.Errorf("invalid %s: no manifest", preparedStateFile)
+	}
+	if opts.sourceDateEpoch == "" {
+		derived := *opts
+		derived.sourceDateEpoch = state.SourceDateEpoch
+		opts = &derived
+		ctx = withOptions(ctx, opts)
+	}
+	outBase, err := outputBase(opts)
+	if err != nil {
+		return err
+	}
+	if err := checkClobber(opts, outBase+outputExtension(opts)); err != nil {
+		return err
+	}
+	packagesDir := filepath.Join(dir, "packages")
+	m := state.Manifest
+	if m.Empty {
+		if err := os.WriteFile(filepath.Join(packagesDir, emptyMarker), nil, 0o644); err != nil {
+			return fmt.Errorf("failed to create empty archive marker: %w", err)
+		}
+	} else {
+		setPhase(ctx, "cleaning up")
+		feeds, err := findInTreeFeeds(ctx, state.SrcDir)
+		if err != nil {
+			return fmt.Errorf("failed to find package feeds in sources: %w", err)
+		}
+		if err := finishPackages(ctx, state.SrcDir, packagesDir, feeds, m); err != nil {
+			return err
+		}
+	}
+	if err := vendorAuxiliary(ctx, state.SrcDir, outBase); err != nil {
+		return err
+	}
+	return packageOutput(ctx, state.SrcDir, packagesDir, outBase, state.Targets, m)
+}
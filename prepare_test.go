@@ -0,0 +1,45 @@
+package main
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestPrepareNonEmptyDirectory(t *testing.T) {
+	dir := t.TempDir()
+	writeFiles(t, dir, "keep")
+	ctx := withOptions(context.Background(), testOptions(t))
+	err := runPrepare(ctx, []string{dir})
+	if err == nil || !strings.Contains(err.Error(), "not empty") {
+		t.Errorf("runPrepare = %v, want a non-empty directory error", err)
+	}
+	assertExists(t, filepath.Join(dir, "keep"))
+	assertRemoved(t, filepath.Join(dir, "src"), filepath.Join(dir, "packages"))
+}
+
+func TestPackageNoClobber(t *testing.T) {
+	dir, outDir := t.TempDir(), t.TempDir()
+	state := `{"srcDir": "` + filepath.Join(dir, "src") + `", "manifest": {"empty": true}}`
+	if err := os.WriteFile(filepath.Join(dir, preparedStateFile), []byte(state), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	opts := testOptions(t, "-no-clobber", "-outdir", outDir)
+	outBase, err := outputBase(opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	output := outBase + outputExtension(opts)
+	if err := os.WriteFile(output, []byte("old"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	err = runPackage(withOptions(context.Background(), opts), []string{dir})
+	if err == nil || !strings.Contains(err.Error(), "already exists") {
+		t.Errorf("runPackage = %v, want an error about the existing output", err)
+	}
+	if buf, err := os.ReadFile(output); err != nil || string(buf) != "old" {
+		t.Errorf("output was replaced: %q, %v", buf, err)
+	}
+}
@@ -0,0 +1,295 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"io/fs"
+	"log/slog"
+	"os"
+	"path"
+	"path/filepath"
+	"regexp"
+	"slices"
+	"strings"
+)
+
+// Extensions of project files that can be restored by dotnet.
+var supportedProjectExts = []string{".csproj", ".fsproj", ".vbproj"}
+
+// Extensions of project files that dotnet can not restore (C++/CLI).
+var unsupportedProjectExts = []string{".vcxproj", ".vcproj"}
+
+// Matches project lines in a solution file, capturing the project path:
+// Project("{type-GUID}") = "Name", "path\to\project.csproj", "{GUID}"
+var solutionProjectPattern = regexp.MustCompile(`^Project\("[^"]*"\)\s*=\s*"[^"]*"\s*,\s*"([^"]+)"`)
+
+// Read the paths of the projects in a solution file. The paths are relative to
+// the directory containing the solution, using forward slashes.
+func solutionProjects(solutionPath string) ([]string, error) {
+	file, err := os.Open(solutionPath)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+	var projects []string
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		match := solutionProjectPattern.FindStringSubmatch(strings.TrimSpace(scanner.Text()))
+		if match == nil {
+			continue
+		}
+		projects = append(projects, path.Clean(strings.ReplaceAll(match[1], `\`, "/")))
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	return projects, nil
+}
+
+// Determine what to pass to dotnet restore, given the solutions (relative to
+// srcDir) found in the archive. Solutions containing projects that can not be
+// restored (such as C++/CLI projects) are replaced by their supported projects.
+func restoreTargets(ctx context.Context, srcDir string, solutions []string) ([]string, error) {
+	var targets []string
+	for _, solution := range solutions {
+		projects, err := solutionProjects(filepath.Join(srcDir, solution))
+		if err != nil {
+			return nil, fmt.Errorf("failed to read solution %s: %w", solution, err)
+		}
+		var supported, unsupported []string
+		for _, project := range projects {
+			switch ext := strings.ToLower(path.Ext(project)); {
+			case slices.Contains(supportedProjectExts, ext):
+				supported = append(supported, path.Join(path.Dir(solution), project))
+			case slices.Contains(unsupportedProjectExts, ext):
+				unsupported = append(unsupported, project)
+			}
+		}
+		if len(unsupported) == 0 {
+			targets = append(targets, solution)
+			continue
+		}
+		slog.WarnContext(
+			ctx,
+			"solution contains projects that can not be restored; restoring supported projects individually",
+			"solution", solution,
+			"skipped", unsupported)
+		targets = append(targets, supported...)
+	}
+	return targets, nil
+}
+
+// Report whether a path (relative to the sources, using forward slashes) is in
+// one of the -path-scope subtrees.  Scopes are directory patterns as for
+// [path.Match], optionally ending in "/**".
+func inPathScope(name string, scopes []string) bool {
+	for _, scope := range scopes {
+		scope = strings.TrimSuffix(strings.TrimSuffix(scope, "**"), "/")
+		if scope == "" {
+			return true
+		}
+		for dir := name; dir != "." && dir != "/"; dir = path.Dir(dir) {
+			if matched, _ := path.Match(scope, dir); matched {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// Restrict the restore targets to the projects in the -path-scope subtrees.
+// Solutions with projects both inside and outside of them are replaced by
+// their projects inside.
+func scopeTargets(ctx context.Context, srcDir string, targets []string) ([]string, error) {
+	opts := optionsFrom(ctx)
+	var scoped []string
+	for _, target := range targets {
+		projects, err := targetProjects(srcDir, target)
+		if err != nil {
+			return nil, err
+		}
+		var inside []string
+		for _, project := range projects {
+			if inPathScope(project, opts.pathScopes) {
+				inside = append(inside, project)
+			}
+		}
+		switch {
+		case len(inside) == 0:
+			slog.DebugContext(ctx, "skipping target outside of path scope", "target", target)
+		case len(inside) == len(projects):
+			scoped = append(scoped, target)
+		default:
+			slog.InfoContext(ctx, "solution has projects outside of path scope; restoring the projects inside individually", "solution", target, "projects", inside)
+			scoped = append(scoped, inside...)
+		}
+	}
+	slog.InfoContext(ctx, "restricted targets to path scope", "scopes", opts.pathScopes, "targets", scoped)
+	return scoped, nil
+}
+
+// Find the supported projects in srcDir, for sources without solutions. The
+// paths are relative to srcDir, using forward slashes.
+func findProjects(srcDir string) ([]string, error) {
+	return findFiles(srcDir, supportedProjectExts)
+}
+
+// Find the solutions in srcDir, relative to srcDir and using forward slashes.
+func findSolutions(srcDir string) ([]string, error) {
+	return findFiles(srcDir, []string{".sln"})
+}
+
+// Find the files in srcDir with the given extensions, relative to srcDir and
+// using forward slashes.
+func findFiles(srcDir string, exts []string) ([]string, error) {
+	var projects []string
+	err := filepath.WalkDir(srcDir, func(name string, d fs.DirEntry, err error) error {
+		if err != nil || d.IsDir() {
+			return err
+		}
+		if slices.Contains(exts, strings.ToLower(filepath.Ext(name))) {
+			rel, err := filepath.Rel(srcDir, name)
+			if err != nil {
+				return err
+			}
+			projects = append(projects, filepath.ToSlash(rel))
+		}
+		return nil
+	})
+	return projects, err
+}
+
+// Get the supported projects (relative to srcDir) of a restore target, which
+// may be either a solution or a project.
+func targetProjects(srcDir, target string) ([]string, error) {
+	if strings.ToLower(path.Ext(target)) != ".sln" {
+		return []string{target}, nil
+	}
+	projects, err := solutionProjects(filepath.Join(srcDir, target))
+	if err != nil {
+		return nil, fmt.Errorf("failed to read solution %s: %w", target, err)
+	}
+	var result []string
+	for _, project := range projects {
+		if slices.Contains(supportedProjectExts, strings.ToLower(path.Ext(project))) {
+			result = append(result, path.Join(path.Dir(target), project))
+		}
+	}
+	return result, nil
+}
+
+// Matches project file contents indicating that the project creates NuGet
+// packages using tooling that may need additional packages.
+var packProjectPattern = regexp.MustCompile(
+	`(?i)<PackAsTool>\s*true\s*</PackAsTool>|` +
+		`<GeneratePackageOnBuild>\s*true\s*</GeneratePackageOnBuild>|` +
+		`<PackageReference\s+Include="NuGet\.Build\.Tasks\.Pack"`)
+
+// Check if the project at the given path creates NuGet packages.
+func isPackProject(projectPath string) (bool, error) {
+	buf, err := os.ReadFile(projectPath)
+	if err != nil {
+		return false, fmt.Errorf("failed to read project %s: %w", projectPath, err)
+	}
+	return packProjectPattern.Match(buf), nil
+}
+
+// Find the lock file of a project (relative to srcDir), returning an empty
+// string if the project does not have one.
+func projectLockFile(srcDir, project string) (string, error) {
+	name := strings.TrimSuffix(path.Base(project), path.Ext(project))
+	for _, candidate := range []string{"packages." + name + ".lock.json", "packages.lock.json"} {
+		lockFile := path.Join(path.Dir(project), candidate)
+		if _, err := os.Stat(filepath.Join(srcDir, lockFile)); err == nil {
+			return lockFile, nil
+		} else if !errors.Is(err, fs.ErrNotExist) {
+			return "", err
+		}
+	}
+	return "", nil
+}
+
+// Report which projects of the restore targets have lock files.
+func lockFileCoverage(ctx context.Context, srcDir string, targets []string) ([]manifestProject, error) {
+	opts := optionsFrom(ctx)
+	var projects []manifestProject
+	for _, target := range targets {
+		paths, err := targetProjects(srcDir, target)
+		if err != nil {
+			return nil, err
+		}
+		for _, project := range paths {
+			lockFile, err := projectLockFile(srcDir, project)
+			if err != nil {
+				return nil, fmt.Errorf("failed to check lock file for %s: %w", project, err)
+			}
+			if lockFile == "" {
+				slog.WarnContext(ctx, "project has no lock file", "project", project)
+			} else {
+				slog.DebugContext(ctx, "found lock file", "project", project, "lock file", lockFile)
+			}
+			projects = append(projects, manifestProject{Path: project, LockFile: lockFile})
+		}
+	}
+	locked := 0
+	for _, project := range projects {
+		if project.LockFile != "" {
+			locked++
+		}
+	}
+	slog.InfoContext(ctx, "lock file coverage", "projects", len(projects), "locked", locked)
+	if opts.requireLockFiles && locked < len(projects) {
+		return nil, fmt.Errorf("%d of %d projects do not have lock files", len(projects)-locked, len(projects))
+	}
+	return projects, nil
+}
+
+// MSBuild properties that disable tasks needing git metadata, keyed by the
+// (prefix of the) package that provides the task.
+var gitTaskProperties = []struct {
+	pkg        string
+	properties []string
+}{
+	{"Microsoft.SourceLink.", []string{"EnableSourceLink=false", "EnableSourceControlManagerQueries=false"}},
+	{"GitVersion.MsBuild", []string{"DisableGitVersionTask=true"}},
+	{"GitVersionTask", []string{"DisableGitVersionTask=true"}},
+	{"Nerdbank.GitVersioning", []string{"NBGV_GitEngine=Disabled"}},
+	{"MinVer", []string{"MinVerSkip=true"}},
+}
+
+// Matches package references, capturing the package ID.
+var packageReferencePattern = regexp.MustCompile(`(?i)<(?:PackageReference|GlobalPackageReference)\s+Include="([^"]+)"`)
+
+// Find packages providing MSBuild tasks that need git metadata in the sources,
+// returning the MSBuild properties that disable them.
+func detectGitTasks(ctx context.Context, srcDir string) ([]string, error) {
+	var properties []string
+	err := filepath.WalkDir(srcDir, func(path string, d fs.DirEntry, err error) error {
+		if err != nil || d.IsDir() {
+			return err
+		}
+		switch strings.ToLower(filepath.Ext(path)) {
+		case ".csproj", ".fsproj", ".vbproj", ".props", ".targets":
+		default:
+			return nil
+		}
+		buf, err := os.ReadFile(path)
+		if err != nil {
+			return err
+		}
+		for _, match := range packageReferencePattern.FindAllSubmatch(buf, -1) {
+			for _, task := range gitTaskProperties {
+				if strings.HasPrefix(string(match[1]), task.pkg) {
+					rel, _ := filepath.Rel(srcDir, path)
+					slog.InfoContext(ctx, "found package with tasks that need git", "package", string(match[1]), "file", rel)
+					properties = append(properties, task.properties...)
+				}
+			}
+		}
+		return nil
+	})
+	slices.Sort(properties)
+	return slices.Compact(properties), err
+}
@@ -0,0 +1,93 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"log/slog"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+)
+
+// systemPackage maps package IDs to the distribution package providing them.
+type systemPackage struct {
+	pattern    string // package ID, possibly with wildcards as for [path.Match]
+	providedBy string
+}
+
+// manifestExclusion is a package left out of the output because the
+// distribution provides it.
+type manifestExclusion struct {
+	ID         string `json:"id"`
+	Version    string `json:"version"`
+	ProvidedBy string `json:"providedBy"` // the distribution package
+}
+
+// Read a -system-packages file: each line holds a package ID (which may contain
+// wildcards) and the distribution package providing it, separated by white
+// space. Empty lines and lines starting with # are ignored.
+func readSystemPackages(name string) ([]systemPackage, error) {
+	file, err := os.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+	var packages []systemPackage
+	scanner := bufio.NewScanner(file)
+	for line := 1; scanner.Scan(); line++ {
+		text := strings.TrimSpace(scanner.Text())
+		if text == "" || strings.HasPrefix(text, "#") {
+			continue
+		}
+		fields := strings.Fields(text)
+		if len(fields) != 2 {
+			return nil, fmt.Errorf("%s:%d: expected a package ID and the package providing it", name, line)
+		}
+		pattern := strings.ToLower(fields[0])
+		if _, err := path.Match(pattern, ""); err != nil {
+			return nil, fmt.Errorf("%s:%d: invalid pattern %s: %w", name, line, fields[0], err)
+		}
+		packages = append(packages, systemPackage{pattern: pattern, providedBy: fields[1]})
+	}
+	return packages, scanner.Err()
+}
+
+// Remove the packages the distribution provides (given by -system-packages)
+// from outDir, returning them so that they can be recorded in the manifest.
+// The directory of a package is removed too once no version is left.
+func excludeSystemPackages(ctx context.Context, outDir string) ([]manifestExclusion, error) {
+	opts := optionsFrom(ctx)
+	systemPackages, err := readSystemPackages(opts.systemPackages)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read system packages: %w", err)
+	}
+	packages, err := listPackages(outDir)
+	if err != nil {
+		return nil, err
+	}
+	var excluded []manifestExclusion
+	for _, pkg := range packages {
+		for _, system := range systemPackages {
+			if matched, _ := path.Match(system.pattern, strings.ToLower(pkg.ID)); !matched {
+				continue
+			}
+			slog.InfoContext(ctx, "excluding package provided by the distribution", "package", pkg.ID, "version", pkg.Version, "provided by", system.providedBy)
+			if err := os.RemoveAll(filepath.Join(outDir, pkg.ID, pkg.Version)); err != nil {
+				return nil, err
+			}
+			idDir := filepath.Join(outDir, pkg.ID)
+			if entries, err := os.ReadDir(idDir); err != nil {
+				return nil, err
+			} else if len(entries) == 0 {
+				if err := os.Remove(idDir); err != nil {
+					return nil, err
+				}
+			}
+			excluded = append(excluded, manifestExclusion{ID: pkg.ID, Version: pkg.Version, ProvidedBy: system.providedBy})
+			break
+		}
+	}
+	return excluded, nil
+}
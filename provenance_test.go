@@ -0,0 +1,35 @@
+package main
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestExcludeSystemPackages(t *testing.T) {
+	outDir, listDir := t.TempDir(), t.TempDir()
+	list := filepath.Join(listDir, "system-packages")
+	if err := os.WriteFile(list, []byte("# targeting packs\nmicrosoft.netcore.app.ref dotnet-targeting-pack-8.0\nsystem.* dotnet-runtime-8.0\n"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	writeFiles(t, outDir,
+		"microsoft.netcore.app.ref/8.0.0/microsoft.netcore.app.ref.8.0.0.nupkg",
+		"system.memory/4.5.0/system.memory.4.5.0.nupkg",
+		"system.memory/4.5.5/system.memory.4.5.5.nupkg",
+		"newtonsoft.json/13.0.3/newtonsoft.json.13.0.3.nupkg",
+	)
+	ctx := withOptions(context.Background(), testOptions(t, "-system-packages", list))
+	excluded, err := excludeSystemPackages(ctx, outDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(excluded) != 3 {
+		t.Errorf("excluded = %v, want 3 packages", excluded)
+	}
+	assertRemoved(t,
+		filepath.Join(outDir, "microsoft.netcore.app.ref"),
+		filepath.Join(outDir, "system.memory"),
+	)
+	assertExists(t, filepath.Join(outDir, "newtonsoft.json/13.0.3/newtonsoft.json.13.0.3.nupkg"))
+}
@@ -0,0 +1,319 @@
+package main
+
+import (
+	"context"
+	"crypto/sha512"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hash"
+	"io"
+	"io/fs"
+	"log/slog"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"regexp"
+	"slices"
+	"strings"
+	"sync"
+)
+
+// nugetProxy is a HTTP server that forwards NuGet V3 API requests, rewriting
+// URLs in JSON responses so that all further requests also go through the
+// proxy. Every response is recorded so that all downloads can be attributed.
+//
+// Requests are of the form <baseURL>/<host>/<path>, and are forwarded to
+// https://<host>/<path>.
+type nugetProxy struct {
+	baseURL  string // URL the proxy is reachable at from the container
+	server   *http.Server
+	listener net.Listener
+
+	recordDir string // if set, save responses here
+	replayDir string // if set, serve saved responses instead of forwarding
+
+	mu           sync.Mutex
+	allowedHosts map[string]bool // hosts that may be forwarded to
+	fetches      []proxyFetch
+}
+
+// proxyFetch records a single response served by the proxy.
+type proxyFetch struct {
+	URL    string `json:"url"`
+	Status int    `json:"status"`
+	Size   int64  `json:"size"`
+	SHA512 string `json:"sha512"` // base64, as used in .nupkg.sha512 files
+}
+
+// Matches URLs to rewrite in JSON responses, capturing the host name.
+var proxyURLPattern = regexp.MustCompile(`https://([A-Za-z0-9.-]+)/`)
+
+// Start a proxy listening on the given address, forwarding to the given
+// upstream NuGet service index. Responses are recorded into, or replayed
+// from, the given directories if they are not empty.
+func startNugetProxy(ctx context.Context, address, upstream, recordDir, replayDir string) (*nugetProxy, error) {
+	upstreamURL, err := url.Parse(upstream)
+	if err != nil {
+		return nil, fmt.Errorf("invalid upstream %s: %w", upstream, err)
+	}
+	if upstreamURL.Scheme != "https" {
+		return nil, fmt.Errorf("upstream %s is not a https URL", upstream)
+	}
+	listener, err := net.Listen("tcp", address)
+	if err != nil {
+		return nil, fmt.Errorf("failed to listen for proxy: %w", err)
+	}
+	p := &nugetProxy{
+		baseURL:      "http://" + listener.Addr().String(),
+		listener:     listener,
+		recordDir:    recordDir,
+		replayDir:    replayDir,
+		allowedHosts: map[string]bool{upstreamURL.Host: true},
+	}
+	p.server = &http.Server{
+		Handler:     p,
+		BaseContext: func(net.Listener) context.Context { return ctx },
+	}
+	go func() {
+		if err := p.server.Serve(listener); err != nil && !errors.Is(err, http.ErrServerClosed) {
+			slog.ErrorContext(ctx, "proxy failed", "error", err)
+		}
+	}()
+	slog.InfoContext(ctx, "started NuGet proxy", "address", p.baseURL, "upstream", upstream)
+	return p, nil
+}
+
+// The URL of the upstream service index, as seen through the proxy.
+func (p *nugetProxy) sourceURL(upstream string) string {
+	return proxyURLPattern.ReplaceAllString(upstream, p.baseURL+"/$1/")
+}
+
+func (p *nugetProxy) close() error {
+	return p.server.Close()
+}
+
+// The responses served by the proxy so far.
+func (p *nugetProxy) recorded() []proxyFetch {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return append([]proxyFetch(nil), p.fetches...)
+}
+
+func (p *nugetProxy) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	host, rest, _ := strings.Cut(strings.TrimPrefix(r.URL.Path, "/"), "/")
+	// The path is decoded and not cleaned, and ends up in file names when
+	// recording or replaying, so it must not leave the host's directory.
+	if !filepath.IsLocal(host) || !filepath.IsLocal(rest) || slices.Contains(strings.Split(rest, "/"), "..") {
+		slog.WarnContext(ctx, "proxy refused request with unsafe path", "path", r.URL.Path)
+		http.Error(w, "bad request", http.StatusBadRequest)
+		return
+	}
+	p.mu.Lock()
+	allowed := p.allowedHosts[host]
+	p.mu.Unlock()
+	if !allowed {
+		slog.WarnContext(ctx, "proxy refused request to unknown host", "host", host)
+		http.Error(w, "forbidden", http.StatusForbidden)
+		return
+	}
+	target := &url.URL{Scheme: "https", Host: host, Path: "/" + rest, RawQuery: r.URL.RawQuery}
+	slog.DebugContext(ctx, "proxying request", "url", target)
+
+	var resp *proxyResponse
+	var err error
+	if p.replayDir != "" {
+		resp, err = p.replay(target)
+	} else {
+		resp, err = p.fetch(ctx, r.Method, target)
+	}
+	if err != nil {
+		slog.ErrorContext(ctx, "proxy request failed", "url", target, "error", err)
+		http.Error(w, err.Error(), http.StatusBadGateway)
+		return
+	}
+	defer resp.body.Close()
+
+	hasher := sha512.New()
+	var body io.Reader = io.TeeReader(resp.body, hasher)
+	size := int64(-1)
+	if strings.Contains(resp.ContentType, "json") {
+		buf, err := io.ReadAll(body)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadGateway)
+			return
+		}
+		size = int64(len(buf))
+		body = strings.NewReader(p.rewrite(string(buf)))
+	}
+	if resp.ContentType != "" {
+		w.Header().Set("Content-Type", resp.ContentType)
+	}
+	w.WriteHeader(resp.Status)
+	n, err := io.Copy(w, body)
+	if err != nil {
+		slog.ErrorContext(ctx, "failed to forward response", "url", target, "error", err)
+	}
+	if size < 0 {
+		size = n
+	}
+	p.record(target.String(), resp.Status, size, hasher)
+}
+
+// proxyResponse is a response to be served by the proxy.
+type proxyResponse struct {
+	Status      int    `json:"status"`
+	ContentType string `json:"contentType"`
+	body        io.ReadCloser
+}
+
+// The path of the fixture file for the given URL in the record/replay
+// directory; the metadata is stored in a file with a .meta.json suffix.  URLs
+// whose fixture would be outside the directory are refused.
+func fixturePath(dir string, target *url.URL) (string, error) {
+	name := filepath.Join(dir, target.Host, filepath.FromSlash(target.Path))
+	if strings.HasSuffix(target.Path, "/") {
+		name = filepath.Join(name, "_index")
+	}
+	if target.RawQuery != "" {
+		name += "@" + url.QueryEscape(target.RawQuery)
+	}
+	if rel, err := filepath.Rel(dir, name); err != nil || !filepath.IsLocal(rel) || !strings.Contains(rel, string(filepath.Separator)) {
+		return "", fmt.Errorf("%w: %s", errUnsafePath, target)
+	}
+	return name, nil
+}
+
+// Fetch a URL from upstream, recording the response if requested.
+func (p *nugetProxy) fetch(ctx context.Context, method string, target *url.URL) (*proxyResponse, error) {
+	record := p.recordDir != "" && method == http.MethodGet
+	var name string
+	if record {
+		var err error
+		if name, err = fixturePath(p.recordDir, target); err != nil {
+			return nil, err
+		}
+	}
+	req, err := http.NewRequestWithContext(ctx, method, target.String(), nil)
+	if err != nil {
+		return nil, err
+	}
+	httpResp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	resp := &proxyResponse{
+		Status:      httpResp.StatusCode,
+		ContentType: httpResp.Header.Get("Content-Type"),
+		body:        httpResp.Body,
+	}
+	if !record {
+		return resp, nil
+	}
+	if err := os.MkdirAll(filepath.Dir(name), 0o755); err != nil {
+		httpResp.Body.Close()
+		return nil, err
+	}
+	meta, err := json.Marshal(resp)
+	if err != nil {
+		httpResp.Body.Close()
+		return nil, err
+	}
+	if err := os.WriteFile(name+".meta.json", meta, 0o644); err != nil {
+		httpResp.Body.Close()
+		return nil, err
+	}
+	file, err := os.Create(name)
+	if err != nil {
+		httpResp.Body.Close()
+		return nil, err
+	}
+	resp.body = &recordingReader{Reader: io.TeeReader(httpResp.Body, file), closers: []io.Closer{httpResp.Body, file}}
+	return resp, nil
+}
+
+// recordingReader is a reader that closes multiple underlying closers.
+type recordingReader struct {
+	io.Reader
+	closers []io.Closer
+}
+
+func (r *recordingReader) Close() error {
+	var errs []error
+	for _, closer := range r.closers {
+		errs = append(errs, closer.Close())
+	}
+	return errors.Join(errs...)
+}
+
+// Serve a previously recorded response; responses that were not recorded are
+// served as not found.
+func (p *nugetProxy) replay(target *url.URL) (*proxyResponse, error) {
+	name, err := fixturePath(p.replayDir, target)
+	if err != nil {
+		return nil, err
+	}
+	meta, err := os.ReadFile(name + ".meta.json")
+	if errors.Is(err, fs.ErrNotExist) {
+		return &proxyResponse{
+			Status:      http.StatusNotFound,
+			ContentType: "text/plain",
+			body:        io.NopCloser(strings.NewReader("not recorded\n")),
+		}, nil
+	} else if err != nil {
+		return nil, err
+	}
+	var resp proxyResponse
+	if err := json.Unmarshal(meta, &resp); err != nil {
+		return nil, fmt.Errorf("invalid fixture %s: %w", name, err)
+	}
+	if resp.body, err = os.Open(name); err != nil {
+		return nil, err
+	}
+	return &resp, nil
+}
+
+// Rewrite URLs in a JSON response to go through the proxy, allowing requests
+// to the hosts referenced.
+func (p *nugetProxy) rewrite(body string) string {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return proxyURLPattern.ReplaceAllStringFunc(body, func(match string) string {
+		host := proxyURLPattern.FindStringSubmatch(match)[1]
+		p.allowedHosts[host] = true
+		return p.baseURL + "/" + host + "/"
+	})
+}
+
+func (p *nugetProxy) record(url string, status int, size int64, hasher hash.Hash) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.fetches = append(p.fetches, proxyFetch{
+		URL:    url,
+		Status: status,
+		Size:   size,
+		SHA512: base64.StdEncoding.EncodeToString(hasher.Sum(nil)),
+	})
+}
+
+// Write a NuGet configuration file into dir that uses the proxy as the only
+// package source.
+func (p *nugetProxy) writeNugetConfig(dir, upstream string) error {
+	config := fmt.Sprintf(`<?xml version="1.0" encoding="utf-8"?>
+<configuration>
+  <packageSources>
+    <clear />
+    <add key="proxy" value="%s" allowInsecureConnections="true" />
+  </packageSources>
+</configuration>
+`, p.sourceURL(upstream))
+	return os.WriteFile(filepath.Join(dir, "NuGet.Config"), []byte(config), 0o644)
+}
@@ -0,0 +1,75 @@
+package main
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestFixturePath(t *testing.T) {
+	dir := t.TempDir()
+	for _, target := range []string{
+		"https://api.nuget.org/v3/index.json",
+		"https://api.nuget.org/v3-flatcontainer/foo/",
+		"https://api.nuget.org/query?q=..%2F..",
+	} {
+		u, _ := url.Parse(target)
+		if _, err := fixturePath(dir, u); err != nil {
+			t.Errorf("fixturePath(%s) = %v", target, err)
+		}
+	}
+	for _, target := range []*url.URL{
+		{Scheme: "https", Host: "api.nuget.org", Path: "/../../etc/passwd"},
+		{Scheme: "https", Host: "..", Path: "/x"},
+		{Scheme: "https", Host: "api.nuget.org", Path: "/.."},
+	} {
+		if name, err := fixturePath(dir, target); !errors.Is(err, errUnsafePath) {
+			t.Errorf("fixturePath(%s) = %s, %v, want %v", target, name, err, errUnsafePath)
+		}
+	}
+}
+
+// Requests with an encoded .. in their path must neither write nor read files
+// outside the record or replay directory.
+func TestProxyEncodedDotDot(t *testing.T) {
+	paths := []string{
+		"/api.nuget.org/%2e%2e/%2e%2e/outside",
+		"/api.nuget.org/v3/%2E%2E/%2E%2E/%2E%2E/outside",
+		"/api.nuget.org/..%2f..%2foutside",
+		"/%2e%2e/outside",
+	}
+	for _, mode := range []string{"record", "replay"} {
+		t.Run(mode, func(t *testing.T) {
+			parent := t.TempDir()
+			dir := filepath.Join(parent, "fixtures")
+			writeFiles(t, parent, "outside", "outside.meta.json")
+			if err := os.WriteFile(filepath.Join(parent, "outside.meta.json"), []byte(`{"status": 200}`), 0o644); err != nil {
+				t.Fatal(err)
+			}
+			p := &nugetProxy{allowedHosts: map[string]bool{"api.nuget.org": true, "..": true}}
+			if mode == "record" {
+				p.recordDir = dir
+			} else {
+				p.replayDir = dir
+			}
+			for _, path := range paths {
+				w := httptest.NewRecorder()
+				p.ServeHTTP(w, httptest.NewRequest(http.MethodGet, path, nil))
+				if w.Code == http.StatusOK || strings.Contains(w.Body.String(), parent) {
+					t.Errorf("GET %s = %d %q", path, w.Code, w.Body.String())
+				}
+			}
+			if buf, err := os.ReadFile(filepath.Join(parent, "outside")); err != nil || string(buf) != filepath.Join(parent, "outside") {
+				t.Errorf("file outside the directory changed: %q, %v", buf, err)
+			}
+			if len(p.recorded()) != 0 {
+				t.Errorf("recorded %v", p.recorded())
+			}
+		})
+	}
+}
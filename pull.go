@@ -0,0 +1,118 @@
+//go:build !nodocker
+
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"time"
+
+	"github.com/docker/docker/api/types/image"
+	"github.com/docker/docker/client"
+	"github.com/docker/docker/pkg/jsonmessage"
+)
+
+// Make sure the SDK image is available, pulling it according to the pull
+// policy. Its tag is checked against the registry every time; an image that
+// is only available locally is used with a warning.
+func ensureImage(ctx context.Context, dc *client.Client) error {
+	opts := optionsFrom(ctx)
+	ref := sdkImage(ctx)
+	tagErr := checkTag(ctx, ref)
+	if opts.pull != pullPolicyAlways {
+		_, _, err := dc.ImageInspectWithRaw(ctx, ref)
+		if err == nil {
+			if tagErr != nil {
+				slog.WarnContext(ctx, "using a local image that is not in the registry", "image", ref, "error", tagErr)
+			}
+			return nil
+		}
+		if !client.IsErrNotFound(err) {
+			return fmt.Errorf("failed to inspect image %s: %w", ref, err)
+		}
+		if opts.pull == pullPolicyNever {
+			return fmt.Errorf("image %s is not available and pulling is disabled", ref)
+		}
+	}
+	if tagErr != nil {
+		return tagErr
+	}
+	return pullImage(ctx, dc, ref)
+}
+
+const (
+	// How many times to try pulling an image that stalls.
+	pullAttempts = 3
+	// How long to wait for pull progress before retrying.
+	pullStallTimeout = 2 * time.Minute
+)
+
+// errPullStalled is the cause when a pull is interrupted for making no progress.
+var errPullStalled = errors.New("no progress")
+
+// Pull an image, retrying if it stalls; layers that were already downloaded are
+// kept, so retries resume where they left off.
+func pullImage(ctx context.Context, dc *client.Client, ref string) error {
+	opts := optionsFrom(ctx)
+	if opts.pullTimeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, opts.pullTimeout)
+		defer cancel()
+	}
+	var err error
+	for attempt := 1; attempt <= pullAttempts; attempt++ {
+		var retry bool
+		if retry, err = pullImageOnce(ctx, dc, ref); err == nil || !retry || ctx.Err() != nil {
+			break
+		}
+		slog.WarnContext(ctx, "pulling image failed", "image", ref, "attempt", attempt, "error", err)
+	}
+	if errors.Is(ctx.Err(), context.DeadlineExceeded) {
+		return fmt.Errorf("timed out pulling image %s after %s: %w", ref, opts.pullTimeout, err)
+	}
+	return err
+}
+
+// Pull an image once, logging progress. Returns whether it is worth retrying
+// on failure.
+func pullImageOnce(ctx context.Context, dc *client.Client, ref string) (bool, error) {
+	ctx, cancel := context.WithCancelCause(ctx)
+	defer cancel(nil)
+	slog.InfoContext(ctx, "pulling image", "image", ref)
+	reader, err := dc.ImagePull(ctx, ref, image.PullOptions{})
+	if err != nil {
+		return false, fmt.Errorf("failed to pull image %s: %w", ref, err)
+	}
+	defer reader.Close()
+	stall := time.AfterFunc(pullStallTimeout, func() { cancel(errPullStalled) })
+	defer stall.Stop()
+	decoder := json.NewDecoder(reader)
+	for {
+		var message jsonmessage.JSONMessage
+		if err := decoder.Decode(&message); errors.Is(err, io.EOF) {
+			break
+		} else if err != nil {
+			if cause := context.Cause(ctx); cause != nil {
+				err = cause
+			}
+			return true, fmt.Errorf("failed to read pull progress for %s: %w", ref, err)
+		}
+		stall.Reset(pullStallTimeout)
+		if message.Error != nil {
+			return false, fmt.Errorf("failed to pull image %s: %w", ref, message.Error)
+		}
+		switch {
+		case message.Progress != nil && message.Progress.Total > 0:
+			slog.DebugContext(ctx, message.Status, "layer", message.ID, "current", message.Progress.Current, "total", message.Progress.Total)
+		case message.ID != "":
+			slog.DebugContext(ctx, message.Status, "layer", message.ID)
+		default:
+			slog.InfoContext(ctx, message.Status, "image", ref)
+		}
+	}
+	return false, nil
+}
@@ -0,0 +1,197 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"regexp"
+	"slices"
+	"strings"
+)
+
+// Matches the parameters of a WWW-Authenticate: Bearer header.
+var bearerParamPattern = regexp.MustCompile(`(\w+)="([^"]*)"`)
+
+// Matches the next page in a Link header.
+var nextLinkPattern = regexp.MustCompile(`<([^>]+)>;\s*rel="next"`)
+
+// Split an image reference (without tag or digest) into the registry host and
+// the repository path in it.
+func splitRepository(repository string) (string, string) {
+	host, name, ok := strings.Cut(repository, "/")
+	if !ok || !strings.ContainsAny(host, ".:") && host != "localhost" {
+		host, name = "docker.io", repository
+	}
+	if host != "docker.io" {
+		return host, name
+	}
+	// Official images on Docker Hub are in the library namespace.
+	if !strings.Contains(name, "/") {
+		name = "library/" + name
+	}
+	return "registry-1.docker.io", name
+}
+
+// The repository of an image reference, without its tag or digest.
+func imageRepository(ref string) string {
+	ref, _, _ = strings.Cut(ref, "@")
+	if i := strings.LastIndex(ref, ":"); i > strings.LastIndex(ref, "/") {
+		ref = ref[:i]
+	}
+	return ref
+}
+
+// The tag of an image reference, or an empty one if it is pinned by digest.
+func imageTag(ref string) string {
+	if strings.Contains(ref, "@") {
+		return ""
+	}
+	if i := strings.LastIndex(ref, ":"); i > strings.LastIndex(ref, "/") {
+		return ref[i+1:]
+	}
+	return "latest"
+}
+
+// List the tags of a repository in a container registry, with an anonymous
+// token if the registry asks for one.
+func listTags(ctx context.Context, repository string) ([]string, error) {
+	host, name := splitRepository(repository)
+	next := "https://" + host + "/v2/" + name + "/tags/list"
+	var token string
+	var tags []string
+	for next != "" {
+		req, err := http.NewRequestWithContext(ctx, http.MethodGet, next, nil)
+		if err != nil {
+			return nil, err
+		}
+		if token != "" {
+			req.Header.Set("Authorization", "Bearer "+token)
+		}
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			return nil, err
+		}
+		if resp.StatusCode == http.StatusUnauthorized && token == "" {
+			resp.Body.Close()
+			if token, err = registryToken(ctx, resp.Header.Get("WWW-Authenticate")); err != nil {
+				return nil, fmt.Errorf("failed to authenticate to %s: %w", host, err)
+			}
+			continue
+		}
+		var page struct {
+			Tags []string `json:"tags"`
+		}
+		err = json.NewDecoder(resp.Body).Decode(&page)
+		resp.Body.Close()
+		if resp.StatusCode != http.StatusOK {
+			return nil, fmt.Errorf("failed to list tags of %s: %s", repository, resp.Status)
+		}
+		if err != nil {
+			return nil, fmt.Errorf("invalid tag list for %s: %w", repository, err)
+		}
+		tags = append(tags, page.Tags...)
+		next = ""
+		if match := nextLinkPattern.FindStringSubmatch(resp.Header.Get("Link")); match != nil {
+			link, err := req.URL.Parse(match[1])
+			if err != nil {
+				return nil, err
+			}
+			next = link.String()
+		}
+	}
+	slices.Sort(tags)
+	return tags, nil
+}
+
+// Get an anonymous token for the realm in a WWW-Authenticate: Bearer header.
+func registryToken(ctx context.Context, challenge string) (string, error) {
+	scheme, params, _ := strings.Cut(challenge, " ")
+	if !strings.EqualFold(scheme, "Bearer") {
+		return "", fmt.Errorf("unsupported authentication %q", challenge)
+	}
+	values := url.Values{}
+	var realm string
+	for _, match := range bearerParamPattern.FindAllStringSubmatch(params, -1) {
+		if match[1] == "realm" {
+			realm = match[2]
+		} else {
+			values.Set(match[1], match[2])
+		}
+	}
+	if realm == "" {
+		return "", fmt.Errorf("no realm in %q", challenge)
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, realm+"?"+values.Encode(), nil)
+	if err != nil {
+		return "", err
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("token request failed: %s", resp.Status)
+	}
+	var body struct {
+		Token       string `json:"token"`
+		AccessToken string `json:"access_token"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&body); err != nil {
+		return "", err
+	}
+	if body.Token == "" {
+		return body.AccessToken, nil
+	}
+	return body.Token, nil
+}
+
+// The repository the SDK images are taken from: that of -image, or the
+// default one.
+func sdkRepository(ctx context.Context) string {
+	if image := optionsFrom(ctx).image; image != "" {
+		return imageRepository(image)
+	}
+	return defaultImageRepository
+}
+
+// Print the tags of the SDK image repository (the list-tags command).
+func runListTags(ctx context.Context, w io.Writer) error {
+	tags, err := listTags(ctx, sdkRepository(ctx))
+	if err != nil {
+		return err
+	}
+	for _, tag := range tags {
+		fmt.Fprintln(w, tag)
+	}
+	return nil
+}
+
+// Matches the tags naming a dotnet version, such as 8.0.
+var versionTagPattern = regexp.MustCompile(`^\d+\.\d+$`)
+
+// Check that the tag of the SDK image (-tag, or that of -image) exists in its
+// repository, to fail with the versions that are available rather than an
+// obscure pull error. Failing to list the tags is not an error, as pulling may
+// still work.
+func checkTag(ctx context.Context, ref string) error {
+	tag := imageTag(ref)
+	if tag == "" {
+		return nil
+	}
+	repository := imageRepository(ref)
+	tags, err := listTags(ctx, repository)
+	if err != nil {
+		slog.DebugContext(ctx, "could not list SDK image tags", "repository", repository, "error", err)
+		return nil
+	}
+	if slices.Contains(tags, tag) {
+		return nil
+	}
+	versions := slices.DeleteFunc(tags, func(tag string) bool { return !versionTagPattern.MatchString(tag) })
+	return fmt.Errorf("there is no SDK image for dotnet %s in %s; available versions: %s", tag, repository, strings.Join(versions, ", "))
+}
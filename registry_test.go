@@ -0,0 +1,50 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestImageTag(t *testing.T) {
+	for ref, want := range map[string]string{
+		"registry.suse.com/bci/dotnet-sdk:8.0": "8.0",
+		"localhost:5000/sdk":                   "latest",
+		"localhost:5000/sdk:9.0":               "9.0",
+		"sdk@sha256:0123":                      "",
+	} {
+		if got := imageTag(ref); got != want {
+			t.Errorf("imageTag(%s) = %q, want %q", ref, got, want)
+		}
+	}
+}
+
+// The tag of -image is checked in its own repository.
+func TestCheckTagCustomRepository(t *testing.T) {
+	server := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/v2/custom/sdk/tags/list" {
+			http.NotFound(w, r)
+			return
+		}
+		_, _ = w.Write([]byte(`{"tags": ["8.0", "9.0"]}`))
+	}))
+	defer server.Close()
+	transport := http.DefaultClient.Transport
+	http.DefaultClient.Transport = server.Client().Transport
+	defer func() { http.DefaultClient.Transport = transport }()
+
+	repository := strings.TrimPrefix(server.URL, "https://") + "/custom/sdk"
+	ctx := context.Background()
+	if err := checkTag(ctx, repository+":9.0"); err != nil {
+		t.Errorf("existing tag was rejected: %v", err)
+	}
+	err := checkTag(ctx, repository+":7.0")
+	if err == nil || !strings.Contains(err.Error(), "8.0, 9.0") {
+		t.Errorf("checkTag = %v, want an error listing the available versions", err)
+	}
+	if err := checkTag(ctx, repository+"@sha256:0123"); err != nil {
+		t.Errorf("image pinned by digest was checked: %v", err)
+	}
+}
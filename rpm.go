@@ -0,0 +1,96 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+)
+
+// The magic number at the start of an rpm file.
+var rpmLeadMagic = []byte{0xed, 0xab, 0xee, 0xdb}
+
+// The magic number (and version) of an rpm header structure.
+var rpmHeaderMagic = []byte{0x8e, 0xad, 0xe8, 0x01}
+
+// The size of the (obsolete) lead at the start of an rpm file.
+const rpmLeadSize = 96
+
+// Extract the source archives in a (source) rpm into outDir, returning the
+// names of the solution files. The payload is extracted into a temporary
+// directory, and any archives in it are then extracted in turn.
+func extractRPM(ctx context.Context, raw *bufio.Reader, outDir string) ([]string, error) {
+	if _, err := raw.Discard(rpmLeadSize); err != nil {
+		return nil, fmt.Errorf("failed to read lead: %w", err)
+	}
+	// The signature header is padded to a multiple of 8 bytes.
+	size, err := skipRPMHeader(raw)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read signature: %w", err)
+	}
+	if _, err := raw.Discard(int((8 - size%8) % 8)); err != nil {
+		return nil, fmt.Errorf("failed to read signature: %w", err)
+	}
+	if _, err := skipRPMHeader(raw); err != nil {
+		return nil, fmt.Errorf("failed to read header: %w", err)
+	}
+
+	payloadDir, err := os.MkdirTemp("", "obs-service-dotnet-packages-rpm-*")
+	if err != nil {
+		return nil, err
+	}
+	defer os.RemoveAll(payloadDir)
+	if _, err := extractStream(ctx, raw, payloadDir); err != nil {
+		return nil, fmt.Errorf("failed to extract payload: %w", err)
+	}
+	entries, err := os.ReadDir(payloadDir)
+	if err != nil {
+		return nil, err
+	}
+	var solutions []string
+	found := false
+	for _, entry := range entries {
+		isArchive := slices.ContainsFunc(sourceArchiveExts, func(ext string) bool {
+			return strings.HasSuffix(entry.Name(), ext)
+		})
+		if entry.IsDir() || !isArchive {
+			slog.DebugContext(ctx, "ignoring file in rpm", "name", entry.Name())
+			continue
+		}
+		found = true
+		names, err := extractArchive(ctx, filepath.Join(payloadDir, entry.Name()), outDir)
+		if err != nil {
+			return nil, err
+		}
+		solutions = append(solutions, names...)
+	}
+	if !found {
+		return nil, fmt.Errorf("no source archives found")
+	}
+	return solutions, nil
+}
+
+// Skip over an rpm header structure, returning its size.
+func skipRPMHeader(r io.Reader) (int64, error) {
+	var intro [16]byte
+	if _, err := io.ReadFull(r, intro[:]); err != nil {
+		return 0, err
+	}
+	if !bytes.Equal(intro[:4], rpmHeaderMagic) {
+		return 0, fmt.Errorf("invalid header magic %x", intro[:4])
+	}
+	entries := binary.BigEndian.Uint32(intro[8:12])
+	dataSize := binary.BigEndian.Uint32(intro[12:16])
+	size := int64(entries)*16 + int64(dataSize)
+	if _, err := io.CopyN(io.Discard, r, size); err != nil {
+		return 0, err
+	}
+	return int64(len(intro)) + size, nil
+}
@@ -0,0 +1,50 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+)
+
+type containerRuntime string
+
+const (
+	containerRuntimeAuto   = "auto"
+	containerRuntimeDocker = "docker"
+	containerRuntimePodman = "podman"
+)
+
+func (r *containerRuntime) String() string {
+	if r == nil {
+		return "<nil>"
+	}
+	return string(*r)
+}
+
+func (r *containerRuntime) Set(value string) error {
+	switch value {
+	case containerRuntimeAuto, containerRuntimeDocker, containerRuntimePodman:
+		*r = containerRuntime(value)
+		return nil
+	}
+	return fmt.Errorf("invalid container runtime %s", value)
+}
+
+// The default docker socket, used to detect if docker is available.
+const dockerSocket = "/var/run/docker.sock"
+
+// Find the podman API socket, preferring the rootless one. Returns the empty
+// string if no socket is found.
+func findPodmanSocket() string {
+	var sockets []string
+	if dir := os.Getenv("XDG_RUNTIME_DIR"); dir != "" {
+		sockets = append(sockets, filepath.Join(dir, "podman", "podman.sock"))
+	}
+	sockets = append(sockets, "/run/podman/podman.sock")
+	for _, socket := range sockets {
+		if _, err := os.Stat(socket); err == nil {
+			return socket
+		}
+	}
+	return ""
+}
@@ -0,0 +1,228 @@
+package main
+
+import (
+	"encoding/xml"
+	"flag"
+	"fmt"
+	"os"
+	"slices"
+	"strconv"
+	"strings"
+)
+
+// The name of this service in _service files.
+const serviceName = "dotnet_packages"
+
+// serviceFile is the contents of an OBS _service file.
+type serviceFile struct {
+	XMLName  xml.Name       `xml:"services"`
+	Services []serviceEntry `xml:"service"`
+}
+
+type serviceEntry struct {
+	Name   string         `xml:"name,attr"`
+	Mode   string         `xml:"mode,attr"`
+	Params []serviceParam `xml:"param"`
+}
+
+type serviceParam struct {
+	Name  string `xml:"name,attr"`
+	Value string `xml:",chardata"`
+}
+
+func readServiceFile(path string) (*serviceFile, error) {
+	buf, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var result serviceFile
+	if err := xml.Unmarshal(buf, &result); err != nil {
+		return nil, fmt.Errorf("failed to parse %s: %w", path, err)
+	}
+	return &result, nil
+}
+
+// The value of a parameter of a service entry, or the empty string.
+func (e *serviceEntry) param(name string) string {
+	for _, param := range e.Params {
+		if param.Name == name {
+			return strings.TrimSpace(param.Value)
+		}
+	}
+	return ""
+}
+
+// Determine glob patterns matching the archives created by the services in a
+// _service file, from their filename, version and extension parameters.
+func serviceArchivePatterns(path string) ([]string, error) {
+	services, err := readServiceFile(path)
+	if err != nil {
+		return nil, err
+	}
+	compression := ""
+	for _, service := range services.Services {
+		if service.Name == "recompress" {
+			compression = service.param("compression")
+		}
+	}
+	var patterns []string
+	for _, service := range services.Services {
+		var extension string
+		switch service.Name {
+		case "obs_scm":
+			extension = "obscpio"
+		case "tar_scm":
+			extension = "tar"
+		case "tar":
+			extension = "tar"
+		default:
+			continue
+		}
+		if value := service.param("extension"); value != "" {
+			extension = value
+		}
+		if extension == "tar" && compression != "" && compression != "none" {
+			extension += "." + compression
+		}
+		name := service.param("filename")
+		if name == "" {
+			url := strings.TrimSuffix(service.param("url"), "/")
+			name = strings.TrimSuffix(url[strings.LastIndex(url, "/")+1:], ".git")
+		}
+		if name == "" {
+			name = "*"
+		}
+		version := service.param("version")
+		if version == "" || version == "_auto_" {
+			version = "*"
+		}
+		pattern := name + "-" + version + "." + extension
+		if !slices.Contains(patterns, pattern) {
+			patterns = append(patterns, pattern)
+		}
+	}
+	return patterns, nil
+}
+
+// Apply the parameters for this service from the given _service file to the
+// flags; options given on the command line take precedence.
+func applyServiceFile(flags *flag.FlagSet, path string) error {
+	services, err := readServiceFile(path)
+	if err != nil {
+		return err
+	}
+	explicit := make(map[string]bool)
+	flags.Visit(func(f *flag.Flag) { explicit[f.Name] = true })
+
+	found := false
+	for _, service := range services.Services {
+		if service.Name != serviceName {
+			continue
+		}
+		if found {
+			return fmt.Errorf("multiple %s services in %s", serviceName, path)
+		}
+		found = true
+		for _, param := range service.Params {
+			if explicit[param.Name] {
+				continue
+			}
+			if flags.Lookup(param.Name) == nil {
+				return fmt.Errorf("unknown parameter %q in %s", param.Name, path)
+			}
+			if err := flags.Set(param.Name, strings.TrimSpace(param.Value)); err != nil {
+				return fmt.Errorf("invalid value for parameter %q in %s: %w", param.Name, path, err)
+			}
+		}
+	}
+	if !found {
+		return fmt.Errorf("no %s service found in %s", serviceName, path)
+	}
+	return nil
+}
+
+// Convert arguments in the convention OBS uses to run services, where each
+// parameter is passed as "--name value" (including boolean ones, and possibly
+// repeated), into arguments the flag package accepts. Unknown parameters are
+// rejected with a suggestion of what may have been meant.
+func serviceArgs(flags *flag.FlagSet, args []string) ([]string, error) {
+	var result []string
+	for i := 0; i < len(args); i++ {
+		arg := args[i]
+		if arg == "--" || arg == "-" || !strings.HasPrefix(arg, "-") {
+			return append(result, args[i:]...), nil
+		}
+		name, _, hasValue := strings.Cut(strings.TrimLeft(arg, "-"), "=")
+		f := flags.Lookup(name)
+		if f == nil {
+			if name == "h" || name == "help" {
+				result = append(result, arg)
+				continue
+			}
+			return nil, unknownParameterError(flags, name)
+		}
+		result = append(result, arg)
+		if hasValue || i+1 >= len(args) {
+			continue
+		}
+		if boolFlag, ok := f.Value.(interface{ IsBoolFlag() bool }); ok && boolFlag.IsBoolFlag() {
+			if value, ok := serviceBool(args[i+1]); ok {
+				result[len(result)-1] = "--" + name + "=" + value
+				i++
+			}
+			continue
+		}
+		result = append(result, args[i+1])
+		i++
+	}
+	return result, nil
+}
+
+// Convert a boolean service parameter value into one the flag package accepts.
+func serviceBool(value string) (string, bool) {
+	switch strings.ToLower(value) {
+	case "enable", "enabled", "yes", "on":
+		return "true", true
+	case "disable", "disabled", "no", "off":
+		return "false", true
+	}
+	if _, err := strconv.ParseBool(value); err == nil {
+		return value, true
+	}
+	return "", false
+}
+
+// Describe an unknown parameter, suggesting known ones with similar names.
+func unknownParameterError(flags *flag.FlagSet, name string) error {
+	var suggestions []string
+	flags.VisitAll(func(f *flag.Flag) {
+		if strings.Contains(f.Name, name) || strings.Contains(name, f.Name) || editDistance(f.Name, name) <= 2 {
+			suggestions = append(suggestions, f.Name)
+		}
+	})
+	if len(suggestions) == 0 {
+		return fmt.Errorf("unknown parameter %q; use -help to list the parameters", name)
+	}
+	return fmt.Errorf("unknown parameter %q; did you mean %s?", name, strings.Join(suggestions, " or "))
+}
+
+// The Levenshtein distance between two strings.
+func editDistance(a, b string) int {
+	previous := make([]int, len(b)+1)
+	current := make([]int, len(b)+1)
+	for j := range previous {
+		previous[j] = j
+	}
+	for i := 1; i <= len(a); i++ {
+		current[0] = i
+		for j := 1; j <= len(b); j++ {
+			cost := 1
+			if a[i-1] == b[j-1] {
+				cost = 0
+			}
+			current[j] = min(previous[j]+1, current[j-1]+1, previous[j-1]+cost)
+		}
+		previous, current = current, previous
+	}
+	return previous[len(b)]
+}
@@ -0,0 +1,68 @@
+//go:build !nodocker
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"os"
+	"strings"
+)
+
+// Set up the restore environment as a normal run would, then start an
+// interactive shell in it for debugging.
+func runShell(ctx context.Context) error {
+	opts := optionsFrom(ctx)
+	if opts.noContainer {
+		return fmt.Errorf("the shell command requires a container")
+	}
+	if opts.srcDir == "" {
+		var err error
+		if ctx, err = locateArchive(ctx); err != nil {
+			return err
+		}
+		opts = optionsFrom(ctx)
+	}
+	srcDir, removeSrcDir, err := sourcesDir(ctx)
+	if err != nil {
+		return err
+	}
+	defer removeSrcDir()
+	ctx, targets, err := prepareSources(ctx, srcDir)
+	if err != nil {
+		return err
+	}
+	opts = optionsFrom(ctx)
+	outDir, err := os.MkdirTemp("", "obs-service-dotnet-packages-out-*")
+	if err != nil {
+		return err
+	}
+	defer os.RemoveAll(outDir)
+
+	restoreArgs, err := sourceRestoreArgs(ctx, srcDir)
+	if err != nil {
+		return err
+	}
+	feeds, err := findInTreeFeeds(ctx, srcDir)
+	if err != nil {
+		return err
+	}
+	var env *containerRestoreEnv
+	if opts.containerID != "" {
+		env, err = newAttachedRestoreEnv(ctx, srcDir, outDir)
+	} else {
+		env, err = newContainerRestoreEnv(ctx, srcDir, outDir, &manifest{})
+	}
+	if err != nil {
+		return err
+	}
+	defer env.close(ctx)
+	restoreArgs = append(restoreArgs, env.restoreArgs()...)
+	restoreArgs = append(restoreArgs, inTreeFeedArgs(env, feeds)...)
+
+	for _, target := range targets {
+		slog.InfoContext(ctx, "to restore", "command", strings.Join(restoreCommand(env, target, opts.lockedMode, restoreArgs...), " "))
+	}
+	return execInteractive(ctx, env.dc, env.containerID, "/bin/bash")
+}
@@ -0,0 +1,131 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"log/slog"
+	"os"
+	"path"
+	"path/filepath"
+	"regexp"
+	"strings"
+)
+
+// specMacroPattern matches the macros expanded in spec files: %name, %{name}
+// and %{?name}.
+var specMacroPattern = regexp.MustCompile(`%(\{\??)?([A-Za-z_][A-Za-z0-9_]*)\}?`)
+
+// Read the file name of the main source (Source or Source0) of a spec file,
+// expanding the macros defined in it. Returns the empty string if the spec
+// file has no main source.
+func specSource0(specFile string) (string, error) {
+	file, err := os.Open(specFile)
+	if err != nil {
+		return "", err
+	}
+	defer file.Close()
+	macros := make(map[string]string)
+	expand := func(value string) string {
+		// Expand repeatedly for macros defined in terms of other macros.
+		for range 10 {
+			expanded := specMacroPattern.ReplaceAllStringFunc(value, func(match string) string {
+				groups := specMacroPattern.FindStringSubmatch(match)
+				if value, ok := macros[strings.ToLower(groups[2])]; ok {
+					return value
+				}
+				if groups[1] == "{?" {
+					return ""
+				}
+				return match
+			})
+			if expanded == value {
+				break
+			}
+			value = expanded
+		}
+		return value
+	}
+	var source string
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if fields := strings.Fields(line); len(fields) >= 3 && (fields[0] == "%define" || fields[0] == "%global") {
+			macros[strings.ToLower(fields[1])] = strings.Join(fields[2:], " ")
+			continue
+		}
+		tag, value, ok := strings.Cut(line, ":")
+		if !ok || strings.ContainsAny(tag, " \t") {
+			continue
+		}
+		value = strings.TrimSpace(value)
+		switch strings.ToLower(tag) {
+		case "name", "version", "release":
+			macros[strings.ToLower(tag)] = value
+		case "source", "source0":
+			if source == "" {
+				source = value
+			}
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return "", fmt.Errorf("failed to read %s: %w", specFile, err)
+	}
+	if source == "" {
+		return "", nil
+	}
+	// The source may be a URL, possibly with a #/ fragment naming the file.
+	source = expand(source)
+	if _, fragment, ok := strings.Cut(source, "#/"); ok {
+		source = fragment
+	}
+	return path.Base(source), nil
+}
+
+// The lines marking the region of a spec file that -update-spec-provides
+// replaces with the bundled Provides.
+const (
+	specProvidesBegin = "# BEGIN dotnet-packages bundled provides"
+	specProvidesEnd   = "# END dotnet-packages bundled provides"
+)
+
+// Replace the marked region of the spec files in the current directory with
+// the Provides for the packages in the output (-update-spec-provides). As with
+// other services, the updated spec files are written to -outdir if given.
+func updateSpecProvides(ctx context.Context, m *manifest) error {
+	opts := optionsFrom(ctx)
+	specFiles, err := filepath.Glob("*.spec")
+	if err != nil {
+		return err
+	}
+	updated := 0
+	for _, specFile := range specFiles {
+		buf, err := os.ReadFile(specFile)
+		if err != nil {
+			return err
+		}
+		text := string(buf)
+		begin := strings.Index(text, specProvidesBegin+"\n")
+		if begin < 0 {
+			continue
+		}
+		start := begin + len(specProvidesBegin) + 1
+		end := strings.Index(text[start:], specProvidesEnd)
+		if end < 0 {
+			return fmt.Errorf("%s: %q without %q", specFile, specProvidesBegin, specProvidesEnd)
+		}
+		text = text[:start] + bundledProvides(m) + text[start+end:]
+		if text == string(buf) {
+			continue
+		}
+		slog.InfoContext(ctx, "updating bundled provides", "spec", specFile, "packages", len(m.Packages))
+		if err := os.WriteFile(filepath.Join(opts.outDir, specFile), []byte(text), 0o644); err != nil {
+			return err
+		}
+		updated++
+	}
+	if updated == 0 {
+		slog.InfoContext(ctx, "no spec file with outdated bundled provides", "marker", specProvidesBegin)
+	}
+	return nil
+}
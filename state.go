@@ -0,0 +1,139 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"reflect"
+	"slices"
+	"strings"
+)
+
+// Extensions of the files in the sources that determine what is restored.
+var restoreInputExts = []string{".csproj", ".fsproj", ".vbproj", ".sln", ".props", ".targets", ".nupkg"}
+
+// Names (in lower case) of other files that determine what is restored.
+var restoreInputNames = []string{"global.json", "nuget.config", toolManifestName}
+
+// Options that can not change the output, so they are left out of the
+// digest. -from-service and -hermetic only act through other options, and
+// -archive and -srcdir through the sources, which are hashed themselves.
+var digestIgnoredOptions = []string{
+	"verbose", "output", "outDir", "fromService", "archives", "archiveSelect",
+	"srcDir", "hermetic", "noClobber", "force", "pullTimeout", "showRestoreOutput",
+	"restoreLog", "reportTimings", "retries", "timeout", "solutionTimeout",
+	"warmStart", "cacheDir", "redact", "statusAddr", "statusLinger",
+}
+
+// Hash the files in the sources that determine what is restored (lock files,
+// projects, and NuGet configuration), along with every option that may change
+// the output and the files given by -extra-packages-dir and -system-packages.
+func restoreInputsDigest(ctx context.Context, srcDir string) (string, error) {
+	opts := optionsFrom(ctx)
+	var names []string
+	err := filepath.WalkDir(srcDir, func(name string, d fs.DirEntry, err error) error {
+		if err != nil || d.IsDir() {
+			return err
+		}
+		base := strings.ToLower(d.Name())
+		isLockFile := strings.HasPrefix(base, "packages.") && strings.HasSuffix(base, ".lock.json")
+		if isLockFile || slices.Contains(restoreInputNames, base) || slices.Contains(restoreInputExts, filepath.Ext(base)) {
+			names = append(names, name)
+		}
+		return nil
+	})
+	if err != nil {
+		return "", err
+	}
+	slices.Sort(names)
+
+	hasher := sha256.New()
+	fmt.Fprintf(hasher, "image %s\n", sdkImage(ctx))
+	// fmt prints the values of the (unexported) fields without calling their
+	// methods, so every field is written the same way on every run.
+	value := reflect.ValueOf(opts).Elem()
+	for i := range value.NumField() {
+		name := value.Type().Field(i).Name
+		if !slices.Contains(digestIgnoredOptions, name) {
+			fmt.Fprintf(hasher, "%s %v\n", name, value.Field(i))
+		}
+	}
+	for _, name := range names {
+		digest, err := fileSHA256(name)
+		if err != nil {
+			return "", err
+		}
+		rel, err := filepath.Rel(srcDir, name)
+		if err != nil {
+			return "", err
+		}
+		fmt.Fprintf(hasher, "%s %s\n", digest, filepath.ToSlash(rel))
+	}
+	for _, input := range []string{opts.extraPackagesDir, opts.systemPackages} {
+		if input == "" {
+			continue
+		}
+		err := filepath.WalkDir(input, func(name string, d fs.DirEntry, err error) error {
+			if err != nil || d.IsDir() {
+				return err
+			}
+			digest, err := fileSHA256(name)
+			if err != nil {
+				return err
+			}
+			fmt.Fprintf(hasher, "%s %s\n", digest, filepath.ToSlash(name))
+			return nil
+		})
+		if err != nil {
+			return "", fmt.Errorf("failed to hash %s: %w", input, err)
+		}
+	}
+	return hex.EncodeToString(hasher.Sum(nil)), nil
+}
+
+// The path of the file recording the digest the output was created from. It
+// is kept in the cache directory (-cache-dir, or the user's), rather than next
+// to the output, so that OBS does not commit it with the package.
+func stateFilePath(ctx context.Context, outputPath string) (string, error) {
+	opts := optionsFrom(ctx)
+	cacheDir := opts.cacheDir
+	if cacheDir == "" {
+		userCacheDir, err := os.UserCacheDir()
+		if err != nil {
+			return "", err
+		}
+		cacheDir = filepath.Join(userCacheDir, "obs-service-dotnet-packages")
+	}
+	outputPath, err := filepath.Abs(outputPath)
+	if err != nil {
+		return "", err
+	}
+	hash := sha256.Sum256([]byte(outputPath))
+	return filepath.Join(cacheDir, "state", hex.EncodeToString(hash[:])[:16]), nil
+}
+
+// Record the digest of the restore inputs the output was written from.
+func writeStateFile(statePath, digest string) error {
+	if err := os.MkdirAll(filepath.Dir(statePath), 0o755); err != nil {
+		return fmt.Errorf("failed to write state file: %w", err)
+	}
+	if err := os.WriteFile(statePath, []byte(digest+"\n"), 0o644); err != nil {
+		return fmt.Errorf("failed to write state file: %w", err)
+	}
+	return nil
+}
+
+// Whether the output archive exists and was created from sources with the same
+// digest, as recorded in the state file.
+func outputUpToDate(statePath, outputPath, digest string) bool {
+	if _, err := os.Stat(outputPath); err != nil {
+		return false
+	}
+	state, err := os.ReadFile(statePath)
+	return err == nil && string(bytes.TrimSpace(state)) == digest
+}
@@ -0,0 +1,100 @@
+package main
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestDigestIgnoredOptions(t *testing.T) {
+	fields := reflect.TypeFor[options]()
+	for _, name := range digestIgnoredOptions {
+		if _, ok := fields.FieldByName(name); !ok {
+			t.Errorf("ignored option %s is not a field of options", name)
+		}
+	}
+}
+
+func TestRestoreInputsDigest(t *testing.T) {
+	srcDir := t.TempDir()
+	if err := os.WriteFile(filepath.Join(srcDir, "app.csproj"), []byte("<Project />"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	digest := func(args ...string) string {
+		t.Helper()
+		opts := testOptions(t, append([]string{"-tag", "9.0"}, args...)...)
+		d, err := restoreInputsDigest(withOptions(context.Background(), opts), srcDir)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return d
+	}
+	base := digest("-vendor", "x=true")
+	if d := digest("-vendor", "x=true"); d != base {
+		t.Errorf("digest is not stable: %s != %s", d, base)
+	}
+	if d := digest("-vendor", "x=true", "-verbose", "-force"); d != base {
+		t.Errorf("ignored options changed the digest")
+	}
+	for _, args := range [][]string{
+		{"-vendor", "x=false"},
+		{"-vendor", "x=true", "-format", "zip"},
+		{"-vendor", "x=true", "-locked-mode=false"},
+		{"-vendor", "x=true", "-property", "A=B"},
+		{"-vendor", "x=true", "-rid", "linux-x64"},
+		{"-vendor", "x=true", "-zstd-long"},
+	} {
+		if d := digest(args...); d == base {
+			t.Errorf("digest did not change with %v", args)
+		}
+	}
+}
+
+// A run with unchanged lock files keeps the output and the restore log of the
+// run that wrote it, even with -no-clobber.
+func TestBuildUpToDate(t *testing.T) {
+	t.Setenv("SOURCE_DATE_EPOCH", "")
+	t.Setenv("XDG_CACHE_HOME", t.TempDir())
+	srcDir, outDir := t.TempDir(), t.TempDir()
+	project := `<Project Sdk="Microsoft.NET.Sdk"><PropertyGroup><TargetFramework>net9.0</TargetFramework></PropertyGroup></Project>`
+	if err := os.WriteFile(filepath.Join(srcDir, "app.csproj"), []byte(project), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	opts := testOptions(t, "-srcdir", srcDir, "-outdir", outDir, "-restore-log", "-no-clobber")
+	ctx, _, err := prepareSources(withOptions(context.Background(), opts), srcDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	digest, err := restoreInputsDigest(ctx, srcDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	outBase := filepath.Join(outDir, "packages")
+	outputPath := outBase + outputExtension(opts)
+	statePath, err := stateFilePath(ctx, outputPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := writeStateFile(statePath, digest); err != nil {
+		t.Fatal(err)
+	}
+	writeFiles(t, outDir, "packages"+outputExtension(opts), "packages-restore.log")
+
+	if err := build(withOptions(context.Background(), opts)); err != nil {
+		t.Fatal(err)
+	}
+	if log, err := os.ReadFile(outBase + "-restore.log"); err != nil || string(log) != outBase+"-restore.log" {
+		t.Errorf("restore log was replaced by a skipped run: %q, %v", log, err)
+	}
+
+	if err := writeStateFile(statePath, "changed"); err != nil {
+		t.Fatal(err)
+	}
+	err = build(withOptions(context.Background(), opts))
+	if err == nil || !strings.Contains(err.Error(), "already exists") {
+		t.Errorf("build = %v, want an error about the existing output", err)
+	}
+}
@@ -0,0 +1,108 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"log/slog"
+	"net"
+	"net/http"
+	"os"
+	"os/signal"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// runStatus is the progress of a run, served as JSON with -status-addr so
+// that automation can poll it instead of parsing the log.
+type runStatus struct {
+	mu       sync.Mutex
+	Phase    string     `json:"phase"`
+	Started  time.Time  `json:"started"`
+	Finished *time.Time `json:"finished,omitempty"`
+	Result   string     `json:"result,omitempty"` // "success", or the error
+	Restores int        `json:"restores"`         // dotnet restore runs started
+	Failures int        `json:"failures"`         // dotnet restore runs that failed
+	Packages int        `json:"packages"`         // packages restored, once known
+}
+
+type runStatusKey struct{}
+
+// Return a context in which progress is recorded in the given status.
+func withRunStatus(ctx context.Context, status *runStatus) context.Context {
+	return context.WithValue(ctx, runStatusKey{}, status)
+}
+
+// Update the run status, if it is being served.
+func updateRunStatus(ctx context.Context, update func(status *runStatus)) {
+	if status, ok := ctx.Value(runStatusKey{}).(*runStatus); ok {
+		status.mu.Lock()
+		defer status.mu.Unlock()
+		update(status)
+	}
+}
+
+// Record the phase the run is in.
+func setPhase(ctx context.Context, phase string) {
+	updateRunStatus(ctx, func(status *runStatus) { status.Phase = phase })
+}
+
+// Record the result of the run.
+func finishRunStatus(ctx context.Context, err error) {
+	updateRunStatus(ctx, func(status *runStatus) {
+		now := time.Now()
+		status.Phase = "finished"
+		status.Finished = &now
+		status.Result = "success"
+		if err != nil {
+			// The status is served over HTTP, so it must not leak secrets.
+			secrets, _ := secretValues(optionsFrom(ctx))
+			status.Result = redactSecrets(secrets, err.Error())
+		}
+	})
+}
+
+// Keep serving the final status for -status-linger after the run, so that
+// whoever polls it sees the result rather than a refused connection.  An
+// interrupt stops waiting early.
+func lingerRunStatus(ctx context.Context) {
+	opts := optionsFrom(ctx)
+	if opts.statusAddr == "" || opts.statusLinger <= 0 {
+		return
+	}
+	ctx, stop := signal.NotifyContext(context.WithoutCancel(ctx), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+	slog.InfoContext(ctx, "run finished, still serving status", "for", opts.statusLinger)
+	select {
+	case <-ctx.Done():
+	case <-time.After(opts.statusLinger):
+	}
+}
+
+// Serve the run status on addr: /status returns it as JSON, and /healthz
+// returns "ok" while the process is running.  The server stops when ctx is
+// done.
+func serveRunStatus(ctx context.Context, addr string, status *runStatus) error {
+	listener, err := net.Listen("tcp", addr)
+	if err != nil {
+		return err
+	}
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /status", func(w http.ResponseWriter, r *http.Request) {
+		status.mu.Lock()
+		defer status.mu.Unlock()
+		writeJSON(w, status)
+	})
+	mux.HandleFunc("GET /healthz", func(w http.ResponseWriter, r *http.Request) {
+		_, _ = w.Write([]byte("ok\n"))
+	})
+	server := &http.Server{Handler: mux}
+	context.AfterFunc(ctx, func() { server.Close() })
+	slog.InfoContext(ctx, "serving status", "address", listener.Addr().String())
+	go func() {
+		if err := server.Serve(listener); err != nil && !errors.Is(err, http.ErrServerClosed) {
+			slog.ErrorContext(ctx, "status server failed", "error", err)
+		}
+	}()
+	return nil
+}
@@ -0,0 +1,79 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net"
+	"net/http"
+	"testing"
+	"time"
+)
+
+// A local address nothing listens on.
+func freeAddr(t *testing.T) string {
+	t.Helper()
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+	return listener.Addr().String()
+}
+
+func TestStatusLinger(t *testing.T) {
+	addr := freeAddr(t)
+	opts := testOptions(t, "-status-addr", addr, "-status-linger", "300ms")
+	status := &runStatus{Phase: "starting", Started: time.Now()}
+	serverCtx, stop := context.WithCancel(context.Background())
+	defer stop()
+	if err := serveRunStatus(serverCtx, addr, status); err != nil {
+		t.Fatal(err)
+	}
+	ctx := withRunStatus(withOptions(context.Background(), opts), status)
+	finishRunStatus(ctx, errors.New("restore failed"))
+
+	start := time.Now()
+	lingered := make(chan struct{})
+	go func() {
+		lingerRunStatus(ctx)
+		close(lingered)
+	}()
+	resp, err := http.Get("http://" + addr + "/status")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	var got struct {
+		Phase  string `json:"phase"`
+		Result string `json:"result"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&got); err != nil {
+		t.Fatal(err)
+	}
+	if got.Phase != "finished" || got.Result != "restore failed" {
+		t.Errorf("status = %+v", got)
+	}
+	select {
+	case <-lingered:
+		if elapsed := time.Since(start); elapsed < 300*time.Millisecond {
+			t.Errorf("stopped serving after %s", elapsed)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("still serving long after -status-linger")
+	}
+}
+
+func TestStatusNoLinger(t *testing.T) {
+	ctx := withOptions(context.Background(), testOptions(t, "-status-addr", freeAddr(t), "-status-linger", "0"))
+	done := make(chan struct{})
+	go func() {
+		lingerRunStatus(ctx)
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("lingered with -status-linger 0")
+	}
+}
@@ -0,0 +1,163 @@
+package main
+
+import (
+	"cmp"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"log/slog"
+	"os"
+	"path"
+	"path/filepath"
+	"regexp"
+	"slices"
+	"strconv"
+	"strings"
+)
+
+// tagAuto selects the SDK image tag from the sources (-tag auto).
+const tagAuto = "auto"
+
+// The tag used with -tag auto when the sources do not specify a version.
+const defaultTag = "9.0"
+
+// Matches the target frameworks set in project files.
+var targetFrameworkPattern = regexp.MustCompile(`(?i)<TargetFrameworks?>([^<]*)</TargetFrameworks?>`)
+
+// Matches target frameworks of .NET (Core), capturing the major and minor
+// version; .NET Framework versions such as net48 have no dot.
+var netVersionPattern = regexp.MustCompile(`(?i)^net(?:coreapp)?(\d+)\.(\d+)`)
+
+// Find the SDK version the sources need, as major.minor: the version in the
+// global.json closest to the restore targets, or else the newest .NET version
+// they target. Returns an empty version if neither is found, and otherwise
+// where it came from.
+func detectTag(srcDir string, targets []string) (version, source string, err error) {
+	for _, target := range targets {
+		for dir := path.Dir(target); ; dir = path.Dir(dir) {
+			name := path.Join(dir, "global.json")
+			buf, err := os.ReadFile(filepath.Join(srcDir, name))
+			if err == nil {
+				var globalJSON struct {
+					SDK struct {
+						Version string `json:"version"`
+					} `json:"sdk"`
+				}
+				if err := json.Unmarshal(buf, &globalJSON); err != nil {
+					return "", "", fmt.Errorf("invalid %s: %w", name, err)
+				}
+				if major, minor, ok := strings.Cut(globalJSON.SDK.Version, "."); ok {
+					minor, _, _ = strings.Cut(minor, ".")
+					return major + "." + minor, name, nil
+				}
+			} else if !errors.Is(err, fs.ErrNotExist) {
+				return "", "", err
+			}
+			if dir == "." {
+				break
+			}
+		}
+	}
+
+	newest := [2]int{-1, -1}
+	for _, target := range targets {
+		projects, err := targetProjects(srcDir, target)
+		if err != nil {
+			return "", "", err
+		}
+		for _, project := range projects {
+			buf, err := os.ReadFile(filepath.Join(srcDir, project))
+			if err != nil {
+				return "", "", fmt.Errorf("failed to read project %s: %w", project, err)
+			}
+			for _, match := range targetFrameworkPattern.FindAllStringSubmatch(string(buf), -1) {
+				for _, tfm := range strings.Split(match[1], ";") {
+					version := netVersionPattern.FindStringSubmatch(strings.TrimSpace(tfm))
+					if version == nil {
+						continue
+					}
+					major, _ := strconv.Atoi(version[1])
+					minor, _ := strconv.Atoi(version[2])
+					if major > newest[0] || major == newest[0] && minor > newest[1] {
+						newest = [2]int{major, minor}
+						source = project
+					}
+				}
+			}
+		}
+	}
+	if newest[0] < 0 {
+		return "", "", nil
+	}
+	return fmt.Sprintf("%d.%d", newest[0], newest[1]), source, nil
+}
+
+// sdkGroup is a set of restore targets needing the same SDK version.
+type sdkGroup struct {
+	tag     string
+	targets []string
+}
+
+// Group the restore targets by the SDK version each of them needs, for sources
+// with solutions pinned to different SDKs. Targets that do not specify a
+// version use the given one.
+func groupTargetsByTag(srcDir string, targets []string, tag string) ([]sdkGroup, error) {
+	var groups []sdkGroup
+	for _, target := range targets {
+		targetTag, _, err := detectTag(srcDir, []string{target})
+		if err != nil {
+			return nil, err
+		}
+		if targetTag == "" {
+			targetTag = tag
+		}
+		i := slices.IndexFunc(groups, func(group sdkGroup) bool { return group.tag == targetTag })
+		if i < 0 {
+			groups = append(groups, sdkGroup{tag: targetTag})
+			i = len(groups) - 1
+		}
+		groups[i].targets = append(groups[i].targets, target)
+	}
+	return groups, nil
+}
+
+// Pick the SDK image tag for -tag auto from the sources, or warn if the given
+// tag does not match them. If the targets need different SDK versions, they
+// are also returned grouped by version, to be restored separately.
+func resolveTag(ctx context.Context, srcDir string, targets []string) (string, []sdkGroup, error) {
+	opts := optionsFrom(ctx)
+	tag := opts.tag
+	var sdkGroups []sdkGroup
+	detected, source, err := detectTag(srcDir, targets)
+	if err != nil {
+		return "", nil, fmt.Errorf("failed to detect SDK version: %w", err)
+	}
+	// The tag only selects the image when restoring in a container from the
+	// SDK image.
+	usesTag := opts.image == "" && !opts.noContainer && opts.containerID == "" && len(opts.matrixTags) == 0
+	if opts.tag == tagAuto && usesTag {
+		groups, err := groupTargetsByTag(srcDir, targets, cmp.Or(detected, defaultTag))
+		if err != nil {
+			return "", nil, fmt.Errorf("failed to detect SDK version: %w", err)
+		}
+		if len(groups) > 1 {
+			for _, group := range groups {
+				slog.InfoContext(ctx, "restoring with multiple SDK versions", "tag", group.tag, "targets", group.targets)
+			}
+			sdkGroups = groups
+		}
+	}
+	switch {
+	case tag == tagAuto && detected == "":
+		tag = defaultTag
+		slog.InfoContext(ctx, "could not detect SDK version, using default", "tag", tag)
+	case tag == tagAuto:
+		tag = detected
+		slog.InfoContext(ctx, "detected SDK version", "tag", tag, "from", source)
+	case detected != "" && detected != tag:
+		slog.WarnContext(ctx, "-tag overrides the SDK version of the sources", "tag", tag, "detected", detected, "from", source)
+	}
+	return tag, sdkGroups, nil
+}
@@ -0,0 +1,70 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"cmp"
+	"context"
+	"log/slog"
+	"regexp"
+	"slices"
+	"strconv"
+	"time"
+)
+
+// restoreTiming is the time spent on a project or package download.
+type restoreTiming struct {
+	name     string
+	duration time.Duration
+}
+
+var (
+	// A line of the MSBuild project performance summary, where the project
+	// path may contain spaces:
+	//   1234 ms  /src/my app/app.csproj   3 calls
+	projectTimingPattern = regexp.MustCompile(`^\s*(\d+) ms\s+(.+?)\s+\d+ calls?\s*$`)
+	// A NuGet HTTP request:
+	//   OK https://api.nuget.org/v3-flatcontainer/foo/1.0.0/foo.1.0.0.nupkg 123ms
+	downloadTimingPattern = regexp.MustCompile(`^\s*OK (.+?\.nupkg) (\d+)ms\s*$`)
+)
+
+// Parse the time spent per project and per package download from the output
+// of a restore with the MSBuild performance summary enabled.
+func parseRestoreTimings(output []byte) (projects, downloads []restoreTiming) {
+	inSummary := false
+	scanner := bufio.NewScanner(bytes.NewReader(output))
+	scanner.Buffer(nil, 1<<20)
+	for scanner.Scan() {
+		line := scanner.Text()
+		if bytes.Contains(scanner.Bytes(), []byte("Performance Summary:")) {
+			inSummary = bytes.Contains(scanner.Bytes(), []byte("Project Performance Summary:"))
+			continue
+		}
+		if match := projectTimingPattern.FindStringSubmatch(line); match != nil && inSummary {
+			ms, _ := strconv.Atoi(match[1])
+			projects = append(projects, restoreTiming{name: match[2], duration: time.Duration(ms) * time.Millisecond})
+		} else if match := downloadTimingPattern.FindStringSubmatch(line); match != nil {
+			ms, _ := strconv.Atoi(match[2])
+			downloads = append(downloads, restoreTiming{name: match[1], duration: time.Duration(ms) * time.Millisecond})
+		}
+	}
+	return projects, downloads
+}
+
+// Log the slowest projects and package downloads of a restore, as requested
+// with -report-timings.
+func reportRestoreTimings(ctx context.Context, solutionPath string, output []byte) {
+	count := optionsFrom(ctx).reportTimings
+	projects, downloads := parseRestoreTimings(output)
+	for _, timings := range []struct {
+		kind    string
+		timings []restoreTiming
+	}{{"project", projects}, {"download", downloads}} {
+		slices.SortFunc(timings.timings, func(a, b restoreTiming) int {
+			return cmp.Compare(b.duration, a.duration)
+		})
+		for _, timing := range timings.timings[:min(count, len(timings.timings))] {
+			slog.InfoContext(ctx, "slow restore "+timings.kind, "solution", solutionPath, timings.kind, timing.name, "duration", timing.duration)
+		}
+	}
+}
@@ -0,0 +1,49 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestParseRestoreTimings(t *testing.T) {
+	output := []byte(`  GET https://api.nuget.org/v3-flatcontainer/foo/1.0.0/foo.1.0.0.nupkg
+  OK https://api.nuget.org/v3-flatcontainer/foo/1.0.0/foo.1.0.0.nupkg 123ms
+  OK http://feed.example/my feed/bar/2.0.0/bar.2.0.0.nupkg 45ms
+  OK https://api.nuget.org/v3-flatcontainer/foo/index.json 12ms
+
+Project Evaluation Performance Summary:
+       50 ms  /src/app/app.csproj   1 calls
+
+Project Performance Summary:
+     1234 ms  /src/app/app.csproj   3 calls
+      567 ms  /src/My App/My App.csproj   1 call
+       89 ms  /src/tools/1 ms tool/tool.csproj   2 calls
+
+Target Performance Summary:
+      100 ms  Restore   1 calls
+`)
+	projects, downloads := parseRestoreTimings(output)
+	wantProjects := []restoreTiming{
+		{"/src/app/app.csproj", 1234 * time.Millisecond},
+		{"/src/My App/My App.csproj", 567 * time.Millisecond},
+		{"/src/tools/1 ms tool/tool.csproj", 89 * time.Millisecond},
+	}
+	wantDownloads := []restoreTiming{
+		{"https://api.nuget.org/v3-flatcontainer/foo/1.0.0/foo.1.0.0.nupkg", 123 * time.Millisecond},
+		{"http://feed.example/my feed/bar/2.0.0/bar.2.0.0.nupkg", 45 * time.Millisecond},
+	}
+	for _, tt := range []struct {
+		kind      string
+		got, want []restoreTiming
+	}{{"projects", projects, wantProjects}, {"downloads", downloads, wantDownloads}} {
+		if len(tt.got) != len(tt.want) {
+			t.Errorf("%s = %v, want %v", tt.kind, tt.got, tt.want)
+			continue
+		}
+		for i := range tt.want {
+			if tt.got[i] != tt.want[i] {
+				t.Errorf("%s[%d] = %v, want %v", tt.kind, i, tt.got[i], tt.want[i])
+			}
+		}
+	}
+}
@@ -0,0 +1,149 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/fs"
+	"log/slog"
+	"os"
+	"path"
+	"path/filepath"
+	"regexp"
+	"slices"
+	"strings"
+)
+
+// The name of the local tool manifests used by `dotnet tool restore`.
+const toolManifestName = "dotnet-tools.json"
+
+// manifestTool is a tool from a dotnet-tools.json file in the sources.
+type manifestTool struct {
+	Manifest    string   `json:"manifest"` // Path to the dotnet-tools.json file
+	ID          string   `json:"id"`
+	Version     string   `json:"version"` // As given in the tool manifest
+	RollForward bool     `json:"rollForward,omitempty"`
+	Resolved    []string `json:"resolved"` // The versions that were restored
+}
+
+// Whether the version of the tool that is restored may change over time.
+func (t manifestTool) floating() bool {
+	return t.Version == "" || strings.ContainsAny(t.Version, "*[](),") || t.RollForward
+}
+
+// Read the tools from the dotnet-tools.json files in the sources, failing on
+// tools without an exact version if -require-pinned-tools is given.
+func readToolManifests(ctx context.Context, srcDir string) ([]manifestTool, error) {
+	opts := optionsFrom(ctx)
+	var tools []manifestTool
+	err := filepath.WalkDir(srcDir, func(name string, d fs.DirEntry, err error) error {
+		if err != nil || d.IsDir() || d.Name() != toolManifestName {
+			return err
+		}
+		rel, err := filepath.Rel(srcDir, name)
+		if err != nil {
+			return err
+		}
+		buf, err := os.ReadFile(name)
+		if err != nil {
+			return err
+		}
+		var manifest struct {
+			Tools map[string]struct {
+				Version     string `json:"version"`
+				RollForward bool   `json:"rollForward"`
+			} `json:"tools"`
+		}
+		if err := json.Unmarshal(buf, &manifest); err != nil {
+			return fmt.Errorf("invalid tool manifest %s: %w", rel, err)
+		}
+		for id, tool := range manifest.Tools {
+			tools = append(tools, manifestTool{
+				Manifest:    filepath.ToSlash(rel),
+				ID:          id,
+				Version:     tool.Version,
+				RollForward: tool.RollForward,
+				Resolved:    []string{},
+			})
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	slices.SortFunc(tools, func(a, b manifestTool) int {
+		if c := strings.Compare(a.Manifest, b.Manifest); c != 0 {
+			return c
+		}
+		return strings.Compare(a.ID, b.ID)
+	})
+
+	var floating []string
+	for _, tool := range tools {
+		if tool.floating() {
+			slog.WarnContext(ctx, "tool version is not pinned", "manifest", tool.Manifest, "tool", tool.ID, "version", tool.Version, "rollForward", tool.RollForward)
+			floating = append(floating, tool.ID)
+		}
+	}
+	if len(floating) > 0 && opts.requirePinned {
+		return nil, fmt.Errorf("tools without an exact version: %s", strings.Join(floating, ", "))
+	}
+	return tools, nil
+}
+
+// The line `dotnet tool restore` prints for each restored tool, such as
+// "Tool 'dotnet-ef' (version '8.0.0') was restored. Available commands: ...".
+var toolRestoredPattern = regexp.MustCompile(`Tool '([^']+)' \(version '([^']+)'\) was restored`)
+
+// Restore the tools of every tool manifest into the packages directory, with
+// the same package sources as the projects, and record the versions restored.
+func restoreTools(ctx context.Context, env restoreEnv, tools []manifestTool, feeds []inTreeFeed) error {
+	var manifests []string
+	for _, tool := range tools {
+		if !slices.Contains(manifests, tool.Manifest) {
+			manifests = append(manifests, tool.Manifest)
+		}
+	}
+	// `dotnet tool restore` does not take MSBuild properties, so the in-tree
+	// feeds are added as sources instead.
+	sourceArgs := slices.Clone(env.restoreArgs())
+	for _, feed := range feeds {
+		sourceArgs = append(sourceArgs, "--add-source", path.Join(env.sourcesPath(), feed.dir))
+	}
+	for _, manifest := range manifests {
+		slog.InfoContext(ctx, "restoring tools", "manifest", manifest)
+		var output bytes.Buffer
+		// `dotnet tool restore` has no --packages option.
+		cmd := []string{"env", "NUGET_PACKAGES=" + env.packagesPath(),
+			"dotnet", "tool", "restore", "--tool-manifest", path.Join(env.sourcesPath(), manifest)}
+		err := env.exec(ctx, &output, append(cmd, sourceArgs...)...)
+		if err != nil {
+			return fmt.Errorf("failed to restore tools of %s: %w\n%s", manifest, err, output.String())
+		}
+		for _, match := range toolRestoredPattern.FindAllStringSubmatch(output.String(), -1) {
+			for i, tool := range tools {
+				if tool.Manifest == manifest && strings.EqualFold(tool.ID, match[1]) && !slices.Contains(tool.Resolved, match[2]) {
+					tools[i].Resolved = append(tools[i].Resolved, match[2])
+				}
+			}
+		}
+	}
+	return nil
+}
+
+// Add the versions restored for the tools in from (read from the same
+// sources, so in the same order) to those in into.
+func mergeToolVersions(into, from []manifestTool) []manifestTool {
+	if into == nil {
+		return from
+	}
+	for i := range min(len(into), len(from)) {
+		for _, version := range from[i].Resolved {
+			if !slices.Contains(into[i].Resolved, version) {
+				into[i].Resolved = append(into[i].Resolved, version)
+			}
+		}
+	}
+	return into
+}
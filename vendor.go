@@ -0,0 +1,175 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io/fs"
+	"log/slog"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"slices"
+	"strings"
+)
+
+// vendorer vendors the dependencies of another ecosystem used in the sources
+// (such as npm for web assets) into an additional archive.
+type vendorer interface {
+	// The name of the ecosystem, used as the suffix of the archive.
+	name() string
+	// Whether the sources use the ecosystem at all.
+	detect(srcDir string) (bool, error)
+	// Download the dependencies into outDir.
+	vendor(ctx context.Context, srcDir, outDir string) error
+}
+
+// vendorList is a flag selecting vendorers: either the name of an embedded
+// one, or NAME=COMMAND to run an external command.
+type vendorList []vendorer
+
+func (l *vendorList) String() string {
+	if l == nil {
+		return "<nil>"
+	}
+	var names []string
+	for _, v := range *l {
+		names = append(names, v.name())
+	}
+	return strings.Join(names, ",")
+}
+
+func (l *vendorList) Set(value string) error {
+	if name, command, ok := strings.Cut(value, "="); ok {
+		if name == "" || len(strings.Fields(command)) == 0 {
+			return fmt.Errorf("invalid vendor %q, expected NAME=COMMAND", value)
+		}
+		*l = append(*l, commandVendorer{vendorName: name, command: strings.Fields(command)})
+		return nil
+	}
+	switch value {
+	case "npm":
+		*l = append(*l, npmVendorer{})
+		return nil
+	}
+	return fmt.Errorf("unknown vendor %s", value)
+}
+
+// Run the vendorers selected with -vendor, writing an archive (in the output
+// format) named after the output with the name of the vendorer appended for
+// each one that applies.  Vendorers run on the host with network access, so
+// they can not be used with -no-network.
+func vendorAuxiliary(ctx context.Context, srcDir, outBase string) error {
+	opts := optionsFrom(ctx)
+	for _, v := range opts.vendors {
+		if found, err := v.detect(srcDir); err != nil {
+			return fmt.Errorf("vendor %s: %w", v.name(), err)
+		} else if !found {
+			slog.InfoContext(ctx, "sources do not need vendoring", "vendor", v.name())
+			continue
+		}
+		dir, err := os.MkdirTemp("", "obs-service-dotnet-packages-vendor-*")
+		if err != nil {
+			return err
+		}
+		defer os.RemoveAll(dir)
+		slog.InfoContext(ctx, "vendoring dependencies", "vendor", v.name())
+		if err := v.vendor(ctx, srcDir, dir); err != nil {
+			return fmt.Errorf("vendor %s: %w", v.name(), err)
+		}
+		vendorBase := outBase + "-" + v.name()
+		if err := createArchive(ctx, dir, vendorBase, opts.format, opts.compression); err != nil {
+			return fmt.Errorf("vendor %s: %w", v.name(), err)
+		}
+		if opts.format == outputFormatCpio {
+			if err := writeObsinfo(ctx, vendorBase); err != nil {
+				return fmt.Errorf("vendor %s: %w", v.name(), err)
+			}
+		}
+	}
+	return nil
+}
+
+// commandVendorer runs an external command (such as another source service)
+// with the sources and output directories as its last arguments.
+type commandVendorer struct {
+	vendorName string
+	command    []string
+}
+
+func (v commandVendorer) name() string {
+	return v.vendorName
+}
+
+func (v commandVendorer) detect(string) (bool, error) {
+	return true, nil
+}
+
+func (v commandVendorer) vendor(ctx context.Context, srcDir, outDir string) error {
+	args := append(slices.Clone(v.command[1:]), srcDir, outDir)
+	var output bytes.Buffer
+	cmd := exec.CommandContext(ctx, v.command[0], args...)
+	cmd.Dir = srcDir
+	cmd.Stdout = &output
+	cmd.Stderr = &output
+	if err := cmd.Run(); err != nil {
+		return fmt.Errorf("%s failed: %w\n%s", v.command[0], err, output.String())
+	}
+	return nil
+}
+
+// npmVendorer fills an npm cache with the packages of every package-lock.json,
+// to be used with `npm ci --offline --cache`.
+type npmVendorer struct{}
+
+func (npmVendorer) name() string {
+	return "npm"
+}
+
+func (npmVendorer) lockFiles(srcDir string) ([]string, error) {
+	var lockFiles []string
+	err := filepath.WalkDir(srcDir, func(name string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if d.IsDir() && d.Name() == "node_modules" {
+			return fs.SkipDir
+		}
+		if !d.IsDir() && d.Name() == "package-lock.json" {
+			lockFiles = append(lockFiles, name)
+		}
+		return nil
+	})
+	return lockFiles, err
+}
+
+func (v npmVendorer) detect(srcDir string) (bool, error) {
+	lockFiles, err := v.lockFiles(srcDir)
+	return len(lockFiles) > 0, err
+}
+
+func (v npmVendorer) vendor(ctx context.Context, srcDir, outDir string) error {
+	lockFiles, err := v.lockFiles(srcDir)
+	if err != nil {
+		return err
+	}
+	for _, lockFile := range lockFiles {
+		dir := filepath.Dir(lockFile)
+		// Do not leave node_modules behind in the sources.
+		nodeModules := filepath.Join(dir, "node_modules")
+		if _, err := os.Stat(nodeModules); errors.Is(err, fs.ErrNotExist) {
+			defer os.RemoveAll(nodeModules)
+		}
+		slog.InfoContext(ctx, "vendoring npm packages", "lock file", lockFile)
+		var output bytes.Buffer
+		cmd := exec.CommandContext(ctx, "npm", "ci", "--ignore-scripts", "--no-audit", "--no-fund", "--cache", outDir)
+		cmd.Dir = dir
+		cmd.Stdout = &output
+		cmd.Stderr = &output
+		if err := cmd.Run(); err != nil {
+			return fmt.Errorf("npm ci in %s failed: %w\n%s", dir, err, output.String())
+		}
+	}
+	return nil
+}
@@ -0,0 +1,91 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io/fs"
+	"log/slog"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+)
+
+// Verify the source archive against sibling checksum (.sha256) and signature
+// (.asc) files, if there are any, before anything in it is used. Signatures
+// are checked with gpgv against the package's .keyring file, as OBS does.
+func verifyArchive(ctx context.Context, archive string) error {
+	checksumFile := archive + ".sha256"
+	if buf, err := os.ReadFile(checksumFile); err == nil {
+		expected, _, _ := strings.Cut(strings.TrimSpace(string(buf)), " ")
+		actual, err := fileSHA256(archive)
+		if err != nil {
+			return fmt.Errorf("failed to hash %s: %w", archive, err)
+		}
+		if !strings.EqualFold(expected, actual) {
+			return fmt.Errorf("checksum mismatch for %s: expected %s, got %s", archive, expected, actual)
+		}
+		slog.InfoContext(ctx, "verified archive checksum", "archive", archive, "sha256", actual)
+	} else if !errors.Is(err, fs.ErrNotExist) {
+		return fmt.Errorf("failed to read %s: %w", checksumFile, err)
+	}
+
+	signatureFile := archive + ".asc"
+	if _, err := os.Stat(signatureFile); errors.Is(err, fs.ErrNotExist) {
+		return nil
+	} else if err != nil {
+		return fmt.Errorf("failed to check %s: %w", signatureFile, err)
+	}
+	keyrings, err := filepath.Glob(filepath.Join(filepath.Dir(archive), "*.keyring"))
+	if err != nil {
+		return err
+	}
+	if len(keyrings) == 0 {
+		slog.WarnContext(ctx, "archive has a signature but there is no keyring to verify it", "signature", signatureFile)
+		return nil
+	}
+	if len(keyrings) > 1 {
+		return fmt.Errorf("multiple keyrings found: %s", strings.Join(keyrings, ", "))
+	}
+	keyring, err := dearmorKeyring(ctx, keyrings[0])
+	if err != nil {
+		return err
+	}
+	defer os.Remove(keyring)
+	var output bytes.Buffer
+	cmd := exec.CommandContext(ctx, "gpgv", "--keyring", keyring, signatureFile, archive)
+	cmd.Stdout = &output
+	cmd.Stderr = &output
+	if err := cmd.Run(); err != nil {
+		return fmt.Errorf("failed to verify signature of %s: %w\n%s", archive, err, output.String())
+	}
+	slog.InfoContext(ctx, "verified archive signature", "archive", archive, "keyring", keyrings[0])
+	return nil
+}
+
+// Convert a (possibly ASCII-armored) keyring into a temporary binary keyring
+// usable by gpgv, returning its absolute path.
+func dearmorKeyring(ctx context.Context, keyring string) (string, error) {
+	file, err := os.CreateTemp("", "obs-service-dotnet-packages-keyring-*.gpg")
+	if err != nil {
+		return "", err
+	}
+	name := file.Name()
+	file.Close()
+	buf, err := os.ReadFile(keyring)
+	if err != nil {
+		os.Remove(name)
+		return "", err
+	}
+	if !bytes.HasPrefix(bytes.TrimSpace(buf), []byte("-----BEGIN")) {
+		return name, os.WriteFile(name, buf, 0o600)
+	}
+	cmd := exec.CommandContext(ctx, "gpg", "--batch", "--yes", "--dearmor", "--output", name, keyring)
+	if output, err := cmd.CombinedOutput(); err != nil {
+		os.Remove(name)
+		return "", fmt.Errorf("failed to read keyring %s: %w\n%s", keyring, err, output)
+	}
+	return name, nil
+}
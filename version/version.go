@@ -0,0 +1,152 @@
+// Package version extracts versions from source archive names and compares
+// them using the same rules as rpm, so that selection agrees with the version
+// OBS and rpm would consider newest.
+package version
+
+import (
+	"path"
+	"regexp"
+	"slices"
+	"strings"
+)
+
+// Extensions of archive files, which are removed from names before looking for
+// a version.
+var archiveExtensions = []string{
+	".bz2", ".cpio", ".gz", ".obscpio", ".rpm", ".tar", ".tbz2", ".tgz",
+	".txz", ".xz", ".zip", ".zst",
+}
+
+// Matches a semver pre-release suffix, such as "-rc.1" in "1.2.3-rc.1".
+var prereleasePattern = regexp.MustCompile(`^(\d+(?:\.\d+)*)-([0-9A-Za-z.]+)`)
+
+// FromFilename returns the version of an archive name, such as "1.2.3" for
+// "foo-1.2.3.tar.gz", or the empty string if the name has no version.
+// Semver pre-release versions are converted to use a tilde, so that
+// "foo-1.2.3-rc.1.tar.gz" gives "1.2.3~rc.1", which sorts before "1.2.3".
+func FromFilename(name string) string {
+	name = path.Base(strings.ReplaceAll(name, `\`, "/"))
+	for slices.Contains(archiveExtensions, strings.ToLower(path.Ext(name))) {
+		name = strings.TrimSuffix(name, path.Ext(name))
+	}
+	// The version starts after the first separator followed by a digit.
+	start := -1
+	for i := 0; i+1 < len(name); i++ {
+		if (name[i] == '-' || name[i] == '_') && '0' <= name[i+1] && name[i+1] <= '9' {
+			start = i + 1
+			break
+		}
+	}
+	if start < 0 {
+		return ""
+	}
+	return prereleasePattern.ReplaceAllString(name[start:], "$1~$2")
+}
+
+// Compare compares two versions using rpm's rules (rpmvercmp): versions are
+// split into alternating numeric and alphabetic segments; numeric segments
+// are compared as numbers and are newer than alphabetic ones; a tilde sorts
+// before anything (including the end of the version), and a caret sorts after
+// the end of the version but before anything else. It returns -1 if a is
+// older than b, 0 if they are equal, and +1 if a is newer than b.
+func Compare(a, b string) int {
+	if a == b {
+		return 0
+	}
+	isAlnum := func(c byte) bool {
+		return ('0' <= c && c <= '9') || ('a' <= c && c <= 'z') || ('A' <= c && c <= 'Z')
+	}
+	isDigit := func(c byte) bool { return '0' <= c && c <= '9' }
+	isAlpha := func(c byte) bool { return isAlnum(c) && !isDigit(c) }
+	for {
+		// Anything else, including non-ASCII bytes, separates segments.
+		isSeparator := func(c byte) bool { return !isAlnum(c) && c != '~' && c != '^' }
+		for a != "" && isSeparator(a[0]) {
+			a = a[1:]
+		}
+		for b != "" && isSeparator(b[0]) {
+			b = b[1:]
+		}
+
+		aTilde, bTilde := strings.HasPrefix(a, "~"), strings.HasPrefix(b, "~")
+		if aTilde || bTilde {
+			if aTilde && bTilde {
+				a, b = a[1:], b[1:]
+				continue
+			}
+			if aTilde {
+				return -1
+			}
+			return 1
+		}
+
+		aCaret, bCaret := strings.HasPrefix(a, "^"), strings.HasPrefix(b, "^")
+		if aCaret || bCaret {
+			switch {
+			case a == "":
+				return -1
+			case b == "":
+				return 1
+			case aCaret && bCaret:
+				a, b = a[1:], b[1:]
+				continue
+			case aCaret:
+				return -1
+			default:
+				return 1
+			}
+		}
+
+		if a == "" || b == "" {
+			break
+		}
+
+		isSegment := isAlpha
+		if isDigit(a[0]) {
+			isSegment = isDigit
+		}
+		aEnd, bEnd := 0, 0
+		for aEnd < len(a) && isSegment(a[aEnd]) {
+			aEnd++
+		}
+		for bEnd < len(b) && isSegment(b[bEnd]) {
+			bEnd++
+		}
+		aSegment, bSegment := a[:aEnd], b[:bEnd]
+		a, b = a[aEnd:], b[bEnd:]
+
+		if aSegment == "" {
+			// Not reached, as a starts with an ASCII letter or digit.
+			return -1
+		}
+		if bSegment == "" {
+			// Segments of different types; numeric ones are newer.
+			if isDigit(aSegment[0]) {
+				return 1
+			}
+			return -1
+		}
+		if isDigit(aSegment[0]) {
+			aSegment = strings.TrimLeft(aSegment, "0")
+			bSegment = strings.TrimLeft(bSegment, "0")
+			if len(aSegment) != len(bSegment) {
+				if len(aSegment) < len(bSegment) {
+					return -1
+				}
+				return 1
+			}
+		}
+		if c := strings.Compare(aSegment, bSegment); c != 0 {
+			return c
+		}
+	}
+
+	switch {
+	case a == "" && b == "":
+		return 0
+	case a == "":
+		return -1
+	default:
+		return 1
+	}
+}
@@ -0,0 +1,58 @@
+package version
+
+import "testing"
+
+func TestCompare(t *testing.T) {
+	tests := []struct {
+		a, b string
+		want int
+	}{
+		{"1.0", "1.0", 0},
+		{"1.0", "1.1", -1},
+		{"1.10", "1.9", 1},
+		{"1.01", "1.1", 0},
+		{"1.0a", "1.0", 1},
+		{"1.0", "1.0a", -1},
+		{"1a", "1.1", -1},
+		{"1.0~rc1", "1.0", -1},
+		{"1.0~rc1", "1.0~rc2", -1},
+		{"1.0^git1", "1.0", 1},
+		{"1.0^git1", "1.0.1", -1},
+		{"1_0", "1.0", 0},
+		{"", "", 0},
+		{"", "1", -1},
+		{"1", "", 1},
+		{"...", "", 0},
+		{"1.0é1", "1.0é2", -1},
+		{"1.0é1", "1.0.1", 0},
+		{"é", "", 0},
+		{"é", "1", -1},
+		{"1é", "1é", 0},
+		{"ü1", "ö2", -1},
+	}
+	for _, tt := range tests {
+		if got := Compare(tt.a, tt.b); got != tt.want {
+			t.Errorf("Compare(%q, %q) = %d, want %d", tt.a, tt.b, got, tt.want)
+		}
+		if got := Compare(tt.b, tt.a); got != -tt.want {
+			t.Errorf("Compare(%q, %q) = %d, want %d", tt.b, tt.a, got, -tt.want)
+		}
+	}
+}
+
+func TestFromFilename(t *testing.T) {
+	tests := []struct {
+		name, want string
+	}{
+		{"foo-1.2.3.tar.gz", "1.2.3"},
+		{"foo_1.2.obscpio", "1.2"},
+		{"foo-1.2.3-rc.1.tar.zst", "1.2.3~rc.1"},
+		{"foo.tar.gz", ""},
+		{"", ""},
+	}
+	for _, tt := range tests {
+		if got := FromFilename(tt.name); got != tt.want {
+			t.Errorf("FromFilename(%q) = %q, want %q", tt.name, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,70 @@
+//go:build !nodocker
+
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"log/slog"
+	"os"
+	"path/filepath"
+
+	"github.com/docker/docker/api/types/container"
+	"github.com/docker/docker/api/types/mount"
+	"github.com/docker/docker/client"
+)
+
+// The prefix of the volumes keeping the SDK state and caches for -warm-start.
+const warmVolumePrefix = "obs-service-dotnet-packages-warm-"
+
+// The name of the warm-start volume for the package in the current directory
+// and the SDK image with the given ID, so that a newly pulled image starts
+// cold.
+func warmVolumeName(imageID string) (string, error) {
+	dir, err := os.Getwd()
+	if err != nil {
+		return "", err
+	}
+	if dir, err = filepath.EvalSymlinks(dir); err != nil {
+		return "", err
+	}
+	hash := sha256.Sum256([]byte(imageID + "\x00" + dir))
+	return warmVolumePrefix + hex.EncodeToString(hash[:])[:16], nil
+}
+
+// Pick the image to restore in and, with -warm-start, a volume to mount at the
+// scratch directory instead of a tmpfs, so that the SDK state and caches there
+// are kept for later runs.  The volume only holds files; the environment
+// (including -env values) is never stored.  The image is pulled as the pull
+// policy says first, and returned by ID.
+func restoreImage(ctx context.Context, dc *client.Client) (string, []mount.Mount, error) {
+	opts := optionsFrom(ctx)
+	if !opts.warmStart {
+		return sdkImage(ctx), nil, nil
+	}
+	if err := ensureImage(ctx, dc); err != nil {
+		return "", nil, err
+	}
+	info, _, err := dc.ImageInspectWithRaw(ctx, sdkImage(ctx))
+	if err != nil {
+		return "", nil, fmt.Errorf("failed to inspect image %s: %w", sdkImage(ctx), err)
+	}
+	name, err := warmVolumeName(info.ID)
+	if err != nil {
+		return "", nil, fmt.Errorf("failed to name warm-start volume: %w", err)
+	}
+	slog.InfoContext(ctx, "using warm-start volume", "volume", name, "image", info.ID)
+	return info.ID, []mount.Mount{{Type: mount.TypeVolume, Source: name, Target: scratchDir}}, nil
+}
+
+// Make the scratch directory of a container writable by any user, as the
+// tmpfs normally mounted there is; a new volume is only writable by root.
+func prepareWarmVolume(ctx context.Context, dc *client.Client, containerID string) error {
+	execOptions := container.ExecOptions{User: "0", Cmd: []string{"chmod", "1777", scratchDir}}
+	if err := runExec(ctx, dc, containerID, nil, execOptions); err != nil {
+		return fmt.Errorf("failed to prepare warm-start volume: %w", err)
+	}
+	return nil
+}
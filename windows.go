@@ -0,0 +1,113 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"regexp"
+	"strings"
+)
+
+type windowsPathMode string
+
+const (
+	windowsPathModeIgnore   = "ignore"
+	windowsPathModeWarn     = "warn"
+	windowsPathModeError    = "error"
+	windowsPathModeSanitize = "sanitize"
+)
+
+func (m *windowsPathMode) String() string {
+	if m == nil {
+		return "<nil>"
+	}
+	return string(*m)
+}
+
+func (m *windowsPathMode) Set(value string) error {
+	switch value {
+	case windowsPathModeIgnore, windowsPathModeWarn, windowsPathModeError, windowsPathModeSanitize:
+		*m = windowsPathMode(value)
+		return nil
+	}
+	return fmt.Errorf("invalid windows path mode %s", value)
+}
+
+// The maximum length of a path on Windows without long path support.
+const windowsMaxPath = 260
+
+// Matches path components (ignoring extensions) reserved on Windows.
+var windowsReservedPattern = regexp.MustCompile(`(?i)^(CON|PRN|AUX|NUL|COM[0-9¹²³]|LPT[0-9¹²³])$`)
+
+// Characters not allowed in path components on Windows.
+const windowsInvalidChars = `<>:"|?*\`
+
+// Describe why a path component can not be used on Windows, or return the
+// empty string if it is fine.
+func windowsComponentProblem(component string) string {
+	stem, _, _ := strings.Cut(component, ".")
+	switch {
+	case windowsReservedPattern.MatchString(strings.TrimRight(stem, " ")):
+		return "reserved name"
+	case strings.ContainsAny(component, windowsInvalidChars):
+		return "invalid character"
+	case strings.ContainsFunc(component, func(r rune) bool { return r < 0x20 }):
+		return "control character"
+	case strings.HasSuffix(component, ".") || strings.HasSuffix(component, " "):
+		return "trailing dot or space"
+	}
+	return ""
+}
+
+// Replace a path component with one that can be used on Windows.
+func sanitizeWindowsComponent(component string) string {
+	component = strings.Map(func(r rune) rune {
+		if r < 0x20 || strings.ContainsRune(windowsInvalidChars, r) {
+			return '_'
+		}
+		return r
+	}, component)
+	component = strings.TrimRight(component, ". ")
+	if stem, ext, _ := strings.Cut(component, "."); windowsReservedPattern.MatchString(stem) {
+		component = stem + "_"
+		if ext != "" {
+			component += "." + ext
+		}
+	}
+	return component
+}
+
+// Check if an archive member name (with forward slashes) can be extracted on
+// Windows, returning the name to use according to the windows path option.
+func checkWindowsPath(ctx context.Context, name string) (string, error) {
+	opts := optionsFrom(ctx)
+	if opts.windowsPaths == windowsPathModeIgnore {
+		return name, nil
+	}
+	components := strings.Split(name, "/")
+	var problems []string
+	for i, component := range components {
+		if problem := windowsComponentProblem(component); problem != "" {
+			problems = append(problems, problem)
+			if opts.windowsPaths == windowsPathModeSanitize {
+				components[i] = sanitizeWindowsComponent(component)
+			}
+		}
+	}
+	if len(name) > windowsMaxPath {
+		problems = append(problems, fmt.Sprintf("longer than %d characters", windowsMaxPath))
+	}
+	if len(problems) == 0 {
+		return name, nil
+	}
+	switch opts.windowsPaths {
+	case windowsPathModeError:
+		return "", fmt.Errorf("%s can not be extracted on Windows: %s", name, strings.Join(problems, ", "))
+	case windowsPathModeSanitize:
+		sanitized := strings.Join(components, "/")
+		slog.WarnContext(ctx, "renamed path for Windows", "path", name, "new path", sanitized, "problems", problems)
+		return sanitized, nil
+	}
+	slog.WarnContext(ctx, "path can not be extracted on Windows", "path", name, "problems", problems)
+	return name, nil
+}
@@ -0,0 +1,134 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"log/slog"
+	"os"
+	"path"
+	"path/filepath"
+	"regexp"
+	"strings"
+)
+
+// Matches project file contents indicating that the project needs a workload
+// (MAUI, mobile platforms or WebAssembly) to build.
+var workloadProjectPattern = regexp.MustCompile(
+	`(?i)<UseMaui>\s*true\s*</UseMaui>|` +
+		`<TargetFrameworks?>[^<]*-(android|ios|maccatalyst|macos|tvos|browser)[^<]*</TargetFrameworks?>|` +
+		`<RunAOTCompilation>\s*true\s*</RunAOTCompilation>|` +
+		`<WasmBuildNative>\s*true\s*</WasmBuildNative>|` +
+		`Sdk="Microsoft\.NET\.Sdk\.BlazorWebAssembly"`)
+
+// Find the projects of the restore targets (relative to srcDir) that need
+// workloads.
+func detectWorkloadProjects(ctx context.Context, srcDir string, targets []string) ([]string, error) {
+	var projects []string
+	for _, target := range targets {
+		paths, err := targetProjects(srcDir, target)
+		if err != nil {
+			return nil, err
+		}
+		for _, project := range paths {
+			buf, err := os.ReadFile(filepath.Join(srcDir, project))
+			if err != nil {
+				return nil, fmt.Errorf("failed to read project %s: %w", project, err)
+			}
+			if workloadProjectPattern.Match(buf) {
+				slog.DebugContext(ctx, "project needs workloads", "project", project)
+				projects = append(projects, project)
+			}
+		}
+	}
+	return projects, nil
+}
+
+// The directory (in the packages directory) workload packs are downloaded
+// into, before they are added as packages.
+const workloadCacheDir = ".workloads"
+
+// Download the workload packs the targets need (with -workloads) into the
+// packages directory, where [importWorkloadPacks] picks them up once the
+// packages are available in the output directory.
+func restoreWorkloads(ctx context.Context, env restoreEnv, srcDir string, targets []string) error {
+	projects, err := detectWorkloadProjects(ctx, srcDir, targets)
+	if err != nil {
+		return err
+	}
+	if len(projects) == 0 {
+		return nil
+	}
+	if !optionsFrom(ctx).workloads {
+		slog.WarnContext(ctx, "projects need workloads, which are not restored; use -workloads to include them", "projects", projects)
+		return nil
+	}
+	cacheDir := path.Join(env.packagesPath(), workloadCacheDir)
+	for _, target := range targets {
+		slog.InfoContext(ctx, "restoring workloads", "solution", target)
+		var output bytes.Buffer
+		// Use the workload manifests of the SDK rather than updating them
+		// over the network, so that the packs only depend on the image.  The
+		// packs come from the configured sources (the proxy without network
+		// access); --source would replace those, so the in-tree feeds, which
+		// do not hold workload packs, are not added.
+		cmd := []string{"dotnet", "workload", "restore", path.Join(env.sourcesPath(), target),
+			"--download-to-cache", cacheDir, "--skip-manifest-update"}
+		err := env.exec(ctx, &output, append(cmd, env.restoreArgs()...)...)
+		if err != nil {
+			return fmt.Errorf("failed to restore workloads of %s: %w\n%s", target, err, output.String())
+		}
+	}
+	return nil
+}
+
+// Add the workload packs downloaded by [restoreWorkloads] to outDir as
+// packages, so that they can be installed from the output like any other
+// package source.
+func importWorkloadPacks(ctx context.Context, outDir string) error {
+	cacheDir := filepath.Join(outDir, workloadCacheDir)
+	defer os.RemoveAll(cacheDir)
+	names, err := filepath.Glob(filepath.Join(cacheDir, "*.nupkg"))
+	if err != nil {
+		return err
+	}
+	for _, name := range names {
+		pkg, err := readNuspec(name)
+		if err != nil {
+			return fmt.Errorf("invalid workload pack %s: %w", filepath.Base(name), err)
+		}
+		id, version := strings.ToLower(pkg.ID), strings.ToLower(pkg.Version)
+		target := filepath.Join(outDir, id, version)
+		if _, err := os.Stat(target); err == nil {
+			continue
+		}
+		slog.InfoContext(ctx, "adding workload pack", "package", pkg.ID, "version", pkg.Version)
+		if err := os.MkdirAll(target, 0o755); err != nil {
+			return err
+		}
+		buf, err := os.ReadFile(name)
+		if err != nil {
+			return err
+		}
+		nupkg := filepath.Join(target, id+"."+version+".nupkg")
+		if err := os.WriteFile(nupkg, buf, 0o644); err != nil {
+			return err
+		}
+		hash, err := hashPackage(target)
+		if err != nil {
+			return err
+		}
+		if err := os.WriteFile(nupkg+".sha512", []byte(hash), 0o644); err != nil {
+			return err
+		}
+		// NuGet only recognizes packages in a folder feed with their .nuspec.
+		nuspec, _, err := readNuspecFile(name)
+		if err != nil {
+			return err
+		}
+		if err := os.WriteFile(filepath.Join(target, id+".nuspec"), nuspec, 0o644); err != nil {
+			return err
+		}
+	}
+	return nil
+}
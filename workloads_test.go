@@ -0,0 +1,60 @@
+package main
+
+import (
+	"archive/zip"
+	"context"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// Write a .nupkg with just a .nuspec for the given package.
+func writeTestNupkg(t *testing.T, name, id, version string) {
+	t.Helper()
+	file, err := os.Create(name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer file.Close()
+	w := zip.NewWriter(file)
+	nuspec, err := w.Create(id + ".nuspec")
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = nuspec.Write([]byte(`<package><metadata><id>` + id + `</id><version>` + version + `</version></metadata></package>`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestImportWorkloadPacks(t *testing.T) {
+	outDir := t.TempDir()
+	cacheDir := filepath.Join(outDir, workloadCacheDir)
+	if err := os.Mkdir(cacheDir, 0o755); err != nil {
+		t.Fatal(err)
+	}
+	writeTestNupkg(t, filepath.Join(cacheDir, "Microsoft.Android.Sdk.Linux.msi.x64.35.0.7.nupkg"), "Microsoft.Android.Sdk.Linux", "35.0.7")
+	if err := importWorkloadPacks(context.Background(), outDir); err != nil {
+		t.Fatal(err)
+	}
+	dir := filepath.Join(outDir, "microsoft.android.sdk.linux", "35.0.7")
+	// The layout NuGet expects of a folder feed (and the global packages
+	// folder): the package, its hash, and its .nuspec.
+	assertExists(t,
+		filepath.Join(dir, "microsoft.android.sdk.linux.35.0.7.nupkg"),
+		filepath.Join(dir, "microsoft.android.sdk.linux.35.0.7.nupkg.sha512"),
+		filepath.Join(dir, "microsoft.android.sdk.linux.nuspec"),
+	)
+	assertRemoved(t, cacheDir)
+	packages, err := readPackages(outDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(packages) != 1 || !strings.EqualFold(packages[0].ID, "Microsoft.Android.Sdk.Linux") {
+		t.Errorf("packages = %+v", packages)
+	}
+}